@@ -2,7 +2,9 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/gosnmp/gosnmp"
 )
@@ -13,13 +15,25 @@ type Alarm struct {
 	Trap   []TrapData
 
 	NeedApply bool
+
+	History *AlarmHistory // 为空时不记录历史
+	Rules   *AlarmRules   // 配置的告警规则, 为空时没有规则
+
+	Debounce *AlarmDebounceConfig // 为空时状态变化立即生效, 不检测抖动
+
+	lastId int // 最近分配的 upsAlarmId
+	flaps  map[string]*alarmFlap
+	now    func() time.Time
 }
 
+// RFC 1628: upsAlarmId 为 PositiveInteger, 达到最大值后从 1 重新开始
+const maxAlarmId = 2147483647
+
 func (a *Alarm) SetSNMP(snmp *SNMP) {
 	a.Snmp = snmp
 }
 
-func (a *Alarm) AddTrap(add bool, index int, oid string) {
+func (a *Alarm) AddTrap(add bool, id int, oid string) {
 	name := "upsTrapAlarmEntryAdded"
 	if !add {
 		name = "upsTrapAlarmEntryRemoved"
@@ -29,11 +43,13 @@ func (a *Alarm) AddTrap(add bool, index int, oid string) {
 		Data: []TrapDataItem{
 			{
 				OID:   "upsAlarmId",
+				Index: id,
 				Type:  gosnmp.Integer,
-				Value: index,
+				Value: id,
 			},
 			{
 				OID:   "upsAlarmDescr",
+				Index: id,
 				Type:  gosnmp.ObjectIdentifier,
 				Value: oid,
 			},
@@ -41,6 +57,30 @@ func (a *Alarm) AddTrap(add bool, index int, oid string) {
 	})
 }
 
+// 分配下一个 upsAlarmId, 跳过仍在表中的 id
+func (a *Alarm) nextId() int {
+	for {
+		a.lastId++
+		if a.lastId > maxAlarmId {
+			a.lastId = 1
+		}
+		if a.find(a.lastId) < 0 {
+			return a.lastId
+		}
+	}
+}
+
+// 返回 id 对应的行在 Alarms 中的位置, 不存在时返回 -1
+func (a *Alarm) find(id int) int {
+	for i, alarm := range a.Alarms {
+		if alarm.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// 添加告警, 返回 upsAlarmId
 func (a *Alarm) Add(desc string) int {
 	if !strings.HasPrefix(desc, ".") {
 		oid := a.Snmp.GetOID(desc, -1)
@@ -51,14 +91,19 @@ func (a *Alarm) Add(desc string) int {
 		desc = oid
 	}
 
-	index := len(a.Alarms)
-	a.AddAlarmEntry(AlarmEntry{
-		Index: index,
+	id := a.nextId()
+	entry := AlarmEntry{
+		Id:    id,
 		Descr: desc,
-		Time:  TimesTamp(getRunningTimeInSeconds()),
-	})
-	a.AddTrap(true, index, desc)
-	return index
+		Time:  getSysUpTime(),
+	}
+	a.AddAlarmEntry(entry)
+	if !a.Flapping(desc) {
+		a.AddTrap(true, id, desc)
+		a.notify(AlarmRaised, entry, 0)
+	}
+	a.record(AlarmRaised, entry)
+	return id
 }
 
 func (a *Alarm) AddAlarmEntry(entry AlarmEntry) {
@@ -67,16 +112,68 @@ func (a *Alarm) AddAlarmEntry(entry AlarmEntry) {
 }
 
 func (a *Alarm) Clear() {
+	for _, entry := range a.Alarms {
+		if !a.Flapping(entry.Descr) {
+			a.notify(AlarmCleared, entry, 0)
+		}
+		a.record(AlarmCleared, entry)
+	}
 	a.Alarms = a.Alarms[:0]
 	a.NeedApply = true
 }
 
-func (a *Alarm) Remove(index int) {
-	if index < len(a.Alarms) {
-		a.AddTrap(false, a.Alarms[index].Index, a.Alarms[index].Descr)
-		a.Alarms = append(a.Alarms[:index], a.Alarms[index+1:]...)
-		a.NeedApply = true
+// 移除 upsAlarmId 为 id 的告警
+func (a *Alarm) Remove(id int) {
+	i := a.find(id)
+	if i < 0 {
+		return
 	}
+	entry := a.Alarms[i]
+	if flap, ok := a.flaps[entry.Descr]; ok {
+		flap.lastId = entry.Id
+	}
+	if !a.Flapping(entry.Descr) {
+		a.AddTrap(false, entry.Id, entry.Descr)
+		a.notify(AlarmCleared, entry, 0)
+	}
+	a.record(AlarmCleared, entry)
+	a.Alarms = append(a.Alarms[:i], a.Alarms[i+1:]...)
+	a.NeedApply = true
+}
+
+// 发送 Webhook / MQTT 事件, 与 Trap 一样在抖动期间不发送。
+// suppressed 为抖动结束时被抑制的变化次数
+func (a *Alarm) notify(event string, entry AlarmEntry, suppressed int) {
+	if a.Snmp == nil || a.Snmp.Notifier == nil {
+		return
+	}
+	webhook := NewWebhookEvent(a.Snmp, WebhookAlarmRaised)
+	if event == AlarmCleared {
+		webhook.Event = WebhookAlarmCleared
+	}
+	webhook.AlarmId = entry.Id
+	webhook.AlarmOID = entry.Descr
+	webhook.AlarmName = a.Snmp.GetName(entry.Descr)
+	webhook.AlarmSuppressed = suppressed
+	a.Snmp.Notifier.Notify(webhook)
+}
+
+// 写入告警历史, 附带当前读数; 抖动期间的每次变化都记录
+func (a *Alarm) record(event string, entry AlarmEntry) {
+	if a.History == nil {
+		return
+	}
+	readings := map[string]float64{}
+	for _, r := range alarmHistoryReadings {
+		value, err := a.Snmp.GetValue(r.Name, r.Index)
+		if err != nil {
+			continue
+		}
+		if v, ok := metricValue(value); ok {
+			readings[alarmHistoryReadingKey(r.Name, r.Index)] = v
+		}
+	}
+	a.History.Record(event, entry, a.Snmp.GetName(entry.Descr), readings)
 }
 
 func (a *Alarm) getOID(desc string) string {
@@ -91,19 +188,58 @@ func (a *Alarm) getOID(desc string) string {
 	return oid
 }
 
+// 按告警类型移除, 返回被移除告警的 upsAlarmId
 func (a *Alarm) RemoveWithDesc(desc string) (int, bool) {
 	desc = a.getOID(desc)
-	for i, alarm := range a.Alarms {
+	for _, alarm := range a.Alarms {
 		if alarm.Descr == desc {
-			a.Remove(i)
-			a.NeedApply = true
-			a.AddTrap(false, alarm.Index, alarm.Descr)
-			return alarm.Index, true
+			a.Remove(alarm.Id)
+			return alarm.Id, true
 		}
 	}
 	return -1, false
 }
 
+// 告警应处的状态
+type AlarmState struct {
+	Name   string
+	Active bool
+}
+
+// 按状态添加或移除告警, 状态不变时不做任何操作。
+// 配置了 Debounce 时状态需连续保持多次才会生效, 见 debounce.go
+func (a *Alarm) Set(desc string, active bool) {
+	desc = a.getOID(desc)
+	exist := a.Exist(desc)
+	if !a.debounce(desc, active, exist) {
+		return
+	}
+	if active {
+		a.Add(desc)
+	} else {
+		a.RemoveWithDesc(desc)
+	}
+}
+
+// 合并两组告警状态, 同名告警任一方有效即有效, 保持首次出现的顺序
+func MergeAlarmStates(states []AlarmState, extra []AlarmState) []AlarmState {
+	result := append([]AlarmState{}, states...)
+	for _, e := range extra {
+		found := false
+		for i := range result {
+			if result[i].Name == e.Name {
+				result[i].Active = result[i].Active || e.Active
+				found = true
+				break
+			}
+		}
+		if !found {
+			result = append(result, e)
+		}
+	}
+	return result
+}
+
 func (a *Alarm) Exist(desc string) bool {
 	desc = a.getOID(desc)
 	for _, alarm := range a.Alarms {
@@ -122,30 +258,34 @@ func (a *Alarm) Apply() {
 	a.Snmp.RemoveAllTable("upsAlarmId")
 	a.Snmp.RemoveAllTable("upsAlarmDescr")
 	a.Snmp.RemoveAllTable("upsAlarmTime")
-	size := len(a.Alarms)
-	a.Snmp.Data.Alarm.Present = size
+	a.Snmp.Data.Alarm.Present = len(a.Alarms)
 
-	if size == 0 {
-		return
+	// 表以 upsAlarmId 为索引, 行的索引在告警存在期间不变
+	var ids []int
+	for _, entry := range a.Alarms {
+		ids = append(ids, entry.Id)
 	}
+	sort.Ints(ids)
 
 	onGet := func(obj any, index int) (any, error) {
-		if index >= size {
-			return nil, nil
+		i := a.find(index)
+		if i < 0 {
+			return nil, fmt.Errorf("%s.%d not found", obj.(string), index)
 		}
+		entry := a.Alarms[i]
 		switch obj.(string) {
 		case "upsAlarmId":
-			return a.Alarms[index].Index, nil
+			return entry.Id, nil
 		case "upsAlarmDescr":
-			return a.Alarms[index].Descr, nil
+			return entry.Descr, nil
 		case "upsAlarmTime":
-			return a.Alarms[index].Time, nil
+			return uint32(entry.Time), nil
 		}
 		return nil, nil
 	}
-	a.Snmp.AddTable("upsAlarmId", "upsAlarmId", size, gosnmp.Integer, onGet)
-	a.Snmp.AddTable("upsAlarmDescr", "upsAlarmDescr", size, gosnmp.ObjectIdentifier, onGet)
-	a.Snmp.AddTable("upsAlarmTime", "upsAlarmTime", size, gosnmp.TimeTicks, onGet)
+	a.Snmp.AddTableIndexes("upsAlarmId", "upsAlarmId", ids, gosnmp.Integer, onGet)
+	a.Snmp.AddTableIndexes("upsAlarmDescr", "upsAlarmDescr", ids, gosnmp.ObjectIdentifier, onGet)
+	a.Snmp.AddTableIndexes("upsAlarmTime", "upsAlarmTime", ids, gosnmp.TimeTicks, onGet)
 	a.Snmp.Apply()
 	for _, trap := range a.Trap {
 		a.Snmp.SendTrap(trap)
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// upsAlarmId 单调递增, 移除告警后其他行的索引不变, 回绕时跳过仍在使用的 id
+func TestAlarmId(t *testing.T) {
+	snmp, traps := newTestTrapAgent(t, "mt1000-pro")
+	public := newTestClient(t, snmp, "public")
+
+	walk := func() map[string]any {
+		t.Helper()
+		pdus, err := public.WalkAll(snmp.GetOID("upsAlarmTable", -1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := map[string]any{}
+		for _, pdu := range pdus {
+			values[snmp.GetName(pdu.Name)] = pduValue(pdu)
+		}
+		return values
+	}
+
+	snmp.Lock.Lock()
+	low := alarm.Add("upsAlarmLowBattery")
+	input := alarm.Add("upsAlarmInputBad")
+	alarm.RemoveWithDesc("upsAlarmLowBattery")
+	fault := alarm.Add("upsAlarmGeneralFault")
+	alarm.Apply()
+	snmp.Lock.Unlock()
+
+	if low != 1 || input != 2 || fault != 3 {
+		t.Fatalf("ids %d %d %d, want 1 2 3", low, input, fault)
+	}
+	values := walk()
+	want := map[string]any{
+		"upsAlarmId.2":    2,
+		"upsAlarmDescr.2": snmp.GetOID("upsAlarmInputBad", -1),
+		"upsAlarmId.3":    3,
+		"upsAlarmDescr.3": snmp.GetOID("upsAlarmGeneralFault", -1),
+	}
+	for name, value := range want {
+		if values[name] != value {
+			t.Errorf("%s = %#v, want %#v", name, values[name], value)
+		}
+	}
+	if len(values) != 6 {
+		t.Errorf("walk %v, want 2 rows", values)
+	}
+
+	// 告警时间为检测时的 sysUpTime
+	uptime := uint32(getSysUpTime())
+	for _, name := range []string{"upsAlarmTime.2", "upsAlarmTime.3"} {
+		v, ok := values[name].(uint32)
+		if !ok || v > uptime || uptime-v > 500 {
+			t.Errorf("%s = %#v, sysUpTime %d", name, values[name], uptime)
+		}
+	}
+
+	snmp.Lock.Lock()
+	alarm.lastId = maxAlarmId - 1
+	wrap := []int{alarm.Add("upsAlarmTempBad"), alarm.Add("upsAlarmOutputBad"), alarm.Add("upsAlarmFanFailure")}
+	alarm.Remove(input)
+	alarm.Apply()
+	snmp.Lock.Unlock()
+	if wrap[0] != maxAlarmId || wrap[1] != 1 || wrap[2] != 4 {
+		t.Fatalf("ids after wrap %v, want [%d 1 4]", wrap, maxAlarmId)
+	}
+	if _, ok := walk()["upsAlarmId.2"]; ok {
+		t.Fatal("removed row upsAlarmId.2 still present")
+	}
+
+	// 每次移除只发送一条 upsTrapAlarmEntryRemoved, 索引与 upsAlarmId 相同
+	time.Sleep(100 * time.Millisecond)
+	removed := traps.find(t, snmp, "upsTrapAlarmEntryRemoved")
+	if len(removed) != 2 {
+		t.Fatalf("received %d upsTrapAlarmEntryRemoved, want 2", len(removed))
+	}
+	for i, id := range []int{low, input} {
+		v := removed[i].Variables[2]
+		if v.Name != snmp.GetOID("upsAlarmId", id) || v.Type != gosnmp.Integer || pduValue(v) != id {
+			t.Errorf("removed trap %d: %s = %#v, want upsAlarmId.%d", i, v.Name, pduValue(v), id)
+		}
+	}
+}
+
+// Q1 / G2 状态位到 upsWellKnownAlarms 的映射
+func TestWellKnownAlarms(t *testing.T) {
+	const threePhaseNormal = "!00000001 00000111 00000000"
+	tests := []struct {
+		name    string
+		profile string
+		g2      string
+		q1      string
+		want    []string
+	}{
+		{"normal", "mt1000-pro", "", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000", nil},
+		{"on battery", "mt1000-pro", "", "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000",
+			[]string{"upsAlarmInputBad", "upsAlarmOnBattery"}},
+		{"on battery low", "mt1000-pro", "", "(000.0 228.0 228.4 017 00.0 21.1 25.0 11001000",
+			[]string{"upsAlarmInputBad", "upsAlarmLowBattery", "upsAlarmOnBattery"}},
+		{"depleted", "mt1000-pro", "", "(228.0 228.0 228.4 017 50.0 21.1 25.0 01001000",
+			[]string{"upsAlarmDepletedBattery", "upsAlarmLowBattery"}},
+		{"standby avr", "mt1000-pro", "", "(190.0 190.0 220.4 017 50.0 27.1 25.0 00101000", nil},
+		{"online bypass", "mt1000-pro", "", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00100000",
+			[]string{"upsAlarmOnBypass"}},
+		{"fault", "mt1000-pro", "", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00011000",
+			[]string{"upsAlarmGeneralFault"}},
+		{"test", "mt1000-pro", "", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001100",
+			[]string{"upsAlarmTestInProgress"}},
+		{"shutting down", "mt1000-pro", "", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001010",
+			[]string{"upsAlarmShutdownImminent", "upsAlarmUpsSystemOff"}},
+		{"output off", "mt1000-pro", "", "(228.0 228.0 000.0 000 50.0 27.1 25.0 00001010",
+			[]string{"upsAlarmOutputOffAsRequested", "upsAlarmUpsSystemOff"}},
+		{"overload", "mt1000-pro", "", "(228.0 228.0 228.4 130 50.0 27.1 25.0 00001000",
+			[]string{"upsAlarmOutputOverload"}},
+
+		{"normal", "three-phase", threePhaseNormal, "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000", nil},
+		{"on battery", "three-phase", "!00000100 00000011 00000000", "(000.0 228.0 228.4 017 00.0 26.1 25.0 00000000",
+			[]string{"upsAlarmBypassBad", "upsAlarmInputBad", "upsAlarmOnBattery"}},
+		{"battery protection", "three-phase", "!00110100 00000011 00000000", "(000.0 228.0 228.4 017 00.0 21.1 25.0 00000000",
+			[]string{"upsAlarmBypassBad", "upsAlarmDepletedBattery", "upsAlarmInputBad", "upsAlarmLowBattery", "upsAlarmOnBattery"}},
+		{"rectifier", "three-phase", "!01000001 00000111 00000000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmChargerFailed"}},
+		{"static bypass", "three-phase", "!00000001 00000101 00000000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmOnBypass"}},
+		{"manual bypass", "three-phase", "!00000001 00001111 00000000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmOnBypass"}},
+		{"bypass frequency", "three-phase", "!00000001 00010111 00000000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmBypassBad"}},
+		{"inverter stopped", "three-phase", "!00000001 00000110 00000000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmUpsOutputOff"}},
+		{"emergency stop", "three-phase", "!00000001 00000111 01000000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmUpsSystemOff"}},
+		{"battery high", "three-phase", "!00000001 00000111 00100000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmBatteryBad"}},
+		{"overload stop", "three-phase", "!00000001 00000111 00001000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmOutputOverload"}},
+		{"inverter voltage", "three-phase", "!00000001 00000111 00000100", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmOutputBad"}},
+		{"over temperature", "three-phase", "!00000001 00000111 00000010", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmTempBad"}},
+		{"short circuit", "three-phase", "!00000001 00000111 00000001", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000000",
+			[]string{"upsAlarmOutputBad"}},
+		{"test", "three-phase", threePhaseNormal, "(228.0 228.0 228.4 017 50.0 27.1 25.0 00000100",
+			[]string{"upsAlarmTestInProgress"}},
+	}
+	for _, test := range tests {
+		t.Run(test.profile+"/"+test.name, func(t *testing.T) {
+			snmp := newTestAgent(t, test.profile, SNMPConfig{})
+			if test.g2 != "" {
+				serialReceived(snmp, "G2", test.g2)
+			}
+			serialReceived(snmp, "Q1", test.q1)
+
+			snmp.Lock.Lock()
+			var got []string
+			for _, entry := range alarm.Alarms {
+				got = append(got, snmp.GetName(entry.Descr))
+			}
+			snmp.Lock.Unlock()
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("alarms %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+// upsShutdownAfterDelay 倒计时期间有 upsAlarmShutdownPending, 取消后下次轮询移除
+func TestControlAlarms(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	exist := func() bool {
+		snmp.Lock.Lock()
+		defer snmp.Lock.Unlock()
+		return alarm.Exist("upsAlarmShutdownPending")
+	}
+
+	snmp.Lock.Lock()
+	control.OnSet("upsShutdownAfterDelay", 600)
+	snmp.Lock.Unlock()
+	if !exist() {
+		t.Fatal("upsAlarmShutdownPending not raised")
+	}
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+	if !exist() {
+		t.Fatal("upsAlarmShutdownPending cleared by poll")
+	}
+
+	snmp.Lock.Lock()
+	control.OnSet("upsShutdownAfterDelay", -1)
+	snmp.Lock.Unlock()
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+	if exist() {
+		t.Fatal("upsAlarmShutdownPending not cleared")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 串口会话的录制与回放。
+// 录制文件每行一条记录: "<RFC3339Nano 时间> <send|recv> <内容>"
+
+const (
+	CaptureSend = "send"
+	CaptureRecv = "recv"
+)
+
+type CaptureEntry struct {
+	Time  time.Time
+	Dir   string
+	Value string
+}
+
+type Capture struct {
+	lock sync.Mutex
+	file io.WriteCloser
+}
+
+// 以追加方式打开录制文件
+func OpenCapture(path string) (*Capture, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &Capture{file: file}, nil
+}
+
+// 记录一行, c 为空时不做任何操作
+func (c *Capture) Record(dir string, value string) {
+	if c == nil {
+		return
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	_, err := fmt.Fprintf(c.file, "%s %s %s\n", time.Now().Format(time.RFC3339Nano), dir, value)
+	if err != nil {
+		Logger.Errorf("Write capture faild: %s", err.Error())
+	}
+}
+
+func (c *Capture) Close() error {
+	if c == nil {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.file.Close()
+}
+
+func ParseCaptureLine(line string) (CaptureEntry, error) {
+	split := strings.SplitN(line, " ", 3)
+	if len(split) < 2 {
+		return CaptureEntry{}, fmt.Errorf("invalid capture line '%s'", line)
+	}
+	t, err := time.Parse(time.RFC3339Nano, split[0])
+	if err != nil {
+		return CaptureEntry{}, err
+	}
+	if split[1] != CaptureSend && split[1] != CaptureRecv {
+		return CaptureEntry{}, fmt.Errorf("invalid capture direction '%s'", split[1])
+	}
+	entry := CaptureEntry{Time: t, Dir: split[1]}
+	if len(split) == 3 {
+		entry.Value = split[2]
+	}
+	return entry, nil
+}
+
+func ReadCapture(r io.Reader) ([]CaptureEntry, error) {
+	var entries []CaptureEntry
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		entry, err := ParseCaptureLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// 回放时交给 Received 的一条应答
+type CaptureReply struct {
+	Time  time.Time
+	Cmd   string // 非 Query 收到的行为空
+	Value string
+}
+
+// 按 TTY.Query 的规则把应答与发送的命令配对:
+// 原样返回的命令和 "@" 被丢弃, 不以应答起始字符开头的迟到应答被丢弃。
+// 录制中不区分 Send 和 Query, 只有 ReplyPrefix 不为 0 的命令会等待应答
+func CaptureReplies(entries []CaptureEntry) []CaptureReply {
+	var replies []CaptureReply
+	pending := ""
+	last := ""
+	for _, entry := range entries {
+		if entry.Dir == CaptureSend {
+			last = entry.Value
+			pending = ""
+			if ReplyPrefix(entry.Value) != 0 {
+				pending = entry.Value
+			}
+			continue
+		}
+
+		// 无效命令的回显
+		if entry.Value == last {
+			last = ""
+			pending = ""
+			continue
+		}
+		if pending == "" {
+			replies = append(replies, CaptureReply{Time: entry.Time, Value: entry.Value})
+			continue
+		}
+		if entry.Value == "@" {
+			pending = ""
+			continue
+		}
+		i := strings.IndexByte(entry.Value, ReplyPrefix(pending))
+		if i < 0 {
+			continue
+		}
+		replies = append(replies, CaptureReply{Time: entry.Time, Cmd: pending, Value: entry.Value[i:]})
+		pending = ""
+	}
+	return replies
+}
+
+// 由录制中的探测应答得到 ProbeResult, 用于回放时自动识别设备
+func ProbeCapture(replies []CaptureReply) (*ProbeResult, error) {
+	result := &ProbeResult{}
+	for _, reply := range replies {
+		parse, err := ProtoParseReply(reply.Cmd, reply.Value)
+		if err != nil || reply.Cmd == "" {
+			continue
+		}
+		switch v := parse.(type) {
+		case QueryResult:
+			if result.Query == nil {
+				result.Query = &v
+			}
+		case UPSInfo:
+			if result.Info == nil {
+				result.Info = &v
+			}
+		case RatingInfo:
+			if result.Rating == nil {
+				result.Rating = &v
+			}
+		case TPRating, ExtraQueryResult:
+			result.ThreePhase = true
+		}
+	}
+	if result.Query == nil {
+		return nil, fmt.Errorf("no Q1 reply in capture")
+	}
+	return result, nil
+}
+
+type Replay struct {
+	Replies []CaptureReply
+	Speed   float64 // 1 为原速, 大于 1 时加速
+
+	// 与 TTYConfig.Received 相同
+	Received func(userData any, cmd string, value string)
+
+	stop chan struct{}
+}
+
+func OpenReplay(path string, speed float64) (*Replay, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entries, err := ReadCapture(file)
+	if err != nil {
+		return nil, err
+	}
+	if speed <= 0 {
+		speed = 1
+	}
+	return &Replay{
+		Replies: CaptureReplies(entries),
+		Speed:   speed,
+		stop:    make(chan struct{}),
+	}, nil
+}
+
+// 按录制时的间隔把应答交给 Received, 全部回放完或 Close 后返回
+func (r *Replay) Run(userData any) {
+	var last time.Time
+	for i, reply := range r.Replies {
+		if i > 0 {
+			delay := time.Duration(float64(reply.Time.Sub(last)) / r.Speed)
+			if delay > 0 {
+				select {
+				case <-r.stop:
+					return
+				case <-time.After(delay):
+				}
+			}
+		}
+		last = reply.Time
+
+		Logger.Debugf("replay recv: %s %s", reply.Cmd, reply.Value)
+		if r.Received != nil {
+			r.Received(userData, reply.Cmd, reply.Value)
+		}
+	}
+	Logger.Infof("Replay finished, %d replies", len(r.Replies))
+}
+
+func (r *Replay) Close() {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// 录制一段模拟器会话, 回放时应得到同样的应答
+func TestCaptureReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ups.capture")
+	capture, err := OpenCapture(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sim, err := NewSimulator(SimulatorConfig{Model: "three-phase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+
+	type received struct{ cmd, value string }
+	var live []received
+	tty, err := serialInit(TTYConfig{
+		Port:    "simulator",
+		Open:    sim.Open,
+		Timeout: time.Second,
+		Capture: capture,
+		Received: func(userData any, cmd string, value string) {
+			live = append(live, received{cmd, value})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range []string{"Q1", "I", "F", "GF", "X9", "G1", "G2", "G3", "Q1"} {
+		tty.Poll(cmd, 0)
+	}
+	tty.Close()
+	capture.Close()
+
+	replay, err := OpenReplay(path, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replayed []received
+	replay.Received = func(userData any, cmd string, value string) {
+		replayed = append(replayed, received{cmd, value})
+	}
+	replay.Run(nil)
+
+	if len(replayed) != len(live) {
+		t.Fatalf("replayed %d replies, want %d", len(replayed), len(live))
+	}
+	for i := range live {
+		if replayed[i] != live[i] {
+			t.Fatalf("reply %d: got %v, want %v", i, replayed[i], live[i])
+		}
+	}
+
+	profile, err := DetectReplayProfile(replay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "three-phase" {
+		t.Fatalf("detected %s, want three-phase", profile.Name)
+	}
+}
+
+func TestCaptureReplies(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	entries := []CaptureEntry{
+		{base, CaptureSend, "Q1"},
+		{base, CaptureRecv, "(228.0 228.0 228.4 006 50.2 27.4 25.0 00001000"},
+		{base, CaptureSend, "I"},
+		{base, CaptureRecv, "@"},
+		{base, CaptureSend, "T"},
+		{base, CaptureSend, "F"},
+		{base, CaptureRecv, "(228.0 228.0 228.4 006 50.2 27.4 25.0 00001000"},
+		{base, CaptureRecv, "x#220.0 007 24.00 50.0"},
+		{base, CaptureRecv, "(000.0 228.0 228.4 017 00.0 24.1 25.0 11001001"},
+	}
+	want := []CaptureReply{
+		{base, "Q1", "(228.0 228.0 228.4 006 50.2 27.4 25.0 00001000"},
+		{base, "F", "#220.0 007 24.00 50.0"},
+		{base, "", "(000.0 228.0 228.4 017 00.0 24.1 25.0 11001001"},
+	}
+
+	replies := CaptureReplies(entries)
+	if len(replies) != len(want) {
+		t.Fatalf("got %v, want %v", replies, want)
+	}
+	for i := range want {
+		if replies[i] != want[i] {
+			t.Fatalf("reply %d: got %v, want %v", i, replies[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// UPS 接受的最短关机延时为 .2 分钟
+const minShutdownSeconds = 12
+
+// 在开机延时中发送 C, UPS 延时 10 秒后开机
+const cancelStartupSeconds = 10
+
+// RFC 1628: 关机前 5 秒内需要出现 upsAlarmShutdownImminent
+const shutdownImminentSeconds = 5
+
+// 倒计时按时间推进的间隔, 与轮询无关, 通讯中断时读回值也会继续减少
+const controlTickInterval = time.Second
+
+// Control 实现 upsControl 组的倒计时。
+// 倒计时由 Agent 维护, 到期前才把 S<m> / S<m>R<m2> / C 下发给 UPS,
+// 这样读回的剩余秒数和 -1 取消都能精确对应 UPS 的实际动作。
+type Control struct {
+	Snmp *SNMP
+
+	ShutdownAt time.Time // upsShutdownAfterDelay 到期时间
+	StartupAt  time.Time // upsStartupAfterDelay 到期时间
+	RebootAt   time.Time // upsRebootWithDuration 到期时间
+	OffAt      time.Time // 已下发关机命令, UPS 输出关闭的时间
+
+	ShutdownSent bool // 关机命令已下发给 UPS
+	StartupByUPS bool // 开机延时已通过 R<m2> 交给 UPS
+
+	stop chan struct{}
+}
+
+func (c *Control) SetSNMP(snmp *SNMP) {
+	c.Snmp = snmp
+	c.stop = make(chan struct{})
+}
+
+// 每 controlTickInterval 推进一次倒计时, 直到 Close
+func (c *Control) Run() {
+	ticker := time.NewTicker(controlTickInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.Snmp.Lock.Lock()
+			c.Tick()
+			alarm.Apply()
+			c.Snmp.Lock.Unlock()
+		}
+	}
+}
+
+func (c *Control) Close() {
+	select {
+	case <-c.stop:
+	default:
+		close(c.stop)
+	}
+}
+
+func secondsUntil(now time.Time, t time.Time) int {
+	if t.IsZero() {
+		return -1
+	}
+	remaining := int(t.Sub(now).Round(time.Second) / time.Second)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+func restartMinutes(d time.Duration) int {
+	minutes := int((d + time.Minute - 1) / time.Minute)
+	if minutes < 1 {
+		return 1
+	}
+	if minutes > 9999 {
+		return 9999
+	}
+	return minutes
+}
+
+func (c *Control) send(cmd string) {
+	if cmd == "" {
+		Logger.Warnf("Control command not supported by device")
+		return
+	}
+	Logger.Infof("Control send: %s", cmd)
+	c.Snmp.TtySend(cmd)
+}
+
+// 下发关机命令, UPS 在 minShutdownSeconds 后关闭输出。
+// restart > 0 时使用 S<m>R<m2>, 否则按 upsAutoRestart 决定是否带 R。
+func (c *Control) sendShutdown(now time.Time, restart time.Duration) {
+	device := c.Snmp.Device
+	delay := FormatShutdownDelay(minShutdownSeconds)
+	switch {
+	case restart > 0:
+		c.send(fmt.Sprintf(device.PoweroffAndStart, delay, restartMinutes(restart)))
+	case c.Snmp.Data.Control.AutoRestart == 2:
+		// 不自动重启: 用最长的开机延时代替
+		c.send(fmt.Sprintf(device.PoweroffAndStart, delay, 9999))
+	default:
+		c.send(fmt.Sprintf(device.Poweroff, delay))
+	}
+	c.ShutdownSent = true
+	c.OffAt = now.Add(minShutdownSeconds * time.Second)
+}
+
+func (c *Control) cancelShutdown() {
+	if c.ShutdownSent || !c.OffAt.IsZero() {
+		c.send(c.Snmp.Device.CancelAllPoweroff)
+	}
+	c.ShutdownAt = time.Time{}
+	c.OffAt = time.Time{}
+	c.ShutdownSent = false
+}
+
+// 处理 upsControl 组的 SET, name 为 MIB 对象名。
+func (c *Control) OnSet(name string, value int) {
+	now := time.Now()
+	switch name {
+	case "upsShutdownAfterDelay":
+		if value < 0 {
+			c.cancelShutdown()
+			if c.StartupByUPS {
+				c.StartupAt = time.Time{}
+				c.StartupByUPS = false
+			}
+			break
+		}
+		if value < minShutdownSeconds {
+			value = minShutdownSeconds
+		}
+		c.cancelShutdown()
+		c.ShutdownAt = now.Add(time.Duration(value) * time.Second)
+	case "upsStartupAfterDelay":
+		if value < 0 {
+			if c.StartupByUPS {
+				Logger.Warnf("Startup countdown already handed to UPS, it can not be aborted")
+			}
+			c.StartupAt = time.Time{}
+			c.StartupByUPS = false
+			break
+		}
+		if value < cancelStartupSeconds {
+			value = cancelStartupSeconds
+		}
+		c.StartupAt = now.Add(time.Duration(value) * time.Second)
+		c.StartupByUPS = false
+		c.RebootAt = time.Time{}
+	case "upsRebootWithDuration":
+		if value < 0 {
+			if !c.RebootAt.IsZero() {
+				c.send(c.Snmp.Device.CancelAllPoweroff)
+			}
+			c.RebootAt = time.Time{}
+			c.OffAt = time.Time{}
+			break
+		}
+		c.ShutdownAt = time.Time{}
+		c.StartupAt = time.Time{}
+		c.StartupByUPS = false
+		c.sendShutdown(now, time.Duration(value)*time.Second)
+		c.ShutdownSent = false
+		c.RebootAt = c.OffAt.Add(time.Duration(restartMinutes(time.Duration(value)*time.Second)) * time.Minute)
+	case "upsShutdownType", "upsAutoRestart":
+		// 协议只能关闭输出, 两种关机类型都按输出处理; upsAutoRestart 在下发关机命令时生效
+	}
+	c.Tick()
+}
+
+// 由 Run 定时调用, 轮询和 SET 时也会调用, 推进倒计时并刷新 upsControl 读回值和相关告警。
+func (c *Control) Tick() {
+	if c.Snmp == nil {
+		return
+	}
+	now := time.Now()
+
+	if !c.ShutdownAt.IsZero() && !c.ShutdownSent && secondsUntil(now, c.ShutdownAt) <= minShutdownSeconds {
+		restart := time.Duration(0)
+		if !c.StartupAt.IsZero() && c.StartupAt.After(c.ShutdownAt) {
+			restart = c.StartupAt.Sub(c.ShutdownAt)
+			c.StartupByUPS = true
+		}
+		c.sendShutdown(now, restart)
+		c.OffAt = c.ShutdownAt
+	}
+	if !c.ShutdownAt.IsZero() && !now.Before(c.ShutdownAt) {
+		c.ShutdownAt = time.Time{}
+		c.ShutdownSent = false
+	}
+
+	if !c.StartupAt.IsZero() && c.ShutdownAt.IsZero() {
+		if !c.StartupByUPS && secondsUntil(now, c.StartupAt) <= cancelStartupSeconds {
+			// 开机延时中的 UPS 收到 C 后延时 10 秒开机
+			c.send(c.Snmp.Device.CancelAllPoweroff)
+			c.StartupByUPS = true
+		}
+		if !now.Before(c.StartupAt) {
+			c.StartupAt = time.Time{}
+			c.StartupByUPS = false
+		}
+	}
+
+	if !c.RebootAt.IsZero() && !now.Before(c.RebootAt) {
+		c.RebootAt = time.Time{}
+	}
+	if !c.OffAt.IsZero() && !now.Before(c.OffAt) {
+		c.OffAt = time.Time{}
+	}
+
+	control := c.Snmp.Data.Control
+	control.ShutdownAfter = secondsUntil(now, c.ShutdownAt)
+	control.StartupAfter = secondsUntil(now, c.StartupAt)
+	control.RebootDuration = secondsUntil(now, c.RebootAt)
+
+	// 只添加告警, 移除由轮询完成, 以免清掉状态位得到的同名告警
+	for _, state := range c.Alarms() {
+		if state.Active && !alarm.Exist(state.Name) {
+			alarm.Add(state.Name)
+		}
+	}
+}
+
+// 倒计时对应的告警, 轮询时与状态位得到的告警合并
+func (c *Control) Alarms() []AlarmState {
+	now := time.Now()
+	return []AlarmState{
+		{"upsAlarmShutdownPending", !c.ShutdownAt.IsZero()},
+		{"upsAlarmShutdownImminent", !c.OffAt.IsZero() && secondsUntil(now, c.OffAt) <= shutdownImminentSeconds},
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 记录下发的串口命令
+func recordSerialSend(snmp *SNMP) func() []string {
+	var lock sync.Mutex
+	var sent []string
+	snmp.SetSerialSend(func(cmd string) {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, cmd)
+	})
+	return func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		commands := sent
+		sent = nil
+		return commands
+	}
+}
+
+func TestFormatShutdownDelay(t *testing.T) {
+	for _, test := range []struct {
+		seconds int
+		want    string
+	}{
+		{0, ".2"},
+		{12, ".2"},
+		{30, ".5"},
+		{59, ".9"},
+		{60, "01"},
+		{150, "02"},
+		{600, "10"},
+		{3600, "10"},
+	} {
+		if got := FormatShutdownDelay(test.seconds); got != test.want {
+			t.Errorf("FormatShutdownDelay(%d) = %s, want %s", test.seconds, got, test.want)
+		}
+	}
+}
+
+// 小于 12 秒的关机延时按 12 秒处理, 并立即下发 S.2
+func TestControlShutdownClamp(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	sent := recordSerialSend(snmp)
+
+	snmp.Lock.Lock()
+	defer snmp.Lock.Unlock()
+	control.OnSet("upsShutdownAfterDelay", 1)
+	if after := data.Control.ShutdownAfter; after != minShutdownSeconds {
+		t.Errorf("upsShutdownAfterDelay %d, want %d", after, minShutdownSeconds)
+	}
+	if got := fmt.Sprint(sent()); got != "[S.2]" {
+		t.Errorf("sent %s, want [S.2]", got)
+	}
+	if !control.ShutdownSent {
+		t.Error("shutdown not marked as sent")
+	}
+}
+
+// 命令下发前取消只清除倒计时, 下发后取消需要发送 C
+func TestControlShutdownCancel(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	sent := recordSerialSend(snmp)
+
+	snmp.Lock.Lock()
+	defer snmp.Lock.Unlock()
+	control.OnSet("upsShutdownAfterDelay", 600)
+	if after := data.Control.ShutdownAfter; after < 599 || after > 600 {
+		t.Errorf("upsShutdownAfterDelay %d, want 600", after)
+	}
+	control.OnSet("upsShutdownAfterDelay", -1)
+	if after := data.Control.ShutdownAfter; after != -1 {
+		t.Errorf("upsShutdownAfterDelay %d after cancel, want -1", after)
+	}
+	if got := sent(); len(got) != 0 {
+		t.Errorf("sent %v before shutdown command", got)
+	}
+
+	control.OnSet("upsShutdownAfterDelay", 0)
+	control.OnSet("upsShutdownAfterDelay", -1)
+	if got := fmt.Sprint(sent()); got != "[S.2 C]" {
+		t.Errorf("sent %s, want [S.2 C]", got)
+	}
+	if !control.OffAt.IsZero() || control.ShutdownSent {
+		t.Errorf("shutdown not cancelled: %+v", control)
+	}
+}
+
+// 不自动重启和超长的重启时间都使用 R9999
+func TestControlRestartLimit(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	sent := recordSerialSend(snmp)
+
+	snmp.Lock.Lock()
+	defer snmp.Lock.Unlock()
+	data.Control.AutoRestart = 2
+	control.OnSet("upsShutdownAfterDelay", 0)
+	if got := fmt.Sprint(sent()); got != "[S.2R9999]" {
+		t.Errorf("sent %s, want [S.2R9999]", got)
+	}
+
+	control.OnSet("upsShutdownAfterDelay", -1)
+	sent()
+	control.OnSet("upsRebootWithDuration", 10000*60*60)
+	if got := fmt.Sprint(sent()); got != "[S.2R9999]" {
+		t.Errorf("sent %s, want [S.2R9999]", got)
+	}
+	control.OnSet("upsRebootWithDuration", 90)
+	if got := fmt.Sprint(sent()); got != "[S.2R0002]" {
+		t.Errorf("sent %s, want [S.2R0002]", got)
+	}
+}
+
+// 通讯中断时没有 Q1 应答, 倒计时仍按时间推进并按时下发关机命令
+func TestControlCountdownWithoutPoll(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	sent := recordSerialSend(snmp)
+
+	snmp.Lock.Lock()
+	control.OnSet("upsShutdownAfterDelay", 60)
+	// 一次 Tick 后剩余时间进入 minShutdownSeconds
+	control.ShutdownAt = time.Now().Add((minShutdownSeconds + 1) * time.Second)
+	alarm.Add("upsAlarmCommunicationsLost")
+	snmp.Lock.Unlock()
+
+	go control.Run()
+	t.Cleanup(control.Close)
+	time.Sleep(controlTickInterval + 500*time.Millisecond)
+
+	snmp.Lock.Lock()
+	defer snmp.Lock.Unlock()
+	if after := data.Control.ShutdownAfter; after < minShutdownSeconds-1 || after > minShutdownSeconds {
+		t.Errorf("upsShutdownAfterDelay %d, want %d", after, minShutdownSeconds)
+	}
+	if got := fmt.Sprint(sent()); got != "[S.2]" {
+		t.Errorf("sent %s, want [S.2]", got)
+	}
+}
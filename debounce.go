@@ -0,0 +1,145 @@
+package main
+
+import "time"
+
+// 告警的去抖和抖动抑制, 只作用于 Alarm.Set (每次轮询按状态设置的告警)。
+// 状态需连续保持 Raise / Clear 次才会产生 / 清除告警;
+// FlapWindow 内变化达到 FlapChanges 次时告警标记为抖动, 不再发送该告警的 Trap 和 Webhook 事件,
+// 连续 FlapQuiet 没有变化后结束抖动, 按当前状态补发一条 Trap 和一条事件。
+
+type AlarmDebounceCount struct {
+	Raise int // 产生告警前需要连续成立的次数
+	Clear int // 清除告警前需要连续不成立的次数
+}
+
+type AlarmDebounceConfig struct {
+	AlarmDebounceCount                               // 默认值
+	Alarms             map[string]AlarmDebounceCount // 告警名 -> 次数, 覆盖默认值
+
+	FlapChanges int           // 为 0 时不检测抖动
+	FlapWindow  time.Duration // 统计变化次数的时间窗口
+	FlapQuiet   time.Duration // 没有变化多久后结束抖动
+}
+
+type alarmFlap struct {
+	count      int         // 与当前告警状态不同的连续次数
+	changes    []time.Time // 窗口内的状态变化时间
+	lastChange time.Time
+	lastId     int // 最近一次的 upsAlarmId, 用于结束抖动时的 Trap
+
+	Flapping   bool
+	Suppressed int // 抖动期间未发送 Trap 的变化次数
+}
+
+func (a *Alarm) time() time.Time {
+	if a.now != nil {
+		return a.now()
+	}
+	return time.Now()
+}
+
+func (a *Alarm) flap(oid string) *alarmFlap {
+	if a.flaps == nil {
+		a.flaps = map[string]*alarmFlap{}
+	}
+	flap, ok := a.flaps[oid]
+	if !ok {
+		flap = &alarmFlap{}
+		a.flaps[oid] = flap
+	}
+	return flap
+}
+
+// 告警是否处于抖动状态, 抖动时不发送 Trap
+func (a *Alarm) Flapping(desc string) bool {
+	flap, ok := a.flaps[a.getOID(desc)]
+	return ok && flap.Flapping
+}
+
+func (a *Alarm) debounceCount(oid string) AlarmDebounceCount {
+	count := AlarmDebounceCount{Raise: 1, Clear: 1}
+	if a.Debounce == nil {
+		return count
+	}
+	if a.Debounce.Raise > 0 {
+		count.Raise = a.Debounce.Raise
+	}
+	if a.Debounce.Clear > 0 {
+		count.Clear = a.Debounce.Clear
+	}
+	if c, ok := a.Debounce.Alarms[a.Snmp.GetName(oid)]; ok {
+		if c.Raise > 0 {
+			count.Raise = c.Raise
+		}
+		if c.Clear > 0 {
+			count.Clear = c.Clear
+		}
+	}
+	return count
+}
+
+// 判断告警状态是否应该改变, exist 为告警当前是否存在
+func (a *Alarm) debounce(oid string, active bool, exist bool) bool {
+	flap := a.flap(oid)
+	now := a.time()
+	a.checkFlapEnd(oid, flap, exist, now)
+
+	if active == exist {
+		flap.count = 0
+		return false
+	}
+	flap.count++
+	count := a.debounceCount(oid)
+	need := count.Clear
+	if active {
+		need = count.Raise
+	}
+	if flap.count < need {
+		return false
+	}
+	flap.count = 0
+	flap.lastChange = now
+
+	if a.Debounce == nil || a.Debounce.FlapChanges <= 0 {
+		return true
+	}
+	changes := flap.changes[:0]
+	for _, t := range flap.changes {
+		if now.Sub(t) < a.Debounce.FlapWindow {
+			changes = append(changes, t)
+		}
+	}
+	flap.changes = append(changes, now)
+	if !flap.Flapping && len(flap.changes) >= a.Debounce.FlapChanges {
+		flap.Flapping = true
+		flap.Suppressed = 0
+		Logger.Warnf("Alarm %s is flapping (%d changes in %s), traps suppressed", a.Snmp.GetName(oid), len(flap.changes), a.Debounce.FlapWindow)
+	}
+	if flap.Flapping {
+		flap.Suppressed++
+	}
+	return true
+}
+
+// 抖动结束时按当前状态补发一条 Trap 和一条带抑制次数的事件
+func (a *Alarm) checkFlapEnd(oid string, flap *alarmFlap, exist bool, now time.Time) {
+	if !flap.Flapping || now.Sub(flap.lastChange) < a.Debounce.FlapQuiet {
+		return
+	}
+	flap.Flapping = false
+	flap.changes = nil
+	Logger.Infof("Alarm %s stopped flapping, %d changes suppressed, now %s", a.Snmp.GetName(oid), flap.Suppressed, map[bool]string{true: "active", false: "cleared"}[exist])
+
+	if exist {
+		for _, entry := range a.Alarms {
+			if entry.Descr == oid {
+				a.AddTrap(true, entry.Id, oid)
+				a.notify(AlarmRaised, entry, flap.Suppressed)
+			}
+		}
+	} else if flap.lastId != 0 {
+		a.AddTrap(false, flap.lastId, oid)
+		a.notify(AlarmCleared, AlarmEntry{Id: flap.lastId, Descr: oid}, flap.Suppressed)
+	}
+	a.NeedApply = true
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testQ1Mains   = "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000"
+	testQ1Battery = "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000"
+)
+
+// 状态需连续保持配置的轮询次数才生效, 中途恢复时重新计数
+func TestAlarmDebounce(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	alarm.Debounce = &AlarmDebounceConfig{
+		AlarmDebounceCount: AlarmDebounceCount{Raise: 2, Clear: 1},
+		Alarms: map[string]AlarmDebounceCount{
+			"upsAlarmInputBad": {Clear: 3}, // 未配置的次数使用默认值
+		},
+	}
+
+	for i, step := range []struct {
+		q1     string
+		active bool
+	}{
+		{testQ1Battery, false},
+		{testQ1Mains, false},
+		{testQ1Battery, false},
+		{testQ1Battery, true},
+		{testQ1Mains, true},
+		{testQ1Mains, true},
+		{testQ1Battery, true}, // 中途恢复, 重新计数
+		{testQ1Mains, true},
+		{testQ1Mains, true},
+		{testQ1Mains, false},
+	} {
+		serialReceived(snmp, "Q1", step.q1)
+		snmp.Lock.Lock()
+		active := alarm.Exist("upsAlarmInputBad")
+		snmp.Lock.Unlock()
+		if active != step.active {
+			t.Fatalf("step %d: upsAlarmInputBad %v, want %v", i, active, step.active)
+		}
+	}
+}
+
+// 抖动期间不发送该告警的 Trap 和事件, 结束后按当前状态补发一条
+func TestAlarmFlapping(t *testing.T) {
+	snmp, traps := newTestTrapAgent(t, "mt1000-pro")
+	alarm.Debounce = &AlarmDebounceConfig{
+		FlapChanges: 4,
+		FlapWindow:  time.Minute,
+		FlapQuiet:   time.Minute,
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	alarm.now = func() time.Time { return now }
+
+	var lock sync.Mutex
+	var events []WebhookEvent
+	notifier, err := NewNotifier(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notifier.AddHandler(func(event WebhookEvent) {
+		lock.Lock()
+		defer lock.Unlock()
+		if event.AlarmName == "upsAlarmInputBad" {
+			events = append(events, event)
+		}
+	})
+	snmp.Lock.Lock()
+	snmp.Notifier = notifier
+	snmp.Lock.Unlock()
+	countEvents := func(event string) (int, int) {
+		lock.Lock()
+		defer lock.Unlock()
+		n, suppressed := 0, 0
+		for _, e := range events {
+			if e.Event == event {
+				n++
+				suppressed += e.AlarmSuppressed
+			}
+		}
+		return n, suppressed
+	}
+
+	inputBad := snmp.GetOID("upsAlarmInputBad", -1)
+	count := func(name string) int {
+		time.Sleep(100 * time.Millisecond)
+		n := 0
+		for _, packet := range traps.find(t, snmp, name) {
+			if packet.Variables[3].Value == inputBad {
+				n++
+			}
+		}
+		return n
+	}
+
+	// 前 3 次变化正常发送, 第 4 次起抑制
+	for i := 0; i < 8; i++ {
+		now = now.Add(5 * time.Second)
+		if i%2 == 0 {
+			serialReceived(snmp, "Q1", testQ1Battery)
+		} else {
+			serialReceived(snmp, "Q1", testQ1Mains)
+		}
+	}
+	added, removed := count("upsTrapAlarmEntryAdded"), count("upsTrapAlarmEntryRemoved")
+	if added != 2 || removed != 1 {
+		t.Fatalf("received %d added %d removed while flapping, want 2 1", added, removed)
+	}
+	raised, _ := countEvents(WebhookAlarmRaised)
+	cleared, _ := countEvents(WebhookAlarmCleared)
+	if raised != 2 || cleared != 1 {
+		t.Fatalf("%d raised %d cleared events while flapping, want 2 1", raised, cleared)
+	}
+	snmp.Lock.Lock()
+	flapping := alarm.Flapping("upsAlarmInputBad")
+	snmp.Lock.Unlock()
+	if !flapping {
+		t.Fatal("upsAlarmInputBad not flapping")
+	}
+
+	// 停在电池供电, 安静期内仍不发送
+	now = now.Add(5 * time.Second)
+	serialReceived(snmp, "Q1", testQ1Battery)
+	now = now.Add(30 * time.Second)
+	serialReceived(snmp, "Q1", testQ1Battery)
+	if n := count("upsTrapAlarmEntryAdded"); n != 2 {
+		t.Fatalf("received %d added before quiet period, want 2", n)
+	}
+
+	now = now.Add(30 * time.Second)
+	serialReceived(snmp, "Q1", testQ1Battery)
+	if n := count("upsTrapAlarmEntryAdded"); n != 3 {
+		t.Fatalf("received %d added after flapping, want 3", n)
+	}
+	// 第 4 次起的 6 次变化被抑制
+	if raised, suppressed := countEvents(WebhookAlarmRaised); raised != 3 || suppressed != 6 {
+		t.Fatalf("%d raised events with %d suppressed after flapping, want 3 with 6", raised, suppressed)
+	}
+	snmp.Lock.Lock()
+	flapping = alarm.Flapping("upsAlarmInputBad")
+	snmp.Lock.Unlock()
+	if flapping {
+		t.Fatal("upsAlarmInputBad still flapping")
+	}
+
+	// 之后的变化正常发送
+	now = now.Add(5 * time.Second)
+	serialReceived(snmp, "Q1", testQ1Mains)
+	if n := count("upsTrapAlarmEntryRemoved"); n != 2 {
+		t.Fatalf("received %d removed after flapping, want 2", n)
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// 探测时每条命令的等待时间
+const probeTimeout = 2 * time.Second
+
+// 探测次数, 串口刚打开时 UPS 可能还没有应答
+const probeRetry = 3
+
+// 启动时等待串口连接和 UPS 应答的最长时间, 超过后使用默认配置启动
+const probeWait = 30 * time.Second
+
+// 启动时探测到的 UPS 信息
+type ProbeResult struct {
+	Info       *UPSInfo     // I, 不支持时为空
+	Rating     *RatingInfo  // F
+	Query      *QueryResult // Q1
+	ThreePhase bool         // GF 或 G1 有应答
+}
+
+func (r *ProbeResult) String() string {
+	result := ""
+	if r.Info != nil {
+		result += fmt.Sprintf("company='%s' model='%s' version='%s' ", r.Info.Company, r.Info.Model, r.Info.Version)
+	}
+	if r.Rating != nil {
+		result += fmt.Sprintf("rating=%.1fV/%dA ", r.Rating.VoltageRating, r.Rating.CurrentRating)
+	}
+	if r.Query != nil {
+		result += fmt.Sprintf("online=%t ", !r.Query.Status.UPSType)
+	}
+	result += fmt.Sprintf("three-phase=%t", r.ThreePhase)
+	return result
+}
+
+func probeQuery(tty *TTY, cmd string) (any, error) {
+	value, err := tty.Query(cmd, probeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	return ProtoParseReply(cmd, value)
+}
+
+// 依次发送 Q1 / I / F / GF / G1 获取 UPS 信息
+func ProbeDevice(tty *TTY) (*ProbeResult, error) {
+	result := &ProbeResult{}
+
+	var err error
+	for i := 0; i < probeRetry; i++ {
+		var parse any
+		parse, err = probeQuery(tty, "Q1")
+		if err == nil {
+			query := parse.(QueryResult)
+			result.Query = &query
+			break
+		}
+		Logger.Debugf("Probe Q1: %s", err.Error())
+		time.Sleep(time.Second)
+	}
+	if result.Query == nil {
+		return nil, err
+	}
+
+	if parse, err := probeQuery(tty, "I"); err == nil {
+		info := parse.(UPSInfo)
+		result.Info = &info
+	} else {
+		Logger.Debugf("Probe I: %s", err.Error())
+	}
+
+	if parse, err := probeQuery(tty, "F"); err == nil {
+		rating := parse.(RatingInfo)
+		result.Rating = &rating
+	} else {
+		Logger.Debugf("Probe F: %s", err.Error())
+	}
+
+	for _, cmd := range []string{"GF", "G1"} {
+		_, err := probeQuery(tty, cmd)
+		if err == nil {
+			result.ThreePhase = true
+			break
+		}
+		Logger.Debugf("Probe %s: %s", cmd, err.Error())
+	}
+
+	return result, nil
+}
+
+// 计算设备配置与探测结果的匹配程度, 返回匹配的条件数, 有条件不满足时返回 -1
+func MatchDeviceProfile(profile *DeviceProfile, probe *ProbeResult) int {
+	detect := profile.Detect
+	score := 0
+
+	matchString := func(expr string, value func(info *UPSInfo) string) bool {
+		if expr == "" {
+			return true
+		}
+		if probe.Info == nil {
+			return false
+		}
+		matched, _ := regexp.MatchString("(?i)"+expr, value(probe.Info))
+		if matched {
+			score++
+		}
+		return matched
+	}
+
+	if !matchString(detect.Manufacturer, func(info *UPSInfo) string { return info.Company }) {
+		return -1
+	}
+	if !matchString(detect.Model, func(info *UPSInfo) string { return info.Model }) {
+		return -1
+	}
+
+	if detect.RatedCurrent != 0 {
+		if probe.Rating == nil || probe.Rating.CurrentRating != detect.RatedCurrent {
+			return -1
+		}
+		score++
+	}
+
+	if detect.Online != nil {
+		if probe.Query == nil || *detect.Online != !probe.Query.Status.UPSType {
+			return -1
+		}
+		score++
+	}
+
+	if detect.ThreePhase != nil {
+		if *detect.ThreePhase != probe.ThreePhase {
+			return -1
+		}
+		score++
+	}
+
+	return score
+}
+
+// 选择匹配条件最多的设备配置, 没有任何识别规则的配置不参与自动选择
+func SelectDeviceProfile(profiles []*DeviceProfile, probe *ProbeResult) (*DeviceProfile, error) {
+	var best *DeviceProfile
+	bestScore := 0
+	for _, profile := range profiles {
+		score := MatchDeviceProfile(profile, probe)
+		Logger.Debugf("Profile %s score: %d", profile.Name, score)
+		if score > bestScore {
+			best = profile
+			bestScore = score
+		}
+	}
+	if best == nil {
+		return nil, errors.New("no matching device profile")
+	}
+	return best, nil
+}
+
+// 探测 UPS 并选择设备配置, 没有匹配的配置时使用默认配置。
+// 串口未打开或 UPS 没有应答时在 wait 内继续探测, 超时后使用默认配置, 不阻塞其他服务启动。
+func DetectDeviceProfile(tty *TTY, wait time.Duration) (*DeviceProfile, error) {
+	profiles, err := LoadDeviceProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		probe, err := ProbeDevice(tty)
+		if err == nil || tty.isClosed() || !time.Now().Before(deadline) {
+			return selectProbedProfile(profiles, probe, err)
+		}
+		select {
+		case sig := <-sigs:
+			return nil, fmt.Errorf("received signal %s while probing device", sig)
+		default:
+		}
+		// ProbeDevice 每次重试间隔 1 秒, 读取协程同时按退避时间重新打开串口
+		Logger.Warnf("Probe device faild: %s, retry", err.Error())
+	}
+}
+
+// 按回放文件中的探测应答选择设备配置, 失败时使用默认配置
+func DetectReplayProfile(replay *Replay) (*DeviceProfile, error) {
+	profiles, err := LoadDeviceProfiles()
+	if err != nil {
+		return nil, err
+	}
+
+	probe, err := ProbeCapture(replay.Replies)
+	return selectProbedProfile(profiles, probe, err)
+}
+
+func selectProbedProfile(profiles []*DeviceProfile, probe *ProbeResult, err error) (*DeviceProfile, error) {
+	if err != nil {
+		Logger.Warnf("Probe device faild: %s, use default profile '%s'", err.Error(), defaultDeviceProfile)
+		return LoadDeviceProfile(defaultDeviceProfile)
+	}
+	Logger.Infof("Probe device: %s", probe.String())
+
+	profile, err := SelectDeviceProfile(profiles, probe)
+	if err != nil {
+		Logger.Warnf("Detect device faild: %s, use default profile '%s'", err.Error(), defaultDeviceProfile)
+		return LoadDeviceProfile(defaultDeviceProfile)
+	}
+	return profile, nil
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"math"
 
 	"github.com/gosnmp/gosnmp"
 )
 
 type Device struct {
+	Profile *DeviceProfile
+
 	InitCallback  func(snmp *SNMP, data *SNMPData) error
 	EnableService SNMPData
 
@@ -15,15 +18,15 @@ type Device struct {
 	GetRated        string // F
 	GetManufacturer string // I
 
-	OnReceive   func(snmp *SNMP, data *SNMPData, value string) error
+	OnReceive   func(snmp *SNMP, data *SNMPData, cmd string, value string) error // cmd 为应答对应的命令
 	SetCallback func(snmp *SNMP, name string, value any) error
 
 	Test             string // T
 	TestToBatteryLow string // TL
 	TestWithMinimum  string // T<m>
 
-	Poweroff             string // S<m>
-	PoweroffAndStart     string // S<m>R<m2>
+	Poweroff             string // S<m>, fmt 格式, 参数为 FormatShutdownDelay 的结果
+	PoweroffAndStart     string // S<m>R<m2>, fmt 格式, 参数为关机延时和开机延时(分钟)
 	PoweroffAndStartWith string // S<m>R<m2> <m>分钟后关机<m2>后启动
 
 	SwitchBuzz string // Q
@@ -57,202 +60,347 @@ type Mt1000ProUserData struct {
 	}
 }
 
-func Mt1000ProOnReceive(snmp *SNMP, data *SNMPData, value string) error {
-	parse, err := ProtoParse(value)
-	if err != nil {
-		return err
+// 三进三出 UPS 在 Q1 基础上补充的信息
+type QueryExtra struct {
+	Alarms []AlarmState         // 与 Q1 的告警合并
+	Update func(data *SNMPData) // 在更新告警和发送 Trap 前调用, 可覆盖由 Q1 估算的值
+}
+
+func mt1000ProUserData(data *SNMPData) *Mt1000ProUserData {
+	switch v := data.UserData.(type) {
+	case *Mt1000ProUserData:
+		return v
+	case *ThreePhaseUserData:
+		return &v.Mt1000ProUserData
 	}
+	return nil
+}
 
-	userData := data.UserData.(*Mt1000ProUserData)
+// Q1 状态位对应的告警
+func Mt1000ProAlarms(v QueryResult) []AlarmState {
+	// 在线式 UPS 的 b5 表示旁路供电, 后备式表示 AVR 升降压
+	onBypass := v.Status.BypassBoostActive && !v.Status.UPSType
+	// b1 置位后 UPS 在关机倒计时中, 输出电压为 0 时输出已按命令关闭
+	outputOff := v.Status.ShutdownActive && v.OPVoltage < 1
+	return []AlarmState{
+		{"upsAlarmLowBattery", v.Status.BatteryLow},
+		// 市电正常时电池低电压, 断电后无法维持负载
+		{"upsAlarmDepletedBattery", v.Status.BatteryLow && !v.Status.UtilityFail},
+		{"upsAlarmInputBad", v.Status.UtilityFail},
+		{"upsAlarmOnBattery", v.Status.UtilityFail},
+		{"upsAlarmOnBypass", onBypass},
+		{"upsAlarmUpsSystemOff", v.Status.ShutdownActive},
+		{"upsAlarmShutdownImminent", v.Status.ShutdownActive && !outputOff},
+		{"upsAlarmOutputOffAsRequested", outputOff},
+		{"upsAlarmGeneralFault", v.Status.UPSFailed},
+		{"upsAlarmTestInProgress", v.Status.TestActive},
+		{"upsAlarmOutputOverload", v.OPCurrentPercent > 120},
+	}
+}
 
-	switch v := parse.(type) {
-	case QueryResult:
-		Logger.Debugf("QueryResult: %#v", v)
-		// Battery
-		data.Battery.Voltage = int(math.Round(float64(v.BatteryVoltage) * 10.0))
-		rating := userData.Rating
-
-		batteryMax := 27.4
-		batteryLow := 21.6
-		charge := (float64(v.BatteryVoltage) - batteryLow) / (batteryMax - batteryLow) * 100
-		data.Battery.Charge = int(math.Round(charge))
-		if data.Battery.Charge > 100 {
-			data.Battery.Charge = 100
-		}
+func Mt1000ProQuery(snmp *SNMP, data *SNMPData, v QueryResult, extra *QueryExtra) {
+	userData := mt1000ProUserData(data)
 
-		if v.Status.BatteryLow {
-			data.Battery.Status = 3
-			if !alarm.Exist("upsAlarmLowBattery") {
-				alarm.Add("upsAlarmLowBattery")
-			}
-		} else {
-			alarm.RemoveWithDesc("upsAlarmLowBattery")
-			data.Battery.Status = 2
-		}
+	Logger.Debugf("QueryResult: %#v", v)
+	// Battery
+	data.Battery.Voltage = int(math.Round(float64(v.BatteryVoltage) * 10.0))
+	rating := userData.Rating
 
-		data.Battery.Temp = int(math.Round(float64(v.Temperature)))
+	battery := snmp.Device.Profile.Battery
+	charge := battery.Charge(float64(v.BatteryVoltage))
+	data.Battery.Charge = int(math.Round(charge))
 
-		// 电流 = (电流百分比 / 100) * 额定电流
-		current := (float64(v.OPCurrentPercent) / 100) * float64(rating.CurrentRating)
-		// 电池电流 = (电流 * 输出电压) / 电池电压
-		batteryCurrent := (current * float64(v.OPVoltage)) / float64(v.BatteryVoltage)
+	if v.Status.BatteryLow {
+		data.Battery.Status = 3
+	} else {
+		data.Battery.Status = 2
+	}
 
-		// // 计算剩余时间 (秒)
-		// // 剩余容量 Ah = (Battery.Charge / 100) * 额定电池容量 (7)
-		// // 放电时间 (小时) = 剩余容量 / 当前电流
-		// if current > 0 { // 避免除以0
-		// 	remainingCapacity := (charge / 100) * 7
-		// 	dischargeTimeHours := remainingCapacity / current
-		// 	data.Battery.Minutes = int(dischargeTimeHours * 60) // 转换为分钟
-		// } else {
-		// 	data.Battery.Minutes = 60 // 如果没有电流，无法计算放电时间
-		// }
+	data.Battery.Temp = int(math.Round(float64(v.Temperature)))
 
-		// if data.Battery.Minutes > 60 {
-		// 	data.Battery.Minutes = 60
-		// }
+	// 电流 = (电流百分比 / 100) * 额定电流
+	current := (float64(v.OPCurrentPercent) / 100) * float64(rating.CurrentRating)
+	// 电池电流 = (电流 * 输出电压) / 电池电压
+	batteryCurrent := (current * float64(v.OPVoltage)) / float64(v.BatteryVoltage)
 
-		// MT1000-Pro
-		// 50%  负载 10  分钟
-		// 100% 负载 3.5 分钟
-		t50 := 10.0
-		t100 := 3.5
+	// 按设备配置中的放电时间表线性插值
+	time := battery.RuntimeMinutes(float64(v.OPCurrentPercent))
 
-		// 使用线性插值计算时间
-		time := t50 + (t100-t50)/(100.0-50.0)*(float64(v.OPCurrentPercent)-50.0)
+	data.Battery.Minutes = int(math.Round(time))
 
-		data.Battery.Minutes = int(math.Round(time))
+	Logger.Debugf("Battery: %fV %f%% %dC %fA %fM", v.BatteryVoltage, charge, data.Battery.Temp, current, time)
 
-		Logger.Debugf("Battery: %fV %f%% %dC %fA %fM", v.BatteryVoltage, charge, data.Battery.Temp, current, time)
+	// Output
+	data.Output.Freq = int(math.Round(float64(v.IPFreq) * 10.0))
+	data.Bypass.Freq = int(math.Round(float64(v.IPFreq) * 10.0))
+	if v.Status.UtilityFail {
+		data.Output.Source = 5
 
-		// Output
-		data.Output.Freq = int(math.Round(float64(v.IPFreq) * 10.0))
-		data.Bypass.Freq = int(math.Round(float64(v.IPFreq) * 10.0))
-		if v.Status.UtilityFail {
-			data.Output.Source = 5
+		data.Input.LineBads = 1
 
-			data.Input.LineBads = 1
+		userData.BatterySecond += 1
 
-			userData.BatterySecond += 1
+		data.Battery.Current = int(math.Round(batteryCurrent * 10.0))
+	} else {
+		data.Output.Source = 3
 
-			data.Battery.Current = int(math.Round(batteryCurrent * 10.0))
+		data.Input.LineBads = 0
 
-			if !alarm.Exist("upsAlarmInputBad") {
-				alarm.Add("upsAlarmInputBad")
-			}
-		} else {
-			data.Output.Source = 3
+		userData.BatterySecond = 0
 
-			data.Input.LineBads = 0
+		data.Battery.Current = 0
+	}
+	userData.OutputInfo.Voltage = int(v.OPVoltage)
+	userData.OutputInfo.Current = int(current * 10.0)
+	userData.OutputInfo.Power = int(float64(v.OPVoltage) * current)
+	userData.OutputInfo.Load = v.OPCurrentPercent
+
+	// Input
+	userData.InputInfo.Voltage = int(v.IPVoltage)
+	userData.InputInfo.Current = int(float64(current) * 10.0)
+	userData.InputInfo.Frequency = int(v.IPFreq * 10.0)
+	userData.InputInfo.Power = int(float64(v.OPVoltage) * current)
+
+	// Config
+	if v.Status.BuzzerActive {
+		data.Config.AudibleStatus = 2
+	} else {
+		data.Config.AudibleStatus = 3
+	}
 
-			userData.BatterySecond = 0
+	if v.Status.BuzzerActive {
+		if config.DisableBuzz {
+			snmp.TtySend(snmp.Device.SwitchBuzz)
+		}
+	}
 
-			data.Battery.Current = 0
+	if extra != nil && extra.Update != nil {
+		extra.Update(data)
+	}
 
-			alarm.RemoveWithDesc("upsAlarmInputBad")
-		}
-		userData.OutputInfo.Voltage = int(v.OPVoltage)
-		userData.OutputInfo.Current = int(current * 10.0)
-		userData.OutputInfo.Power = int(float64(v.OPVoltage) * current)
-		userData.OutputInfo.Load = v.OPCurrentPercent
-
-		// Input
-		userData.InputInfo.Voltage = int(v.IPVoltage)
-		userData.InputInfo.Current = int(float64(current) * 10.0)
-		userData.InputInfo.Frequency = int(v.IPFreq * 10.0)
-		userData.InputInfo.Power = int(float64(v.OPVoltage) * current)
-
-		// Config
-		if v.Status.BuzzerActive {
-			data.Config.AudibleStatus = 2
-		} else {
-			data.Config.AudibleStatus = 3
-		}
+	// Alarm
+	// 规则在读数全部更新后计算, 与状态位得到的告警合并
+	states := Mt1000ProAlarms(v)
+	if extra != nil {
+		states = MergeAlarmStates(states, extra.Alarms)
+	}
+	control.Tick()
+	states = MergeAlarmStates(states, control.Alarms())
+	states = MergeAlarmStates(states, alarm.Rules.Evaluate())
+	for _, state := range states {
+		alarm.Set(state.Name, state.Active)
+	}
 
-		// Alarm
-		if v.Status.ShutdownActive {
-			if !alarm.Exist("upsAlarmUpsSystemOff") {
-				alarm.Add("upsAlarmUpsSystemOff")
-			}
-		} else {
-			alarm.RemoveWithDesc("upsAlarmUpsSystemOff")
-		}
+	alarm.Apply()
 
-		if v.Status.UPSFailed {
-			if !alarm.Exist("upsAlarmGeneralFault") {
-				alarm.Add("upsAlarmGeneralFault")
-			}
-		} else {
-			alarm.RemoveWithDesc("upsAlarmGeneralFault")
-		}
+	OnBatteryTrap(snmp, data)
 
-		if v.OPCurrentPercent > 120 {
-			if !alarm.Exist("upsAlarmOutputOverload") {
-				alarm.Add("upsAlarmOutputOverload")
-			}
+	Mt1000ProTest(snmp, data, v)
+}
+
+// 按各驱动更新后的 upsOutputSource 发送 upsTrapOnBattery。
+// 电池供电期间由 ScheduleTrap 按 trap-interval 限制重复发送, 市电恢复后复位, 下次断电时立即发送。
+func OnBatteryTrap(snmp *SNMP, data *SNMPData) {
+	if data.Output.Source != 5 {
+		snmp.ResetTrap("upsTrapOnBattery")
+		return
+	}
+	snmp.ScheduleTrap(TrapData{
+		OID: "upsTrapOnBattery",
+		Data: []TrapDataItem{
+			{
+				OID:   "upsEstimatedMinutesRemaining",
+				Type:  gosnmp.Integer,
+				Value: data.Battery.Minutes,
+			},
+			{
+				OID:   "upsSecondsOnBattery",
+				Type:  gosnmp.Integer,
+				Value: mt1000ProUserData(data).BatterySecond,
+			},
+			{
+				OID:   "upsConfigLowBattTime",
+				Type:  gosnmp.Integer,
+				Value: data.Config.LowBatteryTime,
+			},
+		},
+	})
+}
+
+// 跟踪进行中的测试, 测试完成、中止或超时后发送 upsTrapTestCompleted
+func Mt1000ProTest(snmp *SNMP, data *SNMPData, v QueryResult) {
+	userData := mt1000ProUserData(data)
+
+	if data.Test.ResultsSummary != 5 {
+		return
+	}
+	if userData.InTestCount == 20 {
+		// UPS 一直没有进入测试
+		data.Test.Id = snmp.GetOID("upsTestAbortTestInProgress", -1)
+		mt1000ProEndTest(snmp, data, 4, "Time out")
+		return
+	}
+	if !userData.InTest {
+		if v.Status.TestActive {
+			userData.InTest = true
 		} else {
-			alarm.RemoveWithDesc("upsAlarmOutputOverload")
+			userData.InTestCount += 1
+			return
 		}
+	}
+	data.Test.ElapsedTime = getSysUpTime() - data.Test.StartTime
+	if v.Status.TestActive {
+		return
+	}
 
-		if v.Status.BuzzerActive {
-			if config.DisableBuzz {
-				snmp.TtySend(snmp.Device.SwitchBuzz)
+	test := mt1000ProTests[snmp.GetName(data.Test.Id)]
+	switch {
+	case v.Status.UPSFailed:
+		mt1000ProEndTest(snmp, data, 3, test.Name+" failed: UPS fault")
+	case v.Status.BatteryLow && !test.ToBatteryLow:
+		mt1000ProEndTest(snmp, data, 2, test.Name+" completed: battery low")
+	default:
+		mt1000ProEndTest(snmp, data, 1, test.Name+" passed")
+	}
+}
+
+// upsWellKnownTests 中可以执行的测试
+type mt1000ProTest struct {
+	Name         string                // 结果说明中的测试名
+	Command      func(d Device) string // 为空表示设备不支持
+	ToBatteryLow bool                  // 测试到电池低电压为止, 结束时电池低电压不算异常
+}
+
+// 一般系统测试的时长(分钟), 用 T<m> 执行
+const generalSystemsTestMinutes = 1
+
+var mt1000ProTests = map[string]mt1000ProTest{
+	"upsTestQuickBatteryTest": {
+		Name:    "Quick battery test",
+		Command: func(d Device) string { return d.Test },
+	},
+	"upsTestDeepBatteryCalibration": {
+		Name:         "Deep battery calibration",
+		Command:      func(d Device) string { return d.TestToBatteryLow },
+		ToBatteryLow: true,
+	},
+	"upsTestGeneralSystemsTest": {
+		Name: "General systems test",
+		Command: func(d Device) string {
+			if d.TestWithMinimum == "" {
+				return ""
 			}
+			return fmt.Sprintf(d.TestWithMinimum, generalSystemsTestMinutes)
+		},
+	},
+}
+
+// 写入 upsTestId 时开始或中止测试, 返回错误时 upsTestId 保持原值
+func Mt1000ProSetTest(snmp *SNMP, data *SNMPData, id string) error {
+	userData := mt1000ProUserData(data)
+	name := snmp.GetName(id)
+
+	if name == "upsTestAbortTestInProgress" {
+		if data.Test.ResultsSummary != 5 {
+			return fmt.Errorf("no test in progress")
 		}
+		if snmp.Device.CancelAllTest == "" {
+			return fmt.Errorf("abort test not supported by %s", snmp.Device.Profile.Name)
+		}
+		snmp.TtySend(snmp.Device.CancelAllTest)
+		data.Test.ElapsedTime = getSysUpTime() - data.Test.StartTime
+		mt1000ProEndTest(snmp, data, 4, "Aborted")
+		return nil
+	}
 
-		alarm.Apply()
+	test, ok := mt1000ProTests[name]
+	if !ok {
+		return fmt.Errorf("unsupported test %s", id)
+	}
+	if data.Test.SpinLock != 1 {
+		return fmt.Errorf("test in progress")
+	}
+	cmd := test.Command(snmp.Device)
+	if cmd == "" {
+		return fmt.Errorf("%s not supported by %s", name, snmp.Device.Profile.Name)
+	}
+	snmp.TtySend(cmd)
+	data.Test.SpinLock = 2
+	data.Test.ResultsSummary = 5
+	data.Test.ResultsDetail = ""
+	data.Test.StartTime = getSysUpTime()
+	data.Test.ElapsedTime = 0
+	userData.InTest = false
+	userData.InTestCount = 0
+	return nil
+}
 
-		if v.Status.UtilityFail {
-			trap := TrapData{
-				OID: "upsTrapOnBattery",
-				Data: []TrapDataItem{
-					{
-						OID:   "upsEstimatedMinutesRemaining",
-						Type:  gosnmp.Integer,
-						Value: data.Battery.Minutes,
-					},
-					{
-						OID:   "upsSecondsOnBattery",
-						Type:  gosnmp.Integer,
-						Value: userData.BatterySecond,
-					},
-					{
-						OID:   "upsConfigLowBattTime",
-						Type:  gosnmp.Integer,
-						Value: data.Config.LowBatteryTime,
-					},
-				},
-			}
+// 不经过 SNMP 的入口 (NUT / MQTT) 写入 upsTestId, 这些客户端不会复位 upsTestSpinLock,
+// 上次测试已结束时先释放测试锁
+func startTest(snmp *SNMP, name string) error {
+	if snmp.Data.Test.SpinLock == 3 {
+		snmp.Data.Test.SpinLock = 1
+	}
+	return snmp.SetValue("upsTestId", 0, snmp.GetOID(name, -1))
+}
+
+// 记录测试结果并发送 upsTrapTestCompleted
+func mt1000ProEndTest(snmp *SNMP, data *SNMPData, summary int, detail string) {
+	userData := mt1000ProUserData(data)
+
+	data.Test.SpinLock = 3
+	data.Test.ResultsSummary = summary
+	data.Test.ResultsDetail = detail
+	data.Test.ElapsedTime = getSysUpTime() - data.Test.StartTime
+	userData.InTest = false
+	userData.InTestCount = 0
+	snmp.SendTrap(TestCompletedTrap(data))
+
+	event := NewWebhookEvent(snmp, WebhookTestCompleted)
+	event.TestName = snmp.GetName(data.Test.Id)
+	event.TestSummary = summary
+	event.TestDetail = detail
+	snmp.Notifier.Notify(event)
+}
 
-			snmp.SendTrap(trap)
+// UPS-MIB upsTrapTestCompleted 携带的对象
+func TestCompletedTrap(data *SNMPData) TrapData {
+	return TrapData{
+		OID: "upsTrapTestCompleted",
+		Data: []TrapDataItem{
+			{OID: "upsTestId", Type: gosnmp.ObjectIdentifier, Value: data.Test.Id},
+			{OID: "upsTestSpinLock", Type: gosnmp.Integer, Value: data.Test.SpinLock},
+			{OID: "upsTestResultsSummary", Type: gosnmp.Integer, Value: data.Test.ResultsSummary},
+			{OID: "upsTestResultsDetail", Type: gosnmp.OctetString, Value: data.Test.ResultsDetail},
+			{OID: "upsTestStartTime", Type: gosnmp.TimeTicks, Value: uint32(data.Test.StartTime)},
+			{OID: "upsTestElapsedTime", Type: gosnmp.TimeTicks, Value: uint32(data.Test.ElapsedTime)},
+		},
+	}
+}
 
-			// Test
-			if data.Test.ResultsSummary != 5 {
-				break
-			}
-			if userData.InTestCount == 20 {
-				data.Test.SpinLock = 3
-				data.Test.ResultsSummary = 4
-				data.Test.ResultsDetail = "Time out"
-				data.Test.Id = snmp.GetOID("upsTestAbortTestInProgress", -1)
-				userData.InTest = false
-				userData.InTestCount = 0
-			}
-			if !userData.InTest {
-				if v.Status.TestActive {
-					userData.InTest = true
-				} else {
-					userData.InTestCount += 1
-					break
-				}
-			}
-			data.Test.ElapsedTime = TimesTamp(getRunningTimeInSeconds()) - data.Test.StartTime
-			if !v.Status.TestActive {
-				data.Test.SpinLock = 3
-				data.Test.ResultsSummary = 1
-				data.Test.ResultsDetail = "OK"
-				userData.InTest = false
-			}
+func Mt1000ProOnReceive(snmp *SNMP, data *SNMPData, cmd string, value string) error {
+	parse, err := ProtoParseReply(cmd, value)
+	if err != nil {
+		return err
+	}
+
+	userData := mt1000ProUserData(data)
+
+	switch v := parse.(type) {
+	case QueryResult:
+		Mt1000ProQuery(snmp, data, v, nil)
+	case UPSInfo:
+		Logger.Debugf("UPSInfo: %#v", v)
+
+		// 未返回的信息段保留设备配置中的值
+		if v.Company != "" {
+			data.Ident.Manufacturer = v.Company
+		}
+		if v.Model != "" {
+			data.Ident.Model = v.Model
+		}
+		if v.Version != "" {
+			data.Ident.SoftwareVersion = v.Version
 		}
 	case RatingInfo:
 		Logger.Debugf("RatingInfo: %#v", v)
@@ -270,28 +418,41 @@ func Mt1000ProOnReceive(snmp *SNMP, data *SNMPData, value string) error {
 	return nil
 }
 
-func Mt1000ProInit(snmp *SNMP, data *SNMPData) error {
-	data.Ident.Manufacturer = "Eaton"
-	data.Ident.Model = "MT1000-Pro"
-	data.Ident.SoftwareVersion = "1.0.0"
+// 单相和三进三出 UPS 共用的初始值
+func mt1000ProInitData(snmp *SNMP, data *SNMPData) {
+	profile := snmp.Device.Profile
+
+	data.Ident.Manufacturer = profile.Manufacturer
+	data.Ident.Model = profile.Model
+	data.Ident.SoftwareVersion = "" // 由 I 应答填充
 	data.Ident.AgentVersion = "1.0.0"
 
+	data.Config.OutputVA = profile.Rating.OutputVA
+	data.Config.OutputPower = profile.Rating.OutputPower
+	data.Config.LowBatteryTime = profile.Rating.LowBatteryTime
+	data.Config.LowVoltageTransferPoint = profile.Rating.LowVoltageTransferPoint
+	data.Config.HighVoltageTransferPoint = profile.Rating.HighVoltageTransferPoint
+
+	data.Test.SpinLock = 1
+	data.Test.Id = snmp.GetOID("upsTestNoTestsInitiated", -1)
+	data.Test.ResultsSummary = 6
+
+	data.Control.ShutdownType = 1
+	data.Control.ShutdownAfter = -1
+	data.Control.StartupAfter = -1
+	data.Control.RebootDuration = -1
+	data.Control.AutoRestart = 1
+}
+
+func Mt1000ProInit(snmp *SNMP, data *SNMPData) error {
+	mt1000ProInitData(snmp, data)
+
 	data.Input.NumLines = 1
 
 	data.Output.NumLines = 1
 
 	data.Bypass.NumLines = 1
 
-	data.Config.OutputVA = 1000
-	data.Config.OutputPower = 600
-	data.Config.LowBatteryTime = 20
-	data.Config.LowVoltageTransferPoint = 173
-	data.Config.HighVoltageTransferPoint = 273
-
-	data.Test.SpinLock = 1
-	data.Test.Id = snmp.GetOID("upsTestNoTestsInitiated", -1)
-	data.Test.ResultsSummary = 6
-
 	data.UserData = &Mt1000ProUserData{}
 
 	onGet := func(obj any, index int) (any, error) {
@@ -347,7 +508,7 @@ func Mt1000ProInit(snmp *SNMP, data *SNMPData) error {
 
 func Mt1000ProSetCallback(snmp *SNMP, name string, value any) error {
 	data := snmp.Data
-	userData := data.UserData.(*Mt1000ProUserData)
+	userData := mt1000ProUserData(data)
 	Logger.Debugf("SetCallback: %s=%v", name, value)
 	switch name {
 	case "upsConfigAudibleStatus":
@@ -361,19 +522,10 @@ func Mt1000ProSetCallback(snmp *SNMP, name string, value any) error {
 			}
 		}
 	case "upsTestId":
-		if data.Test.SpinLock != 1 {
-			break
-		}
-		quickTest := snmp.GetOID("upsTestQuickBatteryTest", -1)
-		if value == quickTest {
-			snmp.TtySend(snmp.Device.Test)
-			data.Test.Id = quickTest
-			data.Test.SpinLock = 2
-			data.Test.ResultsSummary = 5
-			data.Test.StartTime = TimesTamp(getRunningTimeInSeconds())
-			userData.InTest = false
-			userData.InTestCount = 0
-		}
+		return Mt1000ProSetTest(snmp, data, value.(string))
+	case "upsShutdownType", "upsShutdownAfterDelay", "upsStartupAfterDelay", "upsRebootWithDuration", "upsAutoRestart":
+		control.OnSet(name, value.(int))
+		alarm.Apply()
 	case "upsTestSpinLock":
 		data.Test.SpinLock = value.(int)
 		if data.Test.SpinLock == 1 {
@@ -388,83 +540,16 @@ func Mt1000ProSetCallback(snmp *SNMP, name string, value any) error {
 	return nil
 }
 
-var Mt1000Pro = Device{
-	InitCallback: Mt1000ProInit,
-
-	EnableService: SNMPData{
-		Ident: &SNMPDataIdent{
-			Manufacturer:    "1",
-			Model:           "1",
-			SoftwareVersion: "1",
-			AgentVersion:    "1",
-		},
-		Battery: &SNMPDataBattery{
-			Status:  1,
-			Seconds: 1,
-			Minutes: 1,
-			Charge:  1,
-			Voltage: 1,
-			Current: 1,
-			Temp:    1,
-		},
-		Bypass: &SNMPDataBypass{
-			NumLines: 1,
-			Freq:     1,
-		},
-		Input: &SNMPDataInput{
-			NumLines: 1,
-			LineBads: 1,
-		},
-		Output: &SNMPDataOutput{
-			Source:   1,
-			Freq:     1,
-			NumLines: 1,
-		},
-		Alarm: &SNMPDataAlarm{
-			Present: 1,
-		},
-		Test: &SNMPDataTest{
-			Id:             "1",
-			SpinLock:       1,
-			ResultsSummary: 1,
-			ResultsDetail:  "1",
-			StartTime:      1,
-			ElapsedTime:    1,
-		},
-		Config: &SNMPDataConfig{
-			InputVoltage:             1,
-			InputFreq:                1,
-			OutputVoltage:            1,
-			OutputFreq:               1,
-			OutputVA:                 1,
-			OutputPower:              1,
-			LowBatteryTime:           1,
-			AudibleStatus:            1,
-			LowVoltageTransferPoint:  1,
-			HighVoltageTransferPoint: 1,
-		},
+// 设备配置中 driver 对应的实现, 命令和启用的服务由 NewDevice 按设备配置填充
+var deviceDrivers = map[string]Device{
+	"single-phase": {
+		InitCallback: Mt1000ProInit,
+		OnReceive:    Mt1000ProOnReceive,
+		SetCallback:  Mt1000ProSetCallback,
+	},
+	"three-phase": {
+		InitCallback: ThreePhaseInit,
+		OnReceive:    ThreePhaseOnReceive,
+		SetCallback:  Mt1000ProSetCallback,
 	},
-
-	GetInfo:         "Q1",
-	GetRated:        "F",
-	GetManufacturer: "",
-
-	OnReceive: Mt1000ProOnReceive,
-
-	SetCallback: Mt1000ProSetCallback,
-
-	Test:             "T",
-	TestToBatteryLow: "",
-	TestWithMinimum:  "",
-	Poweroff:         "",
-	PoweroffAndStart: "",
-
-	SwitchBuzz: "Q",
-
-	CancelAllPoweroff: "",
-	CancelAllTest:     "",
-
-	ExtraGetInfo:   "",
-	ExtraGetError:  "",
-	ExtraGetTPInfo: "",
 }
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// 三进三出 UPS 的相数
+const threePhaseLines = 3
+
+type ThreePhaseUserData struct {
+	Mt1000ProUserData
+
+	Info     ExtraQueryResult // G1
+	Error    ExtraQueryError  // G2
+	Phase    TPInfo           // G3
+	TPRating TPRating         // GF
+
+	HasInfo  bool
+	HasError bool
+
+	OutputLines int // 三进单出时为 1
+}
+
+// 每相的额定视在功率(VA)和有功功率(W)
+func (u *ThreePhaseUserData) lineRating(data *SNMPData) (float64, float64) {
+	lines := float64(u.OutputLines)
+	return float64(data.Config.OutputVA) / lines, float64(data.Config.OutputPower) / lines
+}
+
+// 第 index 相的输出负载 %
+func (u *ThreePhaseUserData) outputLoad(index int) float64 {
+	if u.OutputLines == 1 {
+		return float64(u.Phase.RPercent)
+	}
+	return float64([]float32{u.Phase.RPercent, u.Phase.SPercent, u.Phase.TPercent}[index-1])
+}
+
+func (u *ThreePhaseUserData) outputVoltage(index int) float64 {
+	return float64([]float32{u.Phase.OutputR, u.Phase.OutputS, u.Phase.OutputT}[index-1])
+}
+
+func (u *ThreePhaseUserData) inputVoltage(index int) float64 {
+	return float64([]float32{u.Phase.InputR, u.Phase.InputS, u.Phase.InputT}[index-1])
+}
+
+func (u *ThreePhaseUserData) bypassVoltage(index int) float64 {
+	return float64([]float32{u.Phase.BypassR, u.Phase.BypassS, u.Phase.BypassT}[index-1])
+}
+
+// 静态旁路开关处于旁路端且不在电池供电
+func (u *ThreePhaseUserData) onBypass() bool {
+	return u.HasError && !u.Error.StaticBypass && !u.Error.BatterySupply
+}
+
+// G2 状态位对应的告警, 与 Q1 的告警合并
+func ThreePhaseAlarms(v ExtraQueryError) []AlarmState {
+	return []AlarmState{
+		{"upsAlarmLowBattery", v.BatteryLow},
+		{"upsAlarmDepletedBattery", v.BatteryLowProtection},
+		{"upsAlarmChargerFailed", v.Rectifier},
+		{"upsAlarmOnBattery", v.BatterySupply},
+		{"upsAlarmOnBypass", (!v.StaticBypass && !v.BatterySupply) || v.ManualBypass},
+		{"upsAlarmBypassBad", v.BypassFreqError || !v.BypassNomal},
+		{"upsAlarmUpsSystemOff", v.EmergencyStop},
+		{"upsAlarmBatteryBad", v.BatteryInputHigh},
+		{"upsAlarmOutputOverload", v.OverloadStop},
+		{"upsAlarmOutputBad", v.InverterOutputVoltage || v.OutputShortCircuit},
+		{"upsAlarmTempBad", v.OverTemperature},
+		{"upsAlarmUpsOutputOff", !v.InverterRunning && v.StaticBypass},
+	}
+}
+
+var ratingNumberRegexp = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*([kKmM]?)`)
+
+// 解析 GF 中的 "150KVA" / "220V/380V 3P4W" 开头的数值
+func parseRatingNumber(value string) (float64, bool) {
+	match := ratingNumberRegexp.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, false
+	}
+	number, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	switch strings.ToUpper(match[2]) {
+	case "K":
+		number *= 1000
+	case "M":
+		number *= 1000000
+	}
+	return number, true
+}
+
+// 用 G1 / G2 的值覆盖由 Q1 估算的值
+func threePhaseUpdate(data *SNMPData, userData *ThreePhaseUserData) {
+	if userData.HasInfo {
+		v := userData.Info
+		data.Battery.Voltage = v.BatteryVoltage * 10
+		data.Battery.Charge = v.BatteryCapacity
+		data.Battery.Minutes = v.BatteryTimeRemaining
+		data.Battery.Temp = int(math.Round(float64(v.Temperature)))
+
+		// a2 = 1 时电池放电, 否则为充电电流
+		current := int(math.Round(float64(v.BatteryCurrent) * 10.0))
+		if userData.HasError && !userData.Error.BatterySupply {
+			current = -current
+		}
+		data.Battery.Current = current
+
+		data.Output.Freq = int(math.Round(float64(v.OPFreq) * 10.0))
+		data.Bypass.Freq = int(math.Round(float64(v.BypassFreq) * 10.0))
+	}
+
+	if userData.HasError {
+		v := userData.Error
+		switch {
+		case v.BatteryLowProtection:
+			data.Battery.Status = 4
+		case v.BatteryLow:
+			data.Battery.Status = 3
+		}
+
+		switch {
+		case v.BatterySupply:
+			data.Output.Source = 5
+		case !v.StaticBypass:
+			data.Output.Source = 4
+		case v.InverterRunning:
+			data.Output.Source = 3
+		default:
+			data.Output.Source = 2
+		}
+	}
+}
+
+// 三进单出时输出表只有一行
+func threePhaseOutputTables(snmp *SNMP, data *SNMPData, lines int, onGet func(obj any, index int) (any, error)) {
+	names := []string{"upsOutputLineIndex", "upsOutputVoltage", "upsOutputCurrent", "upsOutputPower", "upsOutputPercentLoad"}
+	for _, name := range names {
+		snmp.RemoveAllTable(name)
+	}
+	for _, name := range names {
+		snmp.AddTable(name, name, lines, gosnmp.Integer, onGet)
+	}
+	data.Output.NumLines = lines
+}
+
+func ThreePhaseOnReceive(snmp *SNMP, data *SNMPData, cmd string, value string) error {
+	parse, err := ProtoParseReply(cmd, value)
+	if err != nil {
+		return err
+	}
+
+	userData := data.UserData.(*ThreePhaseUserData)
+
+	switch v := parse.(type) {
+	case QueryResult:
+		extra := &QueryExtra{
+			Update: func(data *SNMPData) {
+				threePhaseUpdate(data, userData)
+			},
+		}
+		if userData.HasError {
+			extra.Alarms = ThreePhaseAlarms(userData.Error)
+			// 电池供电时 Q1 的 b7 不一定置位, 以 G2 为准
+			v.Status.UtilityFail = v.Status.UtilityFail || userData.Error.BatterySupply
+			v.Status.BatteryLow = v.Status.BatteryLow || userData.Error.BatteryLow
+		}
+		Mt1000ProQuery(snmp, data, v, extra)
+	case ExtraQueryResult:
+		Logger.Debugf("ExtraQueryResult: %#v", v)
+		userData.Info = v
+		userData.HasInfo = true
+		threePhaseUpdate(data, userData)
+	case ExtraQueryError:
+		Logger.Debugf("ExtraQueryError: %#v", v)
+		userData.Error = v
+		userData.HasError = true
+
+		lines := threePhaseLines
+		if v.TPInOneOut {
+			lines = 1
+		}
+		if lines != userData.OutputLines {
+			userData.OutputLines = lines
+			threePhaseOutputTables(snmp, data, lines, threePhaseOnGet(data))
+			snmp.Apply()
+		}
+
+		threePhaseUpdate(data, userData)
+		// G2 先于下一次 Q1 反映电池供电
+		OnBatteryTrap(snmp, data)
+	case TPInfo:
+		Logger.Debugf("TPInfo: %#v", v)
+		userData.Phase = v
+	case TPRating:
+		Logger.Debugf("TPRating: %#v", v)
+		userData.TPRating = v
+
+		if va, ok := parseRatingNumber(v.PowerRating); ok {
+			data.Config.OutputVA = int(va)
+		}
+		if voltage, ok := parseRatingNumber(v.RectifierInfo); ok {
+			data.Config.InputVoltage = int(voltage)
+		}
+		if voltage, ok := parseRatingNumber(v.OuputInfo); ok {
+			data.Config.OutputVoltage = int(voltage)
+		}
+		data.Config.InputFreq = v.RectifierFreq
+		data.Config.OutputFreq = v.OuputFreq
+	default:
+		// Q1 以外的单相应答(I / F)
+		return Mt1000ProOnReceive(snmp, data, cmd, value)
+	}
+
+	return nil
+}
+
+func threePhaseOnGet(data *SNMPData) func(obj any, index int) (any, error) {
+	return func(obj any, index int) (any, error) {
+		name := obj.(string)
+		userData := data.UserData.(*ThreePhaseUserData)
+
+		lineVA, lineW := userData.lineRating(data)
+		load := userData.outputLoad(index)
+		outputPower := load / 100 * lineW
+		outputCurrent := 0.0
+		if voltage := userData.outputVoltage(index); voltage > 0 {
+			outputCurrent = load / 100 * lineVA / voltage
+		}
+
+		// 输入每相承担总输出功率的 1/3, 不计效率
+		inputPower := 0.0
+		inputCurrent := 0.0
+		if !userData.Error.BatterySupply && !userData.onBypass() {
+			total := 0.0
+			for i := 1; i <= userData.OutputLines; i++ {
+				total += userData.outputLoad(i) / 100 * lineW
+			}
+			inputPower = total / threePhaseLines
+			if voltage := userData.inputVoltage(index); voltage > 0 {
+				inputCurrent = inputPower / voltage
+			}
+		}
+
+		bypassPower := 0.0
+		bypassCurrent := 0.0
+		if userData.onBypass() && index <= userData.OutputLines {
+			bypassPower = outputPower
+			bypassCurrent = outputCurrent
+		}
+
+		switch name {
+		case "upsInputLineIndex", "upsOutputLineIndex", "upsBypassLineIndex":
+			return index, nil
+
+		case "upsInputFrequency":
+			return int(math.Round(float64(userData.Info.IPFreq) * 10.0)), nil
+		case "upsInputVoltage":
+			return int(math.Round(userData.inputVoltage(index))), nil
+		case "upsInputCurrent":
+			return int(math.Round(inputCurrent * 10.0)), nil
+		case "upsInputTruePower":
+			return int(math.Round(inputPower)), nil
+
+		case "upsOutputVoltage":
+			return int(math.Round(userData.outputVoltage(index))), nil
+		case "upsOutputCurrent":
+			return int(math.Round(outputCurrent * 10.0)), nil
+		case "upsOutputPower":
+			return int(math.Round(outputPower)), nil
+		case "upsOutputPercentLoad":
+			return int(math.Round(load)), nil
+
+		case "upsBypassVoltage":
+			return int(math.Round(userData.bypassVoltage(index))), nil
+		case "upsBypassCurrent":
+			return int(math.Round(bypassCurrent * 10.0)), nil
+		case "upsBypassPower":
+			return int(math.Round(bypassPower)), nil
+		}
+		return nil, errors.New("not found")
+	}
+}
+
+func ThreePhaseInit(snmp *SNMP, data *SNMPData) error {
+	mt1000ProInitData(snmp, data)
+
+	data.Input.NumLines = threePhaseLines
+
+	data.Bypass.NumLines = threePhaseLines
+
+	data.UserData = &ThreePhaseUserData{
+		OutputLines: threePhaseLines,
+	}
+
+	onGet := threePhaseOnGet(data)
+
+	snmp.AddTable("upsInputLineIndex", "upsInputLineIndex", threePhaseLines, gosnmp.Integer, onGet)
+	snmp.AddTable("upsInputFrequency", "upsInputFrequency", threePhaseLines, gosnmp.Integer, onGet)
+	snmp.AddTable("upsInputVoltage", "upsInputVoltage", threePhaseLines, gosnmp.Integer, onGet)
+	snmp.AddTable("upsInputCurrent", "upsInputCurrent", threePhaseLines, gosnmp.Integer, onGet)
+	snmp.AddTable("upsInputTruePower", "upsInputTruePower", threePhaseLines, gosnmp.Integer, onGet)
+
+	threePhaseOutputTables(snmp, data, threePhaseLines, onGet)
+
+	snmp.AddTable("upsBypassLineIndex", "upsBypassLineIndex", threePhaseLines, gosnmp.Integer, onGet)
+	snmp.AddTable("upsBypassVoltage", "upsBypassVoltage", threePhaseLines, gosnmp.Integer, onGet)
+	snmp.AddTable("upsBypassCurrent", "upsBypassCurrent", threePhaseLines, gosnmp.Integer, onGet)
+	snmp.AddTable("upsBypassPower", "upsBypassPower", threePhaseLines, gosnmp.Integer, onGet)
+
+	snmp.Apply()
+
+	return nil
+}
@@ -5,32 +5,36 @@ go 1.21
 toolchain go1.22.1
 
 require (
-	github.com/alecthomas/participle v0.4.1 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.4.3
+	github.com/gosnmp/gosnmp v1.36.2-0.20231009064202-d306ed5aa998
+	github.com/hallidave/mibtool v0.2.0
+	github.com/lestrrat-go/file-rotatelogs v2.4.0+incompatible
+	github.com/mochi-mqtt/server/v2 v2.7.9
+	github.com/rifflock/lfshook v0.0.0-20180920164130-b9218ef580f5
+	github.com/sirupsen/logrus v1.4.2
+	github.com/slayercat/GoSNMPServer v0.5.2
+	github.com/spf13/pflag v1.0.5
+	go.bug.st/serial v1.6.2
+	golang.org/x/sys v0.28.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
 	github.com/creack/goselect v0.1.2 // indirect
-	github.com/fatih/color v1.7.0 // indirect
 	github.com/go-ole/go-ole v1.2.6 // indirect
-	github.com/gosnmp/gosnmp v1.36.2-0.20231009064202-d306ed5aa998 // indirect
-	github.com/hallidave/mibtool v0.2.0 // indirect
+	github.com/gorilla/websocket v1.5.0 // indirect
+	github.com/jonboulle/clockwork v0.5.0 // indirect
 	github.com/konsorten/go-windows-terminal-sequences v1.0.1 // indirect
-	github.com/lestrrat-go/file-rotatelogs v2.4.0+incompatible // indirect
 	github.com/lestrrat-go/strftime v1.1.0 // indirect
 	github.com/lufia/plan9stats v0.0.0-20211012122336-39d0f177ccd0 // indirect
-	github.com/mattn/go-colorable v0.1.2 // indirect
-	github.com/mattn/go-isatty v0.0.8 // indirect
 	github.com/pkg/errors v0.9.1 // indirect
 	github.com/power-devops/perfstat v0.0.0-20210106213030-5aafc221ea8c // indirect
-	github.com/rifflock/lfshook v0.0.0-20180920164130-b9218ef580f5 // indirect
+	github.com/rs/xid v1.4.0 // indirect
 	github.com/shirou/gopsutil/v3 v3.23.11 // indirect
 	github.com/shoenig/go-m1cpu v0.1.6 // indirect
-	github.com/sirupsen/logrus v1.4.2 // indirect
-	github.com/slayercat/GoSNMPServer v0.5.2 // indirect
-	github.com/sleepinggenius2/gosmi v0.4.4 // indirect
-	github.com/spf13/pflag v1.0.5 // indirect
-	github.com/stretchr/testify v1.8.4 // indirect
 	github.com/tklauser/go-sysconf v0.3.12 // indirect
 	github.com/tklauser/numcpus v0.6.1 // indirect
 	github.com/yusufpapurcu/wmi v1.2.3 // indirect
-	go.bug.st/serial v1.6.2 // indirect
-	golang.org/x/sys v0.15.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/net v0.33.0 // indirect
+	golang.org/x/sync v0.1.0 // indirect
 )
@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// 告警历史。
+// 文件每行一个 JSON 事件 (raised / cleared), 只追加; 超出保留期限或条数时整理文件。
+// 程序退出时仍未清除的告警在下次启动时记为 interrupted。
+
+const (
+	AlarmRaised  = "raised"
+	AlarmCleared = "cleared"
+
+	alarmHistoryCompactEvery = 1000 // 追加多少条后检查保留限制
+	alarmHistoryMaxPending   = 100  // 写入协程积压超过后丢弃新的事件
+)
+
+// 告警时记录的读数, 表的第一行带 ".1"
+var alarmHistoryReadings = []struct {
+	Name  string
+	Index int
+}{
+	{"upsOutputSource", 0},
+	{"upsEstimatedChargeRemaining", 0},
+	{"upsEstimatedMinutesRemaining", 0},
+	{"upsBatteryVoltage", 0},
+	{"upsBatteryTemperature", 0},
+	{"upsInputVoltage", 1},
+	{"upsInputFrequency", 1},
+	{"upsOutputVoltage", 1},
+	{"upsOutputPercentLoad", 1},
+}
+
+type AlarmHistoryEvent struct {
+	Time        time.Time          `json:"time"`
+	Event       string             `json:"event"`
+	Id          int                `json:"id"`
+	Name        string             `json:"name"`
+	OID         string             `json:"oid"`
+	Readings    map[string]float64 `json:"readings,omitempty"`
+	Interrupted bool               `json:"interrupted,omitempty"` // 程序退出时告警未清除
+}
+
+// 一次告警从发生到清除的记录
+type AlarmHistoryEntry struct {
+	Id            int                `json:"id"`
+	Name          string             `json:"name"`
+	OID           string             `json:"oid"`
+	Raised        time.Time          `json:"raised"`
+	Cleared       *time.Time         `json:"cleared,omitempty"`
+	Duration      float64            `json:"duration"` // 秒, 未清除时为到现在的时长
+	Interrupted   bool               `json:"interrupted,omitempty"`
+	Readings      map[string]float64 `json:"readings,omitempty"`       // 发生时的读数
+	ClearReadings map[string]float64 `json:"clear-readings,omitempty"` // 清除时的读数
+}
+
+// 查询条件, 零值表示不限制
+type AlarmHistoryFilter struct {
+	From time.Time
+	To   time.Time
+	Type string // 告警名或 OID
+}
+
+type AlarmHistoryConfig struct {
+	Path       string
+	MaxAge     time.Duration // 超过该时长的记录被删除, 0 为不限制
+	MaxEntries int           // 最多保留的记录条数, 0 为不限制
+}
+
+type AlarmHistory struct {
+	Config *AlarmHistoryConfig
+
+	lock     sync.Mutex // 保护文件, 写入协程和 Query 使用
+	file     *os.File
+	appended int
+	now      func() time.Time
+
+	// Record 在 Snmp.Lock 中调用, 文件读写由写入协程完成
+	events    chan AlarmHistoryEvent
+	pending   sync.WaitGroup // 尚未写入的事件, Query 前等待
+	done      chan struct{}
+	eventLock sync.Mutex // 保护 closed, 关闭后不再发送到 events
+	closed    bool
+}
+
+// 打开历史文件, 整理后以追加方式写入
+func OpenAlarmHistory(config AlarmHistoryConfig) (*AlarmHistory, error) {
+	h := &AlarmHistory{
+		Config: &config,
+		now:    time.Now,
+		events: make(chan AlarmHistoryEvent, alarmHistoryMaxPending),
+		done:   make(chan struct{}),
+	}
+	err := h.compact(true)
+	if err != nil {
+		return nil, err
+	}
+	h.file, err = os.OpenFile(config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	go h.run()
+	return h, nil
+}
+
+// 写入剩余的事件后关闭文件
+func (h *AlarmHistory) Close() error {
+	if h == nil {
+		return nil
+	}
+	h.eventLock.Lock()
+	if !h.closed {
+		h.closed = true
+		close(h.events)
+	}
+	h.eventLock.Unlock()
+	<-h.done
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.file.Close()
+}
+
+// 记录一条事件, h 为空时不做任何操作
+func (h *AlarmHistory) Record(event string, entry AlarmEntry, name string, readings map[string]float64) {
+	if h == nil {
+		return
+	}
+	h.eventLock.Lock()
+	defer h.eventLock.Unlock()
+	if h.closed {
+		return
+	}
+	h.pending.Add(1)
+	select {
+	case h.events <- AlarmHistoryEvent{
+		Time:     h.now(),
+		Event:    event,
+		Id:       entry.Id,
+		Name:     name,
+		OID:      entry.Descr,
+		Readings: readings,
+	}:
+	default:
+		h.pending.Done()
+		Logger.Errorf("Alarm history writer is busy, drop %s %s", event, name)
+	}
+}
+
+func (h *AlarmHistory) run() {
+	defer close(h.done)
+	for event := range h.events {
+		h.write(event)
+		h.pending.Done()
+	}
+}
+
+func (h *AlarmHistory) write(event AlarmHistoryEvent) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.file == nil {
+		return
+	}
+	dataBytes, err := json.Marshal(event)
+	if err == nil {
+		_, err = h.file.Write(append(dataBytes, '\n'))
+	}
+	if err != nil {
+		Logger.Errorf("Write alarm history faild: %s", err.Error())
+		return
+	}
+
+	h.appended++
+	if h.appended >= alarmHistoryCompactEvery {
+		h.appended = 0
+		err = h.file.Close()
+		if err == nil {
+			err = h.compact(false)
+		}
+		if err != nil {
+			Logger.Errorf("Compact alarm history faild: %s", err.Error())
+		}
+		h.file, err = os.OpenFile(h.Config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			h.file = nil
+			Logger.Errorf("Open alarm history faild: %s", err.Error())
+		}
+	}
+}
+
+// 查询前等待已记录的事件写入文件
+func (h *AlarmHistory) Query(filter AlarmHistoryFilter) ([]AlarmHistoryEntry, error) {
+	h.pending.Wait()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	entries, err := readAlarmHistoryFile(h.Config.Path, h.now())
+	if err != nil {
+		return nil, err
+	}
+	return FilterAlarmHistory(entries, filter), nil
+}
+
+// 按保留限制重写文件, 调用方需持有 h.lock 或尚未打开文件。
+// startup 为 true 时把上次退出时未清除的告警记为 interrupted
+func (h *AlarmHistory) compact(startup bool) error {
+	now := h.now()
+	entries, err := readAlarmHistoryFile(h.Config.Path, now)
+	if err != nil {
+		return err
+	}
+
+	keep := entries[:0]
+	for _, entry := range entries {
+		open := entry.Cleared == nil && !entry.Interrupted
+		if startup && open {
+			entry.Interrupted = true
+			entry.Cleared = &now
+			open = false
+		}
+		if !open && h.Config.MaxAge > 0 && now.Sub(*entry.Cleared) > h.Config.MaxAge {
+			continue
+		}
+		keep = append(keep, entry)
+	}
+	if h.Config.MaxEntries > 0 && len(keep) > h.Config.MaxEntries {
+		keep = keep[len(keep)-h.Config.MaxEntries:]
+	}
+
+	var b strings.Builder
+	for _, entry := range keep {
+		for _, event := range entry.events() {
+			dataBytes, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			b.Write(dataBytes)
+			b.WriteByte('\n')
+		}
+	}
+	tmp := h.Config.Path + ".tmp"
+	err = os.WriteFile(tmp, []byte(b.String()), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.Config.Path)
+}
+
+func (entry AlarmHistoryEntry) events() []AlarmHistoryEvent {
+	events := []AlarmHistoryEvent{{
+		Time:     entry.Raised,
+		Event:    AlarmRaised,
+		Id:       entry.Id,
+		Name:     entry.Name,
+		OID:      entry.OID,
+		Readings: entry.Readings,
+	}}
+	if entry.Cleared != nil {
+		events = append(events, AlarmHistoryEvent{
+			Time:        *entry.Cleared,
+			Event:       AlarmCleared,
+			Id:          entry.Id,
+			Name:        entry.Name,
+			OID:         entry.OID,
+			Readings:    entry.ClearReadings,
+			Interrupted: entry.Interrupted,
+		})
+	}
+	return events
+}
+
+func readAlarmHistoryFile(path string, now time.Time) ([]AlarmHistoryEntry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ReadAlarmHistory(file, now)
+}
+
+// 把事件按 upsAlarmId 配对成记录, 按发生时间排序, 未清除的记录时长计算到 now
+func ReadAlarmHistory(r io.Reader, now time.Time) ([]AlarmHistoryEntry, error) {
+	var entries []*AlarmHistoryEntry
+	open := map[int]*AlarmHistoryEntry{}
+
+	scanner := bufio.NewScanner(r)
+	n := 0
+	for scanner.Scan() {
+		n++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var event AlarmHistoryEvent
+		err := json.Unmarshal([]byte(line), &event)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		switch event.Event {
+		case AlarmRaised:
+			entry := &AlarmHistoryEntry{
+				Id:       event.Id,
+				Name:     event.Name,
+				OID:      event.OID,
+				Raised:   event.Time,
+				Readings: event.Readings,
+			}
+			entries = append(entries, entry)
+			open[event.Id] = entry
+		case AlarmCleared:
+			entry, ok := open[event.Id]
+			if !ok {
+				continue
+			}
+			delete(open, event.Id)
+			cleared := event.Time
+			entry.Cleared = &cleared
+			entry.ClearReadings = event.Readings
+			entry.Interrupted = event.Interrupted
+		default:
+			return nil, fmt.Errorf("line %d: invalid event '%s'", n, event.Event)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	result := make([]AlarmHistoryEntry, 0, len(entries))
+	for _, entry := range entries {
+		end := now
+		if entry.Cleared != nil {
+			end = *entry.Cleared
+		}
+		entry.Duration = end.Sub(entry.Raised).Seconds()
+		result = append(result, *entry)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Raised.Before(result[j].Raised)
+	})
+	return result, nil
+}
+
+// 返回与时间范围有交集且类型匹配的记录
+func FilterAlarmHistory(entries []AlarmHistoryEntry, filter AlarmHistoryFilter) []AlarmHistoryEntry {
+	result := []AlarmHistoryEntry{}
+	for _, entry := range entries {
+		if filter.Type != "" && filter.Type != entry.Name && filter.Type != entry.OID {
+			continue
+		}
+		if !filter.To.IsZero() && entry.Raised.After(filter.To) {
+			continue
+		}
+		if !filter.From.IsZero() && entry.Cleared != nil && entry.Cleared.Before(filter.From) {
+			continue
+		}
+		result = append(result, entry)
+	}
+	return result
+}
+
+// 解析查询时间: RFC 3339、"2006-01-02 15:04:05"、"2006-01-02" (本地时间),
+// 或 "24h" 这样的时长, 表示 now 之前。空字符串返回零值
+func ParseAlarmHistoryTime(value string, now time.Time) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s'", value)
+}
+
+// history 子命令: 读取配置中的历史文件并按条件输出
+func runHistory(args []string) {
+	flags := pflag.NewFlagSet("history", pflag.ExitOnError)
+	configPath := flags.StringP("config", "c", "config.yml", "配置文件路径, 从中读取 alarm-history.path")
+	path := flags.StringP("file", "f", "", "历史文件路径 (可选, 覆盖配置)")
+	from := flags.String("from", "", "开始时间 (RFC 3339 / 2006-01-02 / 24h 表示 24 小时前)")
+	to := flags.String("to", "", "结束时间, 格式同 --from")
+	alarmType := flags.StringP("type", "t", "", "告警名或 OID, 如 upsAlarmInputBad")
+	asJSON := flags.Bool("json", false, "以 JSON 输出")
+	flags.Parse(args)
+
+	if *path == "" {
+		runConfig := defaultConfig
+		dataBytes, err := os.ReadFile(*configPath)
+		if err == nil {
+			err = yaml.Unmarshal(dataBytes, &runConfig)
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "读取配置文件失败: %s\n", err)
+			os.Exit(1)
+		}
+		*path = runConfig.AlarmHistory.Path
+	}
+	if *path == "" {
+		fmt.Fprintln(os.Stderr, "未配置 alarm-history.path, 请用 --file 指定历史文件")
+		os.Exit(1)
+	}
+
+	now := time.Now()
+	var filter AlarmHistoryFilter
+	var err error
+	filter.Type = *alarmType
+	filter.From, err = ParseAlarmHistoryTime(*from, now)
+	if err == nil {
+		filter.To, err = ParseAlarmHistoryTime(*to, now)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	entries, err := readAlarmHistoryFile(*path, now)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "读取告警历史失败: %s\n", err)
+		os.Exit(1)
+	}
+	entries = FilterAlarmHistory(entries, filter)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(entries)
+		return
+	}
+	WriteAlarmHistory(os.Stdout, entries)
+}
+
+// 以表格输出
+func WriteAlarmHistory(w io.Writer, entries []AlarmHistoryEntry) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "RAISED\tCLEARED\tDURATION\tALARM\tREADINGS")
+	for _, entry := range entries {
+		cleared := "-"
+		if entry.Cleared != nil {
+			cleared = entry.Cleared.Local().Format("2006-01-02 15:04:05")
+			if entry.Interrupted {
+				cleared += " (interrupted)"
+			}
+		}
+		var readings []string
+		for _, r := range alarmHistoryReadings {
+			key := alarmHistoryReadingKey(r.Name, r.Index)
+			if value, ok := entry.Readings[key]; ok {
+				readings = append(readings, fmt.Sprintf("%s=%g", key, value))
+			}
+		}
+		duration := time.Duration(entry.Duration * float64(time.Second)).Round(time.Second)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n",
+			entry.Raised.Local().Format("2006-01-02 15:04:05"), cleared, duration, entry.Name, strings.Join(readings, " "))
+	}
+	tw.Flush()
+}
+
+func alarmHistoryReadingKey(name string, index int) string {
+	if index == 0 {
+		return name
+	}
+	return fmt.Sprintf("%s.%d", name, index)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 断电和恢复写入历史, 可按类型查询; 重启时未清除的告警记为 interrupted
+func TestAlarmHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alarm-history.jsonl")
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	history, err := OpenAlarmHistory(AlarmHistoryConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alarm.History = history
+
+	feedTestReplies(snmp)
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 22.1 25.0 01001000")
+
+	entries, err := history.Query(AlarmHistoryFilter{Type: "upsAlarmInputBad"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Cleared == nil || entries[0].Interrupted {
+		t.Fatalf("unexpected upsAlarmInputBad history %+v", entries)
+	}
+	entry := entries[0]
+	if entry.OID != snmp.GetOID("upsAlarmInputBad", -1) {
+		t.Fatalf("oid %s", entry.OID)
+	}
+	if entry.Readings["upsOutputSource"] != 5 || entry.ClearReadings["upsOutputSource"] != 3 {
+		t.Fatalf("readings %v, clear readings %v", entry.Readings, entry.ClearReadings)
+	}
+	if _, ok := entry.Readings["upsEstimatedChargeRemaining"]; !ok {
+		t.Fatalf("readings %v without upsEstimatedChargeRemaining", entry.Readings)
+	}
+
+	// HTTP 查询
+	server := metricsServer(MetricsConfig{}, snmp)
+	recorder := httptest.NewRecorder()
+	server.Server.Handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/alarms/history?type=upsAlarmLowBattery&from=1h", nil))
+	var queried []AlarmHistoryEntry
+	err = json.Unmarshal(recorder.Body.Bytes(), &queried)
+	if err != nil {
+		t.Fatalf("%s: %s", err, recorder.Body.String())
+	}
+	if len(queried) != 1 || queried[0].Name != "upsAlarmLowBattery" || queried[0].Cleared != nil {
+		t.Fatalf("unexpected upsAlarmLowBattery history %+v", queried)
+	}
+
+	history.Close()
+	alarm.History = nil
+	history, err = OpenAlarmHistory(AlarmHistoryConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer history.Close()
+	entries, err = history.Query(AlarmHistoryFilter{Type: "upsAlarmLowBattery"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || !entries[0].Interrupted || entries[0].Cleared == nil {
+		t.Fatalf("open alarm not interrupted after restart: %+v", entries)
+	}
+}
+
+func TestAlarmHistoryRetention(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alarm-history.jsonl")
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	var lines []string
+	add := func(id int, name string, raised time.Time, cleared time.Time) {
+		for _, event := range (AlarmHistoryEntry{Id: id, Name: name, Raised: raised, Cleared: &cleared}).events() {
+			data, _ := json.Marshal(event)
+			lines = append(lines, string(data))
+		}
+	}
+	add(1, "upsAlarmInputBad", now.Add(-50*24*time.Hour), now.Add(-40*24*time.Hour))
+	add(2, "upsAlarmInputBad", now.Add(-20*24*time.Hour), now.Add(-20*24*time.Hour+time.Minute))
+	add(3, "upsAlarmLowBattery", now.Add(-2*time.Hour), now.Add(-time.Hour))
+	add(4, "upsAlarmInputBad", now.Add(-30*time.Minute), now.Add(-10*time.Minute))
+	err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history := &AlarmHistory{
+		Config: &AlarmHistoryConfig{Path: path, MaxAge: 30 * 24 * time.Hour, MaxEntries: 2},
+		now:    func() time.Time { return now },
+	}
+	err = history.compact(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := history.Query(AlarmHistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].Id != 3 || entries[1].Id != 4 {
+		t.Fatalf("kept %+v, want ids 3 and 4", entries)
+	}
+	if entries[1].Duration != (20 * time.Minute).Seconds() {
+		t.Fatalf("duration %v", entries[1].Duration)
+	}
+
+	filtered := FilterAlarmHistory(entries, AlarmHistoryFilter{From: now.Add(-20 * time.Minute)})
+	if len(filtered) != 1 || filtered[0].Id != 4 {
+		t.Fatalf("from filter %+v", filtered)
+	}
+	filtered = FilterAlarmHistory(entries, AlarmHistoryFilter{To: now.Add(-time.Hour)})
+	if len(filtered) != 1 || filtered[0].Id != 3 {
+		t.Fatalf("to filter %+v", filtered)
+	}
+}
+
+func TestParseAlarmHistoryTime(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Time
+	}{
+		{"", time.Time{}},
+		{"2024-05-01T10:00:00Z", time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)},
+		{"2024-05-01", time.Date(2024, 5, 1, 0, 0, 0, 0, time.Local)},
+		{"2024-05-01 08:30:00", time.Date(2024, 5, 1, 8, 30, 0, 0, time.Local)},
+		{"24h", now.Add(-24 * time.Hour)},
+	}
+	for _, test := range tests {
+		got, err := ParseAlarmHistoryTime(test.value, now)
+		if err != nil || !got.Equal(test.want) {
+			t.Errorf("%q: got %v %v, want %v", test.value, got, err, test.want)
+		}
+	}
+	if _, err := ParseAlarmHistoryTime("yesterday", now); err == nil {
+		t.Error("invalid time accepted")
+	}
+}
+
+// 写文件阻塞时 Record 不等待; 关闭时写入剩余事件, 关闭后的事件被忽略
+func TestAlarmHistoryRecordAsync(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alarm-history.jsonl")
+	history, err := OpenAlarmHistory(AlarmHistoryConfig{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	history.lock.Lock()
+	recorded := make(chan struct{})
+	go func() {
+		history.Record(AlarmRaised, AlarmEntry{Id: 1, Descr: ".1.3.6.1.2.1.33.1.6.3.2"}, "upsAlarmOnBattery", nil)
+		history.Record(AlarmCleared, AlarmEntry{Id: 1, Descr: ".1.3.6.1.2.1.33.1.6.3.2"}, "upsAlarmOnBattery", nil)
+		close(recorded)
+	}()
+	select {
+	case <-recorded:
+	case <-time.After(time.Second):
+		t.Fatal("Record blocked by file I/O")
+	}
+	history.lock.Unlock()
+
+	if err := history.Close(); err != nil {
+		t.Fatal(err)
+	}
+	history.Record(AlarmRaised, AlarmEntry{Id: 2}, "upsAlarmOnBattery", nil)
+
+	entries, err := readAlarmHistoryFile(path, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Id != 1 || entries[0].Cleared == nil {
+		t.Fatalf("unexpected history %+v", entries)
+	}
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+// INFORM 发送队列。
+// 每个接收方一个发送协程, 未确认的通知按退避时间重试, 队列保存在文件中, 重启后继续发送。
+
+const (
+	informMinDelay   = 5 * time.Second
+	informMaxDelay   = 5 * time.Minute
+	informMaxPending = 1000 // 超过后丢弃最旧的通知
+)
+
+type InformVariable struct {
+	Name  string         `json:"name"`
+	Type  gosnmp.Asn1BER `json:"type"`
+	Value any            `json:"value"`
+}
+
+type InformEntry struct {
+	ID        uint64           `json:"id"`
+	Target    string           `json:"target"` // host:port
+	Trap      string           `json:"trap"`   // 通知名
+	Variables []InformVariable `json:"variables"`
+	Created   time.Time        `json:"created"`
+	Attempts  int              `json:"attempts"`
+	NextTry   time.Time        `json:"next-try"`
+	LastError string           `json:"last-error,omitempty"`
+}
+
+type InformTargetStatus struct {
+	Target        string     `json:"target"`
+	Pending       int        `json:"pending"`
+	Delivered     int        `json:"delivered"`
+	Failures      int        `json:"failures"`
+	Dropped       int        `json:"dropped"`
+	LastError     string     `json:"last-error,omitempty"`
+	LastDelivered *time.Time `json:"last-delivered,omitempty"`
+}
+
+type InformStatus struct {
+	Targets []InformTargetStatus `json:"targets"`
+	Pending []InformEntry        `json:"pending"`
+}
+
+type InformQueue struct {
+	Path string // 为空时不保存
+
+	MinDelay time.Duration
+	MaxDelay time.Duration
+
+	lock    sync.Mutex
+	nextID  uint64
+	entries []*InformEntry
+	status  map[string]*InformTargetStatus
+	senders map[string]*informSender
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+type informSender struct {
+	target string
+	client *gosnmp.GoSNMP
+	wake   chan struct{}
+}
+
+// 打开队列, 加载上次未送达的通知
+func OpenInformQueue(path string) (*InformQueue, error) {
+	q := &InformQueue{
+		Path:     path,
+		MinDelay: informMinDelay,
+		MaxDelay: informMaxDelay,
+		status:   map[string]*InformTargetStatus{},
+		senders:  map[string]*informSender{},
+		stop:     make(chan struct{}),
+	}
+	if path == "" {
+		return q, nil
+	}
+
+	dataBytes, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(dataBytes, &q.entries)
+	if err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+	for _, entry := range q.entries {
+		for i := range entry.Variables {
+			entry.Variables[i].Value = informValue(entry.Variables[i])
+		}
+		if entry.ID > q.nextID {
+			q.nextID = entry.ID
+		}
+		q.targetStatus(entry.Target).Pending++
+	}
+	if len(q.entries) != 0 {
+		Logger.Warnf("Loaded %d undelivered informs from '%s'", len(q.entries), path)
+	}
+	return q, nil
+}
+
+// JSON 解码后数字为 float64, 按类型还原
+func informValue(v InformVariable) any {
+	number, ok := v.Value.(float64)
+	if !ok {
+		return v.Value
+	}
+	switch v.Type {
+	case gosnmp.Integer:
+		return int(number)
+	case gosnmp.Counter64:
+		return uint64(number)
+	case gosnmp.TimeTicks, gosnmp.Counter32, gosnmp.Gauge32:
+		return uint32(number)
+	}
+	return v.Value
+}
+
+func (q *InformQueue) targetStatus(target string) *InformTargetStatus {
+	status, ok := q.status[target]
+	if !ok {
+		status = &InformTargetStatus{Target: target}
+		q.status[target] = status
+	}
+	return status
+}
+
+// 调用方需持有 q.lock
+func (q *InformQueue) save() {
+	if q.Path == "" {
+		return
+	}
+	entries := q.entries
+	if entries == nil {
+		entries = []*InformEntry{}
+	}
+	dataBytes, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		Logger.Errorf("Save inform queue faild: %s", err.Error())
+		return
+	}
+	tmp := q.Path + ".tmp"
+	err = os.WriteFile(tmp, dataBytes, 0644)
+	if err == nil {
+		err = os.Rename(tmp, q.Path)
+	}
+	if err != nil {
+		Logger.Errorf("Save inform queue faild: %s", err.Error())
+	}
+}
+
+func informTarget(client *gosnmp.GoSNMP) string {
+	return fmt.Sprintf("%s:%d", client.Target, client.Port)
+}
+
+// 添加接收方并启动发送协程, 队列中该接收方未送达的通知会继续发送
+func (q *InformQueue) AddTarget(client *gosnmp.GoSNMP) {
+	sender := &informSender{
+		target: informTarget(client),
+		client: client,
+		wake:   make(chan struct{}, 1),
+	}
+
+	q.lock.Lock()
+	q.senders[sender.target] = sender
+	q.targetStatus(sender.target)
+	q.lock.Unlock()
+
+	q.wg.Add(1)
+	go q.run(sender)
+}
+
+// 加入队列, 由发送协程异步发送
+func (q *InformQueue) Add(client *gosnmp.GoSNMP, name string, variables []gosnmp.SnmpPDU) {
+	entry := &InformEntry{
+		Target:  informTarget(client),
+		Trap:    name,
+		Created: time.Now(),
+		NextTry: time.Now(),
+	}
+	for _, v := range variables {
+		entry.Variables = append(entry.Variables, InformVariable{Name: v.Name, Type: v.Type, Value: v.Value})
+	}
+
+	q.lock.Lock()
+	q.nextID++
+	entry.ID = q.nextID
+	q.entries = append(q.entries, entry)
+	q.targetStatus(entry.Target).Pending++
+	q.dropOldest(entry.Target)
+	q.save()
+	sender := q.senders[entry.Target]
+	q.lock.Unlock()
+
+	if sender != nil {
+		select {
+		case sender.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// 调用方需持有 q.lock
+func (q *InformQueue) dropOldest(target string) {
+	count := 0
+	for _, entry := range q.entries {
+		if entry.Target == target {
+			count++
+		}
+	}
+	for i := 0; count > informMaxPending && i < len(q.entries); {
+		entry := q.entries[i]
+		if entry.Target != target {
+			i++
+			continue
+		}
+		Logger.Errorf("Inform queue of %s is full, drop %s #%d created at %s", target, entry.Trap, entry.ID, entry.Created.Format(time.RFC3339))
+		q.entries = append(q.entries[:i], q.entries[i+1:]...)
+		status := q.targetStatus(target)
+		status.Pending--
+		status.Dropped++
+		count--
+	}
+}
+
+// 取出该接收方最早的一条通知, 返回需要等待的时间
+func (q *InformQueue) next(target string) (*InformEntry, time.Duration) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for _, entry := range q.entries {
+		if entry.Target != target {
+			continue
+		}
+		// 按顺序送达, 最早的一条未确认前不发送后面的
+		wait := time.Until(entry.NextTry)
+		if wait > 0 {
+			return nil, wait
+		}
+		return entry, 0
+	}
+	return nil, -1
+}
+
+func (q *InformQueue) delay(attempts int) time.Duration {
+	delay := q.MinDelay
+	for i := 1; i < attempts && delay < q.MaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > q.MaxDelay {
+		delay = q.MaxDelay
+	}
+	return delay
+}
+
+func (q *InformQueue) done(entry *InformEntry, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	status := q.targetStatus(entry.Target)
+	if err == nil {
+		for i, e := range q.entries {
+			if e == entry {
+				q.entries = append(q.entries[:i], q.entries[i+1:]...)
+				status.Pending--
+				break
+			}
+		}
+		now := time.Now()
+		status.Delivered++
+		status.LastDelivered = &now
+		Logger.Infof("Inform %s #%d delivered to %s after %d attempts", entry.Trap, entry.ID, entry.Target, entry.Attempts+1)
+	} else {
+		entry.Attempts++
+		entry.LastError = err.Error()
+		delay := q.delay(entry.Attempts)
+		entry.NextTry = time.Now().Add(delay)
+		status.Failures++
+		status.LastError = err.Error()
+		Logger.Warnf("Inform %s #%d to %s faild (attempt %d): %s, retry in %s", entry.Trap, entry.ID, entry.Target, entry.Attempts, err.Error(), delay)
+	}
+	q.save()
+}
+
+func (q *InformQueue) run(sender *informSender) {
+	defer q.wg.Done()
+	for {
+		entry, wait := q.next(sender.target)
+		if entry == nil {
+			var timer <-chan time.Time
+			if wait >= 0 {
+				timer = time.After(wait)
+			}
+			select {
+			case <-q.stop:
+				return
+			case <-sender.wake:
+			case <-timer:
+			}
+			continue
+		}
+
+		q.done(entry, sender.send(entry))
+
+		select {
+		case <-q.stop:
+			return
+		default:
+		}
+	}
+}
+
+func (s *informSender) send(entry *InformEntry) error {
+	trap := gosnmp.SnmpTrap{IsInform: true}
+	for _, v := range entry.Variables {
+		trap.Variables = append(trap.Variables, gosnmp.SnmpPDU{Name: v.Name, Type: v.Type, Value: v.Value})
+	}
+	result, err := s.client.SendTrap(trap)
+	if err != nil {
+		return err
+	}
+	if result != nil && result.Error != gosnmp.NoError {
+		return fmt.Errorf("%s", result.Error)
+	}
+	return nil
+}
+
+func (q *InformQueue) Status() InformStatus {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	status := InformStatus{
+		Targets: []InformTargetStatus{},
+		Pending: []InformEntry{},
+	}
+	for _, target := range q.status {
+		status.Targets = append(status.Targets, *target)
+	}
+	for _, entry := range q.entries {
+		status.Pending = append(status.Pending, *entry)
+	}
+	return status
+}
+
+// 停止发送协程, 未送达的通知已在文件中
+func (q *InformQueue) Close() {
+	select {
+	case <-q.stop:
+		return
+	default:
+		close(q.stop)
+	}
+	q.wg.Wait()
+}
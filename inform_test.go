@@ -0,0 +1,200 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func newTestInformQueue(t *testing.T, path string) *InformQueue {
+	t.Helper()
+
+	queue, err := OpenInformQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.MinDelay = 50 * time.Millisecond
+	queue.MaxDelay = 200 * time.Millisecond
+	t.Cleanup(queue.Close)
+	return queue
+}
+
+// 等待 fn 对队列状态返回 true
+func waitInformStatus(t *testing.T, queue *InformQueue, fn func(status InformStatus) bool) InformStatus {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		status := queue.Status()
+		if fn(status) {
+			return status
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected inform status %+v", status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// 接收端未启动时重试, 启动后送达并从队列中删除
+func TestInformRetry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inform-queue.json")
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{InformQueue: path})
+	snmp.InformQueue = newTestInformQueue(t, path)
+
+	port := freeTestPort(t)
+	err := snmp.AddTrap(TrapConfig{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Inform:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snmp.Trap) != 0 || len(snmp.Inform) != 1 {
+		t.Fatalf("%d trap receivers, %d inform receivers", len(snmp.Trap), len(snmp.Inform))
+	}
+	feedTestReplies(snmp)
+
+	status := waitInformStatus(t, snmp.InformQueue, func(status InformStatus) bool {
+		return len(status.Targets) == 1 && status.Targets[0].Failures >= 2
+	})
+	if status.Targets[0].Pending == 0 || status.Targets[0].LastError == "" || status.Pending[0].Attempts == 0 {
+		t.Fatalf("unexpected inform status %+v", status)
+	}
+
+	// 未送达的通知已保存
+	saved, err := OpenInformQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.entries) == 0 {
+		t.Fatal("pending informs not saved")
+	}
+
+	traps := startTestTrapListener(t, &gosnmp.GoSNMP{
+		Version:   gosnmp.Version2c,
+		Community: "public",
+		Logger:    gosnmp.NewLogger(SNMPLogger),
+	}, port)
+	traps.wait(t, snmp, "upsTrapOnBattery")
+
+	waitInformStatus(t, snmp.InformQueue, func(status InformStatus) bool {
+		return len(status.Pending) == 0 && status.Targets[0].Delivered > 0
+	})
+	saved, err = OpenInformQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.entries) != 0 {
+		t.Fatalf("%d informs left in queue file", len(saved.entries))
+	}
+}
+
+// 重启后从文件加载未送达的通知, 变量类型不变, 接收方添加后继续发送
+func TestInformQueueReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "inform-queue.json")
+	port := freeTestPort(t)
+	client := &gosnmp.GoSNMP{
+		Target:    "127.0.0.1",
+		Port:      port,
+		Version:   gosnmp.Version2c,
+		Community: "public",
+		Timeout:   time.Second,
+		Logger:    gosnmp.NewLogger(SNMPLogger),
+	}
+	variables := []gosnmp.SnmpPDU{
+		{Name: sysUpTimeOID, Type: gosnmp.TimeTicks, Value: uint32(1234)},
+		{Name: snmpTrapOIDOID, Type: gosnmp.ObjectIdentifier, Value: ".1.3.6.1.2.1.33.2.1"},
+		{Name: ".1.3.6.1.2.1.33.1.2.3.0", Type: gosnmp.Integer, Value: 17},
+		{Name: ".1.3.6.1.2.1.33.1.1.1.0", Type: gosnmp.OctetString, Value: "Santak"},
+	}
+
+	queue, err := OpenInformQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.Add(client, "upsTrapOnBattery", variables)
+	queue.Add(client, "upsTrapOnBattery", variables)
+	queue.Close()
+
+	queue = newTestInformQueue(t, path)
+	status := queue.Status()
+	if len(status.Pending) != 2 || status.Pending[1].ID != 2 {
+		t.Fatalf("unexpected reloaded queue %+v", status)
+	}
+	for i, v := range status.Pending[0].Variables {
+		if v.Name != variables[i].Name || v.Type != variables[i].Type || v.Value != variables[i].Value {
+			t.Fatalf("variable %d: got %v, want %v", i, v, variables[i])
+		}
+	}
+
+	traps := startTestTrapListener(t, &gosnmp.GoSNMP{
+		Version:   gosnmp.Version2c,
+		Community: "public",
+		Logger:    gosnmp.NewLogger(SNMPLogger),
+	}, port)
+	err = client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.AddTarget(client)
+
+	waitInformStatus(t, queue, func(status InformStatus) bool {
+		return len(status.Pending) == 0 && status.Targets[0].Delivered == 2
+	})
+	traps.lock.Lock()
+	defer traps.lock.Unlock()
+	if len(traps.received) != 2 {
+		t.Fatalf("received %d informs, want 2", len(traps.received))
+	}
+}
+
+// v3 INFORM 的权威引擎是接收方, 发送前先发现接收方的引擎 ID, 不使用 Agent 的引擎 ID
+func TestInformV3(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{Auth: []SNMPAuth{testSNMPUser}})
+	snmp.InformQueue = newTestInformQueue(t, "")
+
+	const engineID = "\x80\x00\x1f\x88\x04receiver"
+	port := freeTestPort(t)
+	traps := startTestTrapListener(t, &gosnmp.GoSNMP{
+		Version:       gosnmp.Version3,
+		SecurityModel: gosnmp.UserSecurityModel,
+		MsgFlags:      gosnmp.AuthPriv,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			UserName:                 testSNMPUser.Username,
+			AuthenticationProtocol:   testSNMPUser.AuthProto,
+			AuthenticationPassphrase: testSNMPUser.AuthKey,
+			PrivacyProtocol:          testSNMPUser.PrivProto,
+			PrivacyPassphrase:        testSNMPUser.PrivKey,
+			AuthoritativeEngineID:    engineID,
+		},
+		Logger: gosnmp.NewLogger(SNMPLogger),
+	}, port)
+
+	auth := testSNMPUser
+	err := snmp.AddTrap(TrapConfig{
+		Host:    "127.0.0.1",
+		Port:    port,
+		Version: gosnmp.Version3,
+		Inform:  true,
+		Auth:    &auth,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	feedTestReplies(snmp)
+
+	packet := traps.wait(t, snmp, "upsTrapOnBattery")
+	usm := packet.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if usm.AuthoritativeEngineID != engineID {
+		t.Fatalf("inform engine ID %x, want receiver engine ID %x", usm.AuthoritativeEngineID, engineID)
+	}
+	waitInformStatus(t, snmp.InformQueue, func(status InformStatus) bool {
+		return len(status.Targets) == 1 && status.Targets[0].Delivered > 0
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+
+	"github.com/slayercat/GoSNMPServer"
+)
+
+// 与 GoSNMPServer.UDPListener 相同, 但 Shutdown 只关闭连接而不把 conn 置空,
+// Shutdown 与 NextSnmp 在不同协程中调用时没有数据竞争
+type udpListener struct {
+	conn   *net.UDPConn
+	logger GoSNMPServer.ILogger
+}
+
+func newUDPListener(address string) (GoSNMPServer.ISnmpServerListener, error) {
+	addr, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &udpListener{conn: conn, logger: GoSNMPServer.NewDiscardLogger()}, nil
+}
+
+func (l *udpListener) SetupLogger(logger GoSNMPServer.ILogger) {
+	l.logger = logger
+}
+
+func (l *udpListener) Address() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+func (l *udpListener) NextSnmp() ([]byte, GoSNMPServer.IReplyer, error) {
+	var msg [4096]byte
+	counts, addr, err := l.conn.ReadFromUDP(msg[:])
+	if err != nil {
+		return nil, nil, err
+	}
+	l.logger.Infof("udp request from %v. size=%v", addr, counts)
+	return msg[:counts], &udpReplyer{target: addr, conn: l.conn}, nil
+}
+
+func (l *udpListener) Shutdown() {
+	l.conn.Close()
+}
+
+type udpReplyer struct {
+	target *net.UDPAddr
+	conn   *net.UDPConn
+}
+
+func (r *udpReplyer) ReplyPDU(data []byte) error {
+	_, err := r.conn.WriteToUDP(data, r.target)
+	return err
+}
+
+func (r *udpReplyer) Shutdown() {}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"net"
@@ -38,6 +39,8 @@ type Trap struct {
 	User      User   `yaml:"user"`
 
 	Version gosnmp.SnmpVersion `yaml:"version"`
+
+	Inform bool `yaml:"inform"` // 发送 InformRequest, 未确认时重试
 }
 
 type Snmp struct {
@@ -48,17 +51,132 @@ type Snmp struct {
 
 	Trap []Trap `yaml:"trap"`
 
+	InformQueue string `yaml:"inform-queue"` // 未送达的 INFORM 保存到该文件, 重启后继续发送
+
+	TrapInterval map[string]time.Duration `yaml:"trap-interval"` // 通知名 -> 最小发送间隔
+
 	LogLevel string `yaml:"log-level"`
 }
 
+type NutUser struct {
+	Username string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	Actions  []string `yaml:"actions"`
+	InstCmds []string `yaml:"instcmds"`
+	Upsmon   string   `yaml:"upsmon"`
+}
+
+type Nut struct {
+	Enable  bool   `yaml:"enable"`
+	Address string `yaml:"address"`
+	Port    int    `yaml:"port"`
+	Name    string `yaml:"name"`
+
+	User []NutUser `yaml:"user"`
+}
+
+type Metrics struct {
+	Enable  bool   `yaml:"enable"`
+	Address string `yaml:"address"`
+	Port    int    `yaml:"port"`
+	Path    string `yaml:"path"`
+
+	InformPath  string `yaml:"inform-path"`
+	HistoryPath string `yaml:"history-path"`
+}
+
+type MQTTOption struct {
+	Enable   bool   `yaml:"enable"`
+	Broker   string `yaml:"broker"` // tcp://host:1883, ssl://host:8883
+	ClientID string `yaml:"client-id"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+
+	Topic    string        `yaml:"topic"`    // 主题前缀
+	Interval time.Duration `yaml:"interval"` // 读数发布间隔
+
+	Discovery       bool   `yaml:"discovery"` // 发布 Home Assistant 自动发现配置
+	DiscoveryPrefix string `yaml:"discovery-prefix"`
+
+	AllowShutdown bool `yaml:"allow-shutdown"` // 接受 shutdown 命令, 任何能向 command 主题发布的客户端都能关闭 UPS
+	ShutdownDelay int  `yaml:"shutdown-delay"` // shutdown 命令的默认关机延时, 秒
+}
+
+type AlarmHistoryOption struct {
+	Path       string        `yaml:"path"`        // 为空时不记录
+	MaxAge     time.Duration `yaml:"max-age"`     // 保留时长, 0 为不限制
+	MaxEntries int           `yaml:"max-entries"` // 保留条数, 0 为不限制
+}
+
+type AlarmRuleOption struct {
+	Name     string        `yaml:"name"`
+	Alarm    string        `yaml:"alarm"`
+	Expr     string        `yaml:"expr"`
+	Clear    string        `yaml:"clear"`
+	For      time.Duration `yaml:"for"`
+	ClearFor time.Duration `yaml:"clear-for"`
+	Severity string        `yaml:"severity"`
+}
+
+type WebhookOption struct {
+	URL         string            `yaml:"url"`
+	Events      []string          `yaml:"events"`   // alarm-raised / alarm-cleared / test-completed, 为空时全部发送
+	Template    string            `yaml:"template"` // text/template, 为空时发送默认 JSON
+	ContentType string            `yaml:"content-type"`
+	Secret      string            `yaml:"secret"` // HMAC-SHA256 签名密钥
+	Headers     map[string]string `yaml:"headers"`
+	Timeout     time.Duration     `yaml:"timeout"`
+	Retries     int               `yaml:"retries"`
+	RetryDelay  time.Duration     `yaml:"retry-delay"`
+}
+
+type AlarmDebounceCountOption struct {
+	Raise int `yaml:"raise"` // 连续成立多少次轮询后产生告警
+	Clear int `yaml:"clear"` // 连续不成立多少次轮询后清除告警
+}
+
+type AlarmDebounceOption struct {
+	AlarmDebounceCountOption `yaml:",inline"`
+
+	Alarms map[string]AlarmDebounceCountOption `yaml:"alarms"` // 按告警名覆盖默认次数
+
+	FlapChanges int           `yaml:"flap-changes"` // flap-window 内变化多少次视为抖动, 0 为不检测
+	FlapWindow  time.Duration `yaml:"flap-window"`
+	FlapQuiet   time.Duration `yaml:"flap-quiet"` // 没有变化多久后结束抖动
+}
+
 type RunConfig struct {
 	COMPort string `yaml:"com-port"`
 
+	// 串口断开后重新打开的退避时间, 每次失败加倍直到上限, 0 为默认 1s / 30s
+	ReconnectMinDelay time.Duration `yaml:"reconnect-min-delay"`
+	ReconnectMaxDelay time.Duration `yaml:"reconnect-max-delay"`
+
+	Device string `yaml:"device"` // 设备配置名或配置文件路径, auto 为启动时自动识别
+
+	Capture     string  `yaml:"capture"`      // 录制串口收发到该文件, 为空时不录制
+	Replay      string  `yaml:"replay"`       // 回放录制文件代替串口
+	ReplaySpeed float64 `yaml:"replay-speed"` // 回放倍速, 1 为原速
+
 	Address string `yaml:"address"`
 	Port    int    `yaml:"port"`
 
 	Snmp Snmp `yaml:"snmp"`
 
+	Nut Nut `yaml:"nut"`
+
+	Metrics Metrics `yaml:"metrics"`
+
+	MQTT MQTTOption `yaml:"mqtt"`
+
+	AlarmHistory AlarmHistoryOption `yaml:"alarm-history"`
+
+	AlarmRules []AlarmRuleOption `yaml:"alarm-rules"`
+
+	AlarmDebounce AlarmDebounceOption `yaml:"alarm-debounce"`
+
+	Webhooks []WebhookOption `yaml:"webhooks"`
+
 	DisableBuzz bool `yaml:"disable-buzz"`
 
 	LogLevel  string   `yaml:"log-level"`
@@ -67,9 +185,12 @@ type RunConfig struct {
 
 var defaultConfig = RunConfig{
 	COMPort: "COM8",
+	Device:  autoDeviceProfile,
 	Address: "0.0.0.0",
 	Port:    161,
 
+	ReplaySpeed: 1,
+
 	Snmp: Snmp{
 		PublicName:  "public",
 		PrivateName: "private",
@@ -101,9 +222,59 @@ var defaultConfig = RunConfig{
 			},
 		},
 
+		InformQueue: "inform-queue.json",
+
 		LogLevel: "error",
 	},
 
+	Nut: Nut{
+		Enable:  false,
+		Address: "0.0.0.0",
+		Port:    3493,
+		Name:    "santak",
+
+		User: []NutUser{
+			{
+				Username: "upsmon",
+				Password: "upsmon",
+				Upsmon:   "primary",
+			},
+		},
+	},
+
+	Metrics: Metrics{
+		Enable:  false,
+		Address: "0.0.0.0",
+		Port:    9163,
+		Path:    "/metrics",
+
+		InformPath:  "/inform",
+		HistoryPath: "/alarms/history",
+	},
+
+	MQTT: MQTTOption{
+		Enable:          false,
+		Broker:          "tcp://127.0.0.1:1883",
+		Topic:           "santak-ups",
+		Interval:        10 * time.Second,
+		Discovery:       true,
+		DiscoveryPrefix: "homeassistant",
+		AllowShutdown:   false,
+		ShutdownDelay:   60,
+	},
+
+	AlarmHistory: AlarmHistoryOption{
+		MaxAge:     90 * 24 * time.Hour,
+		MaxEntries: 10000,
+	},
+
+	AlarmDebounce: AlarmDebounceOption{
+		AlarmDebounceCountOption: AlarmDebounceCountOption{Raise: 1, Clear: 1},
+		FlapChanges:              6,
+		FlapWindow:               time.Minute,
+		FlapQuiet:                2 * time.Minute,
+	},
+
 	DisableBuzz: false,
 	LogLevel:    "info",
 }
@@ -122,6 +293,8 @@ var data = &SNMPData{
 
 var alarm = Alarm{}
 
+var control = Control{}
+
 var Logger *logrus.Logger
 var SNMPLogger *logrus.Logger
 
@@ -131,7 +304,13 @@ var config = RunConfig{}
 
 func argsParse() {
 	var configPath string
+	var capturePath string
+	var replayPath string
+	var replaySpeed float64
 	pflag.StringVarP(&configPath, "config", "c", "config.yml", "配置文件路径 (可选)")
+	pflag.StringVar(&capturePath, "capture", "", "录制串口收发到该文件 (可选)")
+	pflag.StringVar(&replayPath, "replay", "", "回放录制文件代替串口 (可选)")
+	pflag.Float64Var(&replaySpeed, "replay-speed", 0, "回放倍速 (可选)")
 
 	if _, err := os.Stat(configPath); os.IsNotExist(err) {
 		config = defaultConfig
@@ -161,7 +340,17 @@ func argsParse() {
 
 	pflag.Parse()
 
-	if config.COMPort == "" {
+	if capturePath != "" {
+		config.Capture = capturePath
+	}
+	if replayPath != "" {
+		config.Replay = replayPath
+	}
+	if replaySpeed > 0 {
+		config.ReplaySpeed = replaySpeed
+	}
+
+	if config.COMPort == "" && config.Replay == "" {
 		pflag.Usage()
 
 		ports, err := enumerator.GetDetailedPortsList()
@@ -196,6 +385,15 @@ func main() {
 	sigs = make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGQUIT)
 
+	if len(os.Args) > 1 && os.Args[1] == "simulate" {
+		runSimulate(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "history" {
+		runHistory(os.Args[2:])
+		return
+	}
+
 	argsParse()
 	setLogLevel(Logger, config.LogLevel)
 	setLogLevel(SNMPLogger, config.Snmp.LogLevel)
@@ -221,16 +419,65 @@ func main() {
 		})
 	}
 
-	serial, err := serialInit(TTYConfig{
-		Port:     config.COMPort,
-		Received: serialReceived,
-	})
-	if err != nil {
-		Logger.Fatalf("Init serail faild: %s", err.Error())
+	if err := CheckTrapIntervals(config.Snmp.TrapInterval); err != nil {
+		Logger.Fatalf("Invalid trap-interval: %s", err.Error())
 		return
 	}
 
-	device := Mt1000Pro
+	var serial *TTY
+	var replay *Replay
+	var capture *Capture
+	var err error
+	if config.Replay != "" {
+		replay, err = OpenReplay(config.Replay, config.ReplaySpeed)
+		if err != nil {
+			Logger.Fatalf("Open replay faild: %s", err.Error())
+			return
+		}
+		replay.Received = serialReceived
+		Logger.Infof("Replay '%s' at %.1fx, %d replies", config.Replay, replay.Speed, len(replay.Replies))
+	} else {
+		if config.Capture != "" {
+			capture, err = OpenCapture(config.Capture)
+			if err != nil {
+				Logger.Fatalf("Open capture faild: %s", err.Error())
+				return
+			}
+			Logger.Infof("Capture serial session to '%s'", config.Capture)
+		}
+
+		serial, err = serialInit(TTYConfig{
+			Port:     config.COMPort,
+			Capture:  capture,
+			Received: serialReceived,
+
+			ReconnectMinDelay: config.ReconnectMinDelay,
+			ReconnectMaxDelay: config.ReconnectMaxDelay,
+		})
+		if err != nil {
+			Logger.Fatalf("Init serail faild: %s", err.Error())
+			return
+		}
+	}
+
+	var profile *DeviceProfile
+	if config.Device == autoDeviceProfile && replay != nil {
+		profile, err = DetectReplayProfile(replay)
+	} else if config.Device == autoDeviceProfile {
+		profile, err = DetectDeviceProfile(serial, probeWait)
+	} else {
+		profile, err = LoadDeviceProfile(config.Device)
+	}
+	if err != nil {
+		Logger.Fatalf("Load device profile faild: %s", err.Error())
+		return
+	}
+	device, err := NewDevice(profile)
+	if err != nil {
+		Logger.Fatalf("Init device faild: %s", err.Error())
+		return
+	}
+	Logger.Infof("Device profile: %s (%s %s)", profile.Name, profile.Manufacturer, profile.Model)
 
 	snmp := snmp_server(SNMPConfig{
 		PublicName:  config.Snmp.PublicName,
@@ -241,12 +488,22 @@ func main() {
 
 		Auth: auth,
 
+		InformQueue: config.Snmp.InformQueue,
+
+		TrapIntervals: config.Snmp.TrapInterval,
+
 		SetCallback: device.SetCallback,
 
 		Logger: GoSNMPServer.WrapLogrus(SNMPLogger),
 	}, device.EnableService, data)
 	snmp.SetDevice(device)
-	snmp.SetSerialSend(createSerialSend(serial))
+	if replay != nil {
+		snmp.SetSerialSend(func(value string) {
+			Logger.Infof("Replay: ignore send '%s'", value)
+		})
+	} else {
+		snmp.SetSerialSend(createSerialSend(serial))
+	}
 
 	for _, trap := range config.Snmp.Trap {
 		if trap.Enable {
@@ -255,6 +512,7 @@ func main() {
 				Port:      uint16(trap.Port),
 				Community: trap.Community,
 				Version:   trap.Version,
+				Inform:    trap.Inform,
 			}
 
 			if trap.User.Username != "" && trap.User.AuthPass != "" && trap.User.PrivPass != "" {
@@ -276,6 +534,78 @@ func main() {
 	}
 
 	alarm.SetSNMP(snmp)
+	control.SetSNMP(snmp)
+	go control.Run()
+
+	var rules []AlarmRuleConfig
+	for _, rule := range config.AlarmRules {
+		rules = append(rules, AlarmRuleConfig{
+			Name:     rule.Name,
+			Alarm:    rule.Alarm,
+			Expr:     rule.Expr,
+			Clear:    rule.Clear,
+			For:      rule.For,
+			ClearFor: rule.ClearFor,
+			Severity: rule.Severity,
+		})
+	}
+	alarm.Rules, err = NewAlarmRules(snmp, rules)
+	if err != nil {
+		Logger.Fatalf("Load alarm rules faild: %s", err.Error())
+	}
+
+	var webhooks []WebhookConfig
+	for _, webhook := range config.Webhooks {
+		webhooks = append(webhooks, WebhookConfig{
+			URL:         webhook.URL,
+			Events:      webhook.Events,
+			Template:    webhook.Template,
+			ContentType: webhook.ContentType,
+			Secret:      webhook.Secret,
+			Headers:     webhook.Headers,
+			Timeout:     webhook.Timeout,
+			Retries:     webhook.Retries,
+			RetryDelay:  webhook.RetryDelay,
+		})
+	}
+	if len(webhooks) != 0 {
+		snmp.Notifier, err = NewNotifier(webhooks)
+		if err != nil {
+			Logger.Fatalf("Load webhooks faild: %s", err.Error())
+		}
+	}
+
+	alarm.Debounce = &AlarmDebounceConfig{
+		AlarmDebounceCount: AlarmDebounceCount{
+			Raise: config.AlarmDebounce.Raise,
+			Clear: config.AlarmDebounce.Clear,
+		},
+		Alarms:      map[string]AlarmDebounceCount{},
+		FlapChanges: config.AlarmDebounce.FlapChanges,
+		FlapWindow:  config.AlarmDebounce.FlapWindow,
+		FlapQuiet:   config.AlarmDebounce.FlapQuiet,
+	}
+	alarmsOID := snmp.GetOID("upsWellKnownAlarms", -1) + "."
+	for name, count := range config.AlarmDebounce.Alarms {
+		oid, err := snmp.Mib.OID(name)
+		if err != nil || !strings.HasPrefix("."+oid.String(), alarmsOID) {
+			Logger.Fatalf("Alarm debounce: '%s' is not in upsWellKnownAlarms", name)
+		}
+		alarm.Debounce.Alarms[name] = AlarmDebounceCount{Raise: count.Raise, Clear: count.Clear}
+	}
+
+	if config.AlarmHistory.Path != "" {
+		alarm.History, err = OpenAlarmHistory(AlarmHistoryConfig{
+			Path:       config.AlarmHistory.Path,
+			MaxAge:     config.AlarmHistory.MaxAge,
+			MaxEntries: config.AlarmHistory.MaxEntries,
+		})
+		if err != nil {
+			// 历史只用于查询, 打开失败不影响 SNMP 服务
+			Logger.Errorf("Open alarm history faild: %s, alarm history disabled", err.Error())
+			alarm.History = nil
+		}
+	}
 
 	err = device.InitCallback(snmp, data)
 	if err != nil {
@@ -283,40 +613,162 @@ func main() {
 		return
 	}
 
-	serial.SetUserData(snmp)
+	if replay != nil {
+		go replay.Run(snmp)
+	} else {
+		serial.SetUserData(snmp)
+	}
 
-	go func() {
-		send := func(data string) {
-			err := serial.Send(data)
-			if err != nil {
-				Logger.Errorf("Send data '%s' faild: %s", data, err.Error())
-			}
+	var nut *NUT
+	if config.Nut.Enable {
+		var users []NUTUser
+		for _, user := range config.Nut.User {
+			users = append(users, NUTUser{
+				Username: user.Username,
+				Password: user.Password,
+				Actions:  user.Actions,
+				InstCmds: user.InstCmds,
+				Upsmon:   user.Upsmon,
+			})
 		}
-		for {
-			select {
-			case <-sigs:
-				Logger.Infof("Received signal. Stopping send operation...")
-				return
-			default:
-				send(device.GetInfo)
-				send(device.GetRated)
-				send(device.GetManufacturer)
-				send(device.ExtraGetInfo)
-				send(device.ExtraGetError)
-				send(device.ExtraGetTPInfo)
-				send(device.ExtraGetRated)
-
-				time.Sleep(time.Second * 1)
-			}
+
+		nut, err = nutServer(NUTConfig{
+			Address: config.Nut.Address,
+			Port:    config.Nut.Port,
+			Name:    config.Nut.Name,
+			Users:   users,
+		}, snmp)
+		if err != nil {
+			Logger.Fatalf("Init NUT server faild: %s", err.Error())
+			return
 		}
-	}()
+		go nut.Run()
+	}
+
+	var metrics *MetricsServer
+	if config.Metrics.Enable {
+		metrics = metricsServer(MetricsConfig{
+			Address: config.Metrics.Address,
+			Port:    config.Metrics.Port,
+			Path:    config.Metrics.Path,
+
+			InformPath:  config.Metrics.InformPath,
+			HistoryPath: config.Metrics.HistoryPath,
+		}, snmp)
+		go metrics.Run()
+	}
+
+	var mqtt *MQTTServer
+	if config.MQTT.Enable {
+		mqtt = mqttServer(MQTTConfig{
+			Broker:   config.MQTT.Broker,
+			ClientID: config.MQTT.ClientID,
+			Username: config.MQTT.Username,
+			Password: config.MQTT.Password,
+
+			Topic:    config.MQTT.Topic,
+			Interval: config.MQTT.Interval,
+
+			Discovery:       config.MQTT.Discovery,
+			DiscoveryPrefix: config.MQTT.DiscoveryPrefix,
+
+			AllowShutdown: config.MQTT.AllowShutdown,
+			ShutdownDelay: config.MQTT.ShutdownDelay,
+		}, snmp)
+		// 告警和测试事件与 Webhook 一起由 Notifier 分发
+		snmp.Lock.Lock()
+		if snmp.Notifier == nil {
+			snmp.Notifier, _ = NewNotifier(nil)
+		}
+		snmp.Notifier.AddHandler(mqtt.PublishEvent)
+		snmp.Lock.Unlock()
+		go mqtt.Run()
+	}
+
+	// 回放时应答来自录制文件, 不轮询串口
+	if serial != nil {
+		watchdog := &Watchdog{
+			Timeout: 10 * time.Second,
+			OnLost: func() {
+				snmp.Lock.Lock()
+				data.Battery.Status = 1
+				// 看门狗已有超时, 不经过轮询去抖
+				if !alarm.Exist("upsAlarmCommunicationsLost") {
+					alarm.Add("upsAlarmCommunicationsLost")
+				}
+				alarm.Apply()
+				snmp.Lock.Unlock()
+				serial.Reconnect()
+			},
+			OnRestore: func() {
+				snmp.Lock.Lock()
+				alarm.RemoveWithDesc("upsAlarmCommunicationsLost")
+				alarm.Apply()
+				snmp.Lock.Unlock()
+			},
+		}
+
+		go func() {
+			poll := func(cmd string) bool {
+				err := serial.Poll(cmd, 0)
+				if err == nil {
+					return true
+				}
+				if errors.Is(err, ErrTimeout) || errors.Is(err, ErrDisconnected) {
+					Logger.Warnf("Poll faild: %s", err.Error())
+				} else {
+					Logger.Debugf("Poll faild: %s", err.Error())
+				}
+				return false
+			}
+			for {
+				select {
+				case <-sigs:
+					Logger.Infof("Received signal. Stopping send operation...")
+					return
+				default:
+					if !poll(device.GetInfo) {
+						watchdog.Check()
+						time.Sleep(time.Second * 1)
+						continue
+					}
+					watchdog.Feed()
+					poll(device.GetRated)
+					poll(device.GetManufacturer)
+					poll(device.ExtraGetInfo)
+					poll(device.ExtraGetError)
+					poll(device.ExtraGetTPInfo)
+					poll(device.ExtraGetRated)
+
+					time.Sleep(time.Second * 1)
+				}
+			}
+		}()
+	}
 
 	go func() {
 		<-sigs
 		Logger.Info("Received signal. Stopping...")
-		err := serial.Close()
-		if err != nil {
-			Logger.Fatalf("Serial close faild: %s", err.Error())
+		if serial != nil {
+			err := serial.Close()
+			if err != nil {
+				Logger.Fatalf("Serial close faild: %s", err.Error())
+			}
+		}
+		if replay != nil {
+			replay.Close()
+		}
+		capture.Close()
+		control.Close()
+		alarm.History.Close()
+		if nut != nil {
+			nut.Close()
+		}
+		if metrics != nil {
+			metrics.Close()
+		}
+		if mqtt != nil {
+			mqtt.Close()
 		}
 		snmp.Close()
 		os.Exit(0)
@@ -394,8 +846,8 @@ func runNCM() {
 }
 
 func init() {
-	Logger = newLog("app")
-	SNMPLogger = newLog("snmp")
+	Logger = newLog("logs", "app")
+	SNMPLogger = newLog("logs", "snmp")
 }
 
 var filter = &ContentFilterHook{}
@@ -434,11 +886,12 @@ func (hook *ContentFilterHook) Fire(entry *logrus.Entry) error {
 	return nil
 }
 
-func newLog(name string) *logrus.Logger {
+// 日志写入 dir 下的 <name>Log / <name>Error, 文件在第一次写入时创建
+func newLog(dir string, name string) *logrus.Logger {
 	// 创建一个 writer
 	logWriter, err := rotatelogs.New(
-		filepath.Join("logs", name+"Log_%Y-%m-%d.log"), //日志路径
-		rotatelogs.WithLinkName(filepath.Join("logs", name+"Log.log")),
+		filepath.Join(dir, name+"Log_%Y-%m-%d.log"), //日志路径
+		rotatelogs.WithLinkName(filepath.Join(dir, name+"Log.log")),
 		rotatelogs.WithRotationTime(24*time.Hour), // 每 24 小时轮转一次
 		rotatelogs.WithRotationSize(10*1024*1024), // 当日志文件超过 10MB 时轮转
 		// rotatelogs.WithMaxAge(7*24*time.Hour),     // 保留 7 天
@@ -450,8 +903,8 @@ func newLog(name string) *logrus.Logger {
 
 	// 创建一个 Error 级别的 writer
 	errorWriter, err := rotatelogs.New(
-		filepath.Join("logs", name+"Error_%Y-%m-%d.log"), //日志路径
-		rotatelogs.WithLinkName(filepath.Join("logs", name+"Error.log")),
+		filepath.Join(dir, name+"Error_%Y-%m-%d.log"), //日志路径
+		rotatelogs.WithLinkName(filepath.Join(dir, name+"Error.log")),
 		rotatelogs.WithRotationTime(24*time.Hour), // 每 24 小时轮转一次
 		rotatelogs.WithRotationSize(10*1024*1024), // 当日志文件超过 10MB 时轮转
 		// rotatelogs.WithMaxAge(7*24*time.Hour),     // 保留 7 天
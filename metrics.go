@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Prometheus 文本格式导出
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type MetricsConfig struct {
+	Address string
+	Port    int
+	Path    string
+
+	InformPath  string // INFORM 发送状态, JSON 格式
+	HistoryPath string // 告警历史查询, JSON 格式
+}
+
+type MetricsServer struct {
+	Config *MetricsConfig
+	Snmp   *SNMP
+
+	Server *http.Server
+}
+
+type metricDesc struct {
+	Name  string  // Prometheus 指标名
+	Help  string  // 说明
+	OID   string  // SNMP 服务名
+	Scale float64 // 乘数, 换算成基本单位
+	Table string  // 表行数的服务名, 为空表示标量
+}
+
+var metricDescs = []metricDesc{
+	// upsBattery
+	{Name: "ups_battery_status", Help: "Battery status (1: unknown, 2: normal, 3: low, 4: depleted).", OID: "upsBatteryStatus", Scale: 1},
+	{Name: "ups_battery_on_battery_seconds", Help: "Elapsed time since the UPS switched to battery power.", OID: "upsSecondsOnBattery", Scale: 1},
+	{Name: "ups_battery_runtime_seconds", Help: "Estimated time to battery charge depletion.", OID: "upsEstimatedMinutesRemaining", Scale: 60},
+	{Name: "ups_battery_charge_ratio", Help: "Estimated battery charge remaining.", OID: "upsEstimatedChargeRemaining", Scale: 0.01},
+	{Name: "ups_battery_voltage_volts", Help: "Present battery voltage.", OID: "upsBatteryVoltage", Scale: 0.1},
+	{Name: "ups_battery_current_amperes", Help: "Present battery current.", OID: "upsBatteryCurrent", Scale: 0.1},
+	{Name: "ups_battery_temperature_celsius", Help: "Ambient temperature at or near the UPS battery casing.", OID: "upsBatteryTemperature", Scale: 1},
+
+	// upsInput
+	{Name: "ups_input_line_bads", Help: "Number of input lines out of tolerance.", OID: "upsInputLineBads", Scale: 1},
+	{Name: "ups_input_lines", Help: "Number of input lines utilized in this device.", OID: "upsInputNumLines", Scale: 1},
+	{Name: "ups_input_frequency_hertz", Help: "Present input frequency.", OID: "upsInputFrequency", Scale: 0.1, Table: "upsInputNumLines"},
+	{Name: "ups_input_voltage_volts", Help: "Present input voltage.", OID: "upsInputVoltage", Scale: 1, Table: "upsInputNumLines"},
+	{Name: "ups_input_current_amperes", Help: "Present input current.", OID: "upsInputCurrent", Scale: 0.1, Table: "upsInputNumLines"},
+	{Name: "ups_input_power_watts", Help: "Present input true power.", OID: "upsInputTruePower", Scale: 1, Table: "upsInputNumLines"},
+
+	// upsOutput
+	{Name: "ups_output_source", Help: "Present source of output power (1: other, 2: none, 3: normal, 4: bypass, 5: battery, 6: booster, 7: reducer).", OID: "upsOutputSource", Scale: 1},
+	{Name: "ups_output_frequency_hertz", Help: "Present output frequency.", OID: "upsOutputFrequency", Scale: 0.1},
+	{Name: "ups_output_lines", Help: "Number of output lines utilized in this device.", OID: "upsOutputNumLines", Scale: 1},
+	{Name: "ups_output_voltage_volts", Help: "Present output voltage.", OID: "upsOutputVoltage", Scale: 1, Table: "upsOutputNumLines"},
+	{Name: "ups_output_current_amperes", Help: "Present output current.", OID: "upsOutputCurrent", Scale: 0.1, Table: "upsOutputNumLines"},
+	{Name: "ups_output_power_watts", Help: "Present output true power.", OID: "upsOutputPower", Scale: 1, Table: "upsOutputNumLines"},
+	{Name: "ups_output_load_ratio", Help: "Percentage of the UPS power capacity presently being used.", OID: "upsOutputPercentLoad", Scale: 0.01, Table: "upsOutputNumLines"},
+
+	// upsBypass
+	{Name: "ups_bypass_frequency_hertz", Help: "Present bypass frequency.", OID: "upsBypassFrequency", Scale: 0.1},
+	{Name: "ups_bypass_lines", Help: "Number of bypass lines utilized in this device.", OID: "upsBypassNumLines", Scale: 1},
+	{Name: "ups_bypass_voltage_volts", Help: "Present bypass voltage.", OID: "upsBypassVoltage", Scale: 1, Table: "upsBypassNumLines"},
+	{Name: "ups_bypass_current_amperes", Help: "Present bypass current.", OID: "upsBypassCurrent", Scale: 0.1, Table: "upsBypassNumLines"},
+	{Name: "ups_bypass_power_watts", Help: "Present true power conveyed by the bypass.", OID: "upsBypassPower", Scale: 1, Table: "upsBypassNumLines"},
+
+	// upsAlarm
+	{Name: "ups_alarms_present", Help: "Present number of active alarm conditions.", OID: "upsAlarmsPresent", Scale: 1},
+
+	// upsTest
+	{Name: "ups_test_spin_lock", Help: "Test spin lock (1: available, 2: in use, 3: done).", OID: "upsTestSpinLock", Scale: 1},
+	{Name: "ups_test_results_summary", Help: "Result of the last test (1: pass, 2: warning, 3: error, 4: aborted, 5: in progress, 6: no tests initiated).", OID: "upsTestResultsSummary", Scale: 1},
+	{Name: "ups_test_elapsed_seconds", Help: "Elapsed time of the last test.", OID: "upsTestElapsedTime", Scale: 0.01}, // TimeTicks
+
+	// upsControl
+	{Name: "ups_shutdown_type", Help: "Shutdown type (1: output, 2: system).", OID: "upsShutdownType", Scale: 1},
+	{Name: "ups_shutdown_after_delay_seconds", Help: "Seconds until shutdown, -1 if no countdown is in effect.", OID: "upsShutdownAfterDelay", Scale: 1},
+	{Name: "ups_startup_after_delay_seconds", Help: "Seconds until startup, -1 if no countdown is in effect.", OID: "upsStartupAfterDelay", Scale: 1},
+	{Name: "ups_reboot_with_duration_seconds", Help: "Seconds remaining in the reboot countdown, -1 if none.", OID: "upsRebootWithDuration", Scale: 1},
+	{Name: "ups_auto_restart", Help: "Auto restart after shutdown (1: on, 2: off).", OID: "upsAutoRestart", Scale: 1},
+
+	// upsConfig
+	{Name: "ups_config_input_voltage_volts", Help: "Nominal input voltage.", OID: "upsConfigInputVoltage", Scale: 1},
+	{Name: "ups_config_input_frequency_hertz", Help: "Nominal input frequency.", OID: "upsConfigInputFreq", Scale: 1},
+	{Name: "ups_config_output_voltage_volts", Help: "Nominal output voltage.", OID: "upsConfigOutputVoltage", Scale: 1},
+	{Name: "ups_config_output_frequency_hertz", Help: "Nominal output frequency.", OID: "upsConfigOutputFreq", Scale: 1},
+	{Name: "ups_config_output_volt_amperes", Help: "Magnitude of the nominal output volt-amp rating.", OID: "upsConfigOutputVA", Scale: 1},
+	{Name: "ups_config_output_power_watts", Help: "Magnitude of the nominal true power rating.", OID: "upsConfigOutputPower", Scale: 1},
+	{Name: "ups_config_low_battery_time_seconds", Help: "Remaining runtime at which a low battery condition is declared.", OID: "upsConfigLowBattTime", Scale: 60},
+	{Name: "ups_config_audible_status", Help: "Audible alarm status (1: disabled, 2: enabled, 3: muted).", OID: "upsConfigAudibleStatus", Scale: 1},
+	{Name: "ups_config_low_voltage_transfer_volts", Help: "Minimum input line voltage allowed before the UPS switches to battery.", OID: "upsConfigLowVoltageTransferPoint", Scale: 1},
+	{Name: "ups_config_high_voltage_transfer_volts", Help: "Maximum line voltage allowed before the UPS switches to battery.", OID: "upsConfigHighVoltageTransferPoint", Scale: 1},
+}
+
+// 把 SNMP 返回值换算成 float64, 不支持的类型返回 false。
+func metricValue(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
+
+func metricLabelEscape(value string) string {
+	value = strings.ReplaceAll(value, "\\", `\\`)
+	value = strings.ReplaceAll(value, "\n", `\n`)
+	value = strings.ReplaceAll(value, "\"", `\"`)
+	return value
+}
+
+func metricsServer(config MetricsConfig, snmp *SNMP) *MetricsServer {
+	if config.Path == "" {
+		config.Path = "/metrics"
+	}
+	if config.InformPath == "" {
+		config.InformPath = "/inform"
+	}
+	if config.HistoryPath == "" {
+		config.HistoryPath = "/alarms/history"
+	}
+
+	m := &MetricsServer{
+		Config: &config,
+		Snmp:   snmp,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(config.Path, m.handle)
+	mux.HandleFunc(config.InformPath, m.handleInform)
+	mux.HandleFunc(config.HistoryPath, m.handleHistory)
+
+	m.Server = &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", config.Address, config.Port),
+		Handler: mux,
+	}
+	return m
+}
+
+// 启动 HTTP 服务器。
+func (m *MetricsServer) Run() {
+	Logger.Infof("Metrics server is running on http://%s%s", m.Server.Addr, m.Config.Path)
+	err := m.Server.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		Logger.Errorf("Metrics server faild: %s", err.Error())
+	}
+}
+
+// 关闭 HTTP 服务器。
+func (m *MetricsServer) Close() error {
+	return m.Server.Close()
+}
+
+func (m *MetricsServer) handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, err := w.Write([]byte(m.Collect()))
+	if err != nil {
+		Logger.Errorf("Metrics write faild: %s", err.Error())
+	}
+}
+
+// INFORM 各接收方的送达统计和未确认的通知, 队列有自己的锁, 不需要 Snmp.Lock
+func (m *MetricsServer) handleInform(w http.ResponseWriter, r *http.Request) {
+	status := InformStatus{Targets: []InformTargetStatus{}, Pending: []InformEntry{}}
+	if m.Snmp.InformQueue != nil {
+		status = m.Snmp.InformQueue.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(status)
+	if err != nil {
+		Logger.Errorf("Inform status write faild: %s", err.Error())
+	}
+}
+
+// 告警历史查询, 参数 from / to / type 与 history 子命令相同
+func (m *MetricsServer) handleHistory(w http.ResponseWriter, r *http.Request) {
+	history := alarm.History
+	if history == nil {
+		http.Error(w, "alarm history disabled", http.StatusNotFound)
+		return
+	}
+
+	query := r.URL.Query()
+	now := time.Now()
+	filter := AlarmHistoryFilter{Type: query.Get("type")}
+	var err error
+	filter.From, err = ParseAlarmHistoryTime(query.Get("from"), now)
+	if err == nil {
+		filter.To, err = ParseAlarmHistoryTime(query.Get("to"), now)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	entries, err := history.Query(filter)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(entries)
+	if err != nil {
+		Logger.Errorf("Alarm history write faild: %s", err.Error())
+	}
+}
+
+// 生成全部指标文本, 一次采集在锁内完成, 各指标来自同一时刻。
+func (m *MetricsServer) Collect() string {
+	m.Snmp.Lock.Lock()
+	defer m.Snmp.Lock.Unlock()
+
+	var b strings.Builder
+
+	m.writeInfo(&b)
+
+	for _, desc := range metricDescs {
+		var lines []string
+		if desc.Table == "" {
+			if value, ok := m.value(desc.OID, 0); ok {
+				lines = append(lines, fmt.Sprintf("%s %s", desc.Name, m.format(value*desc.Scale)))
+			}
+		} else {
+			rows, ok := m.value(desc.Table, 0)
+			if !ok {
+				continue
+			}
+			for i := 1; i <= int(rows); i++ {
+				if value, ok := m.value(desc.OID, i); ok {
+					lines = append(lines, fmt.Sprintf("%s{line=\"%d\"} %s", desc.Name, i, m.format(value*desc.Scale)))
+				}
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "# HELP %s %s\n", desc.Name, desc.Help)
+		fmt.Fprintf(&b, "# TYPE %s gauge\n", desc.Name)
+		for _, line := range lines {
+			b.WriteString(line)
+			b.WriteString("\n")
+		}
+	}
+
+	m.writeAlarms(&b)
+
+	return b.String()
+}
+
+func (m *MetricsServer) value(name string, index int) (float64, bool) {
+	value, err := m.Snmp.GetValue(name, index)
+	if err != nil || value == nil {
+		return 0, false
+	}
+	return metricValue(value)
+}
+
+// 按 Scale 换算后去掉浮点误差
+func (m *MetricsServer) format(value float64) string {
+	return strconv.FormatFloat(math.Round(value*1e6)/1e6, 'g', -1, 64)
+}
+
+func (m *MetricsServer) writeInfo(b *strings.Builder) {
+	labels := []struct {
+		Name string
+		OID  string
+	}{
+		{"manufacturer", "upsIdentManufacturer"},
+		{"model", "upsIdentModel"},
+		{"software_version", "upsIdentUPSSoftwareVersion"},
+		{"agent_version", "upsIdentAgentSoftwareVersion"},
+		{"name", "upsIdentName"},
+	}
+
+	var pairs []string
+	for _, label := range labels {
+		value, err := m.Snmp.GetValue(label.OID, 0)
+		if err != nil || value == nil {
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", label.Name, metricLabelEscape(fmt.Sprintf("%v", value))))
+	}
+
+	fmt.Fprintf(b, "# HELP ups_info UPS identification.\n")
+	fmt.Fprintf(b, "# TYPE ups_info gauge\n")
+	fmt.Fprintf(b, "ups_info{%s} 1\n", strings.Join(pairs, ","))
+}
+
+func (m *MetricsServer) writeAlarms(b *strings.Builder) {
+	names := map[string]string{}
+	for _, entry := range alarm.Alarms {
+		names[entry.Descr] = m.Snmp.GetName(entry.Descr)
+	}
+	if len(names) == 0 {
+		return
+	}
+
+	oids := make([]string, 0, len(names))
+	for oid := range names {
+		oids = append(oids, oid)
+	}
+	sort.Strings(oids)
+
+	fmt.Fprintf(b, "# HELP ups_alarm Active alarm conditions from upsAlarmTable.\n")
+	fmt.Fprintf(b, "# TYPE ups_alarm gauge\n")
+	for _, oid := range oids {
+		fmt.Fprintf(b, "ups_alarm{oid=\"%s\",name=\"%s\"} 1\n", metricLabelEscape(oid), metricLabelEscape(names[oid]))
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsCollect(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+
+	// 完成一次快速测试, upsTestElapsedTime 为 TimeTicks
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+	snmp.Lock.Lock()
+	err := startTest(snmp, "upsTestQuickBatteryTest")
+	snmp.Lock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 26.1 25.0 00001100")
+	time.Sleep(200 * time.Millisecond)
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+	snmp.Lock.Lock()
+	summary, elapsed := data.Test.ResultsSummary, data.Test.ElapsedTime
+	snmp.Lock.Unlock()
+	if summary != 1 || elapsed < 20 {
+		t.Fatalf("test summary %d, elapsed %d", summary, elapsed)
+	}
+
+	serialReceived(snmp, "Q1", "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000")
+
+	m := metricsServer(MetricsConfig{}, snmp)
+	text := m.Collect()
+	lines := map[string]bool{}
+	for _, line := range strings.Split(text, "\n") {
+		lines[line] = true
+	}
+	for _, want := range []string{
+		"# HELP ups_output_source Present source of output power (1: other, 2: none, 3: normal, 4: bypass, 5: battery, 6: booster, 7: reducer).",
+		"# TYPE ups_output_source gauge",
+		"ups_output_source 5",
+		`ups_input_voltage_volts{line="1"} 0`,
+		`ups_output_voltage_volts{line="1"} 228`,
+		`ups_output_load_ratio{line="1"} 0.17`,
+		"ups_battery_temperature_celsius 25",
+		"ups_test_elapsed_seconds " + m.format(float64(elapsed)/100), // TimeTicks -> 秒
+		"ups_shutdown_after_delay_seconds -1",
+		`ups_alarm{oid="` + snmp.GetOID("upsAlarmOnBattery", -1) + `",name="upsAlarmOnBattery"} 1`,
+	} {
+		if !lines[want] {
+			t.Errorf("missing %q in\n%s", want, text)
+		}
+	}
+	if !strings.HasPrefix(text, "# HELP ups_info UPS identification.\n# TYPE ups_info gauge\nups_info{manufacturer=\"") {
+		t.Errorf("ups_info:\n%s", text)
+	}
+}
+
+func TestMetricLabelEscape(t *testing.T) {
+	if got := metricLabelEscape("a\\b\n\"c\""); got != `a\\b\n\"c\"` {
+		t.Errorf("metricLabelEscape %s", got)
+	}
+}
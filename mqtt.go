@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MQTT 发布。
+// <topic>/<key> 为各读数的保留消息, <topic>/state 为全部读数的 JSON,
+// <topic>/event 为告警和测试事件, <topic>/command 接收命令。
+// 开启 Discovery 时按 Home Assistant 的格式发布设备和传感器配置。
+
+type MQTTConfig struct {
+	Broker   string // tcp://host:1883
+	ClientID string
+	Username string
+	Password string
+
+	Topic    string        // 主题前缀
+	Interval time.Duration // 读数发布间隔
+
+	Discovery       bool
+	DiscoveryPrefix string
+
+	AllowShutdown bool // 是否接受 shutdown 命令, 默认关闭
+	ShutdownDelay int  // shutdown 命令未指定 delay 时的关机延时, 秒
+}
+
+type MQTTServer struct {
+	Config *MQTTConfig
+	Snmp   *SNMP
+
+	Client mqtt.Client
+
+	stop chan struct{}
+}
+
+type mqttSensor struct {
+	Key   string // 主题名和 state 中的字段名
+	Name  string // Home Assistant 中的名称
+	OID   string
+	Index int
+	Scale float64 // 乘数, 换算成 Unit
+
+	Unit        string
+	DeviceClass string
+}
+
+var mqttSensors = []mqttSensor{
+	{Key: "battery_charge", Name: "Battery charge", OID: "upsEstimatedChargeRemaining", Scale: 1, Unit: "%", DeviceClass: "battery"},
+	{Key: "battery_runtime", Name: "Battery runtime", OID: "upsEstimatedMinutesRemaining", Scale: 1, Unit: "min", DeviceClass: "duration"},
+	{Key: "battery_voltage", Name: "Battery voltage", OID: "upsBatteryVoltage", Scale: 0.1, Unit: "V", DeviceClass: "voltage"},
+	{Key: "battery_current", Name: "Battery current", OID: "upsBatteryCurrent", Scale: 0.1, Unit: "A", DeviceClass: "current"},
+	{Key: "battery_temperature", Name: "Battery temperature", OID: "upsBatteryTemperature", Scale: 1, Unit: "°C", DeviceClass: "temperature"},
+	{Key: "seconds_on_battery", Name: "Time on battery", OID: "upsSecondsOnBattery", Scale: 1, Unit: "s", DeviceClass: "duration"},
+	{Key: "input_voltage", Name: "Input voltage", OID: "upsInputVoltage", Index: 1, Scale: 1, Unit: "V", DeviceClass: "voltage"},
+	{Key: "input_frequency", Name: "Input frequency", OID: "upsInputFrequency", Index: 1, Scale: 0.1, Unit: "Hz", DeviceClass: "frequency"},
+	{Key: "output_voltage", Name: "Output voltage", OID: "upsOutputVoltage", Index: 1, Scale: 1, Unit: "V", DeviceClass: "voltage"},
+	{Key: "output_current", Name: "Output current", OID: "upsOutputCurrent", Index: 1, Scale: 0.1, Unit: "A", DeviceClass: "current"},
+	{Key: "output_power", Name: "Output power", OID: "upsOutputPower", Index: 1, Scale: 1, Unit: "W", DeviceClass: "power"},
+	{Key: "output_load", Name: "Output load", OID: "upsOutputPercentLoad", Index: 1, Scale: 1, Unit: "%"},
+	{Key: "output_frequency", Name: "Output frequency", OID: "upsOutputFrequency", Scale: 0.1, Unit: "Hz", DeviceClass: "frequency"},
+}
+
+// upsOutputSource -> status
+var mqttOutputSources = map[int]string{
+	2: "off",
+	3: "online",
+	4: "bypass",
+	5: "on_battery",
+	6: "boost",
+	7: "trim",
+}
+
+// command 主题接受的命令, 值为 JSON {"command": "...", "delay": 秒} 或只有命令名
+type mqttCommand struct {
+	Command string `json:"command"`
+	Delay   *int   `json:"delay,omitempty"`
+}
+
+var mqttCommands = map[string]func(m *MQTTServer, cmd mqttCommand) error{
+	"beeper.toggle": func(m *MQTTServer, cmd mqttCommand) error {
+		return m.deviceCommand(m.Snmp.Device.SwitchBuzz)
+	},
+	"beeper.enable": func(m *MQTTServer, cmd mqttCommand) error {
+		return m.beeper(true)
+	},
+	"beeper.disable": func(m *MQTTServer, cmd mqttCommand) error {
+		return m.beeper(false)
+	},
+	"test.battery.start": func(m *MQTTServer, cmd mqttCommand) error {
+		return startTest(m.Snmp, "upsTestQuickBatteryTest")
+	},
+	"test.battery.start.deep": func(m *MQTTServer, cmd mqttCommand) error {
+		return startTest(m.Snmp, "upsTestDeepBatteryCalibration")
+	},
+	"test.battery.stop": func(m *MQTTServer, cmd mqttCommand) error {
+		return startTest(m.Snmp, "upsTestAbortTestInProgress")
+	},
+	"shutdown": func(m *MQTTServer, cmd mqttCommand) error {
+		if !m.Config.AllowShutdown {
+			return fmt.Errorf("shutdown is disabled, set mqtt.allow-shutdown to enable it")
+		}
+		delay := m.Config.ShutdownDelay
+		if cmd.Delay != nil {
+			delay = *cmd.Delay
+		}
+		if delay < 0 {
+			return fmt.Errorf("invalid delay %d", delay)
+		}
+		return m.Snmp.SetValue("upsShutdownAfterDelay", 0, delay)
+	},
+	"shutdown.stop": func(m *MQTTServer, cmd mqttCommand) error {
+		return m.Snmp.SetValue("upsShutdownAfterDelay", 0, -1)
+	},
+}
+
+func mqttServer(config MQTTConfig, snmp *SNMP) *MQTTServer {
+	if config.Topic == "" {
+		config.Topic = "santak-ups"
+	}
+	config.Topic = strings.TrimSuffix(config.Topic, "/")
+	if config.ClientID == "" {
+		config.ClientID = config.Topic
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10 * time.Second
+	}
+	if config.DiscoveryPrefix == "" {
+		config.DiscoveryPrefix = "homeassistant"
+	}
+	if config.ShutdownDelay <= 0 {
+		config.ShutdownDelay = 60
+	}
+
+	m := &MQTTServer{
+		Config: &config,
+		Snmp:   snmp,
+		stop:   make(chan struct{}),
+	}
+
+	options := mqtt.NewClientOptions().
+		AddBroker(config.Broker).
+		SetClientID(config.ClientID).
+		SetUsername(config.Username).
+		SetPassword(config.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetConnectRetryInterval(10*time.Second).
+		SetWill(m.topic("availability"), "offline", 1, true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(client mqtt.Client, err error) {
+			Logger.Warnf("MQTT connection lost: %s", err.Error())
+		})
+	m.Client = mqtt.NewClient(options)
+	return m
+}
+
+func (m *MQTTServer) topic(name string) string {
+	return m.Config.Topic + "/" + name
+}
+
+// Home Assistant 的 node_id 和 unique_id 只能包含字母、数字、下划线和横线
+func (m *MQTTServer) nodeID() string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, m.Config.Topic)
+}
+
+// 连接 MQTT 服务器并定时发布读数。
+func (m *MQTTServer) Run() {
+	Logger.Infof("MQTT publisher is connecting to %s", m.Config.Broker)
+	m.Client.Connect()
+
+	ticker := time.NewTicker(m.Config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.stop:
+			return
+		case <-ticker.C:
+			m.Publish()
+		}
+	}
+}
+
+// 发布离线状态并断开连接。
+func (m *MQTTServer) Close() error {
+	select {
+	case <-m.stop:
+		return nil
+	default:
+		close(m.stop)
+	}
+	if m.Client.IsConnectionOpen() {
+		m.Client.Publish(m.topic("availability"), 1, true, "offline").WaitTimeout(time.Second)
+	}
+	m.Client.Disconnect(250)
+	return nil
+}
+
+// 每次连接 (包括重连) 后重新订阅命令并发布配置和读数
+func (m *MQTTServer) onConnect(client mqtt.Client) {
+	Logger.Infof("MQTT connected to %s", m.Config.Broker)
+	client.Subscribe(m.topic("command"), 1, m.onCommand)
+	if m.Config.Discovery {
+		m.publishDiscovery()
+	}
+	client.Publish(m.topic("availability"), 1, true, "online")
+	m.Publish()
+}
+
+func (m *MQTTServer) onCommand(client mqtt.Client, message mqtt.Message) {
+	payload := strings.TrimSpace(string(message.Payload()))
+	var cmd mqttCommand
+	if strings.HasPrefix(payload, "{") {
+		if err := json.Unmarshal([]byte(payload), &cmd); err != nil {
+			Logger.Errorf("MQTT command '%s' faild: %s", payload, err.Error())
+			return
+		}
+	} else {
+		cmd.Command = payload
+	}
+	run, ok := mqttCommands[cmd.Command]
+	if !ok {
+		Logger.Errorf("MQTT command '%s' not supported", cmd.Command)
+		return
+	}
+
+	m.Snmp.Lock.Lock()
+	err := run(m, cmd)
+	m.Snmp.Lock.Unlock()
+	if err != nil {
+		Logger.Errorf("MQTT command %s faild: %s", cmd.Command, err.Error())
+		return
+	}
+	Logger.Infof("MQTT command %s", cmd.Command)
+	m.Publish()
+}
+
+// 发送设备命令, 命令为空表示设备不支持
+func (m *MQTTServer) deviceCommand(cmd string) error {
+	if cmd == "" {
+		return fmt.Errorf("not supported by %s", m.Snmp.Device.Profile.Name)
+	}
+	m.Snmp.TtySend(cmd)
+	return nil
+}
+
+// 协议只有翻转命令, 状态不同时才发送
+func (m *MQTTServer) beeper(enable bool) error {
+	if (m.Snmp.Data.Config.AudibleStatus == 2) == enable {
+		return nil
+	}
+	return m.deviceCommand(m.Snmp.Device.SwitchBuzz)
+}
+
+// 读取当前状态, 值为数字或字符串
+func (m *MQTTServer) State() map[string]any {
+	m.Snmp.Lock.Lock()
+	defer m.Snmp.Lock.Unlock()
+
+	state := map[string]any{}
+	for _, sensor := range mqttSensors {
+		value, err := m.Snmp.GetValue(sensor.OID, sensor.Index)
+		if err != nil || value == nil {
+			continue
+		}
+		if v, ok := metricValue(value); ok {
+			// 去掉换算后的浮点误差
+			state[sensor.Key] = math.Round(v*sensor.Scale*1e6) / 1e6
+		}
+	}
+
+	status := "unknown"
+	if value, err := m.Snmp.GetValue("upsOutputSource", 0); err == nil {
+		if v, ok := metricValue(value); ok && mqttOutputSources[int(v)] != "" {
+			status = mqttOutputSources[int(v)]
+		}
+	}
+	state["status"] = status
+
+	state["beeper"] = "OFF"
+	if m.Snmp.Data.Config.AudibleStatus == 2 {
+		state["beeper"] = "ON"
+	}
+	state["test_result"] = m.Snmp.Data.Test.ResultsDetail
+
+	alarms := []string{}
+	for _, entry := range alarm.Alarms {
+		alarms = append(alarms, m.Snmp.GetName(entry.Descr))
+	}
+	state["alarms"] = alarms
+	state["alarm_count"] = len(alarms)
+	return state
+}
+
+// 发布各读数的保留消息和 state
+func (m *MQTTServer) Publish() {
+	if !m.Client.IsConnectionOpen() {
+		return
+	}
+	state := m.State()
+	for key, value := range state {
+		if key == "alarms" {
+			continue
+		}
+		m.Client.Publish(m.topic(key), 0, true, fmt.Sprint(value))
+	}
+	dataBytes, err := json.Marshal(state)
+	if err != nil {
+		Logger.Errorf("MQTT publish state faild: %s", err.Error())
+		return
+	}
+	m.Client.Publish(m.topic("state"), 0, true, dataBytes)
+}
+
+// 发布告警或测试事件, 作为 Notifier 的订阅者调用
+func (m *MQTTServer) PublishEvent(event WebhookEvent) {
+	if !m.Client.IsConnectionOpen() {
+		return
+	}
+	dataBytes, err := json.Marshal(event)
+	if err != nil {
+		Logger.Errorf("MQTT publish event faild: %s", err.Error())
+		return
+	}
+	m.Client.Publish(m.topic("event"), 1, false, dataBytes)
+}
+
+// Home Assistant MQTT discovery
+// https://www.home-assistant.io/integrations/mqtt/#mqtt-discovery
+func (m *MQTTServer) publishDiscovery() {
+	m.Snmp.Lock.Lock()
+	ident := m.Snmp.Data.Ident
+	device := map[string]any{
+		"identifiers":  []string{m.nodeID()},
+		"name":         m.Config.Topic,
+		"manufacturer": ident.Manufacturer,
+		"model":        ident.Model,
+		"sw_version":   ident.SoftwareVersion,
+	}
+	m.Snmp.Lock.Unlock()
+
+	node := m.nodeID()
+	publish := func(component string, key string, config map[string]any) {
+		config["unique_id"] = node + "_" + key
+		config["availability_topic"] = m.topic("availability")
+		config["device"] = device
+		dataBytes, err := json.Marshal(config)
+		if err != nil {
+			Logger.Errorf("MQTT discovery %s faild: %s", key, err.Error())
+			return
+		}
+		m.Client.Publish(fmt.Sprintf("%s/%s/%s/%s/config", m.Config.DiscoveryPrefix, component, node, key), 1, true, dataBytes)
+	}
+
+	for _, sensor := range mqttSensors {
+		config := map[string]any{
+			"name":                sensor.Name,
+			"state_topic":         m.topic(sensor.Key),
+			"unit_of_measurement": sensor.Unit,
+			"state_class":         "measurement",
+		}
+		if sensor.DeviceClass != "" {
+			config["device_class"] = sensor.DeviceClass
+		}
+		publish("sensor", sensor.Key, config)
+	}
+	publish("sensor", "status", map[string]any{
+		"name":        "Status",
+		"state_topic": m.topic("status"),
+	})
+	publish("sensor", "alarm_count", map[string]any{
+		"name":        "Alarms",
+		"state_topic": m.topic("alarm_count"),
+	})
+	publish("sensor", "test_result", map[string]any{
+		"name":        "Test result",
+		"state_topic": m.topic("test_result"),
+	})
+	publish("binary_sensor", "on_battery", map[string]any{
+		"name":           "On battery",
+		"state_topic":    m.topic("status"),
+		"value_template": "{{ 'ON' if value == 'on_battery' else 'OFF' }}",
+	})
+	publish("switch", "beeper", map[string]any{
+		"name":          "Beeper",
+		"state_topic":   m.topic("beeper"),
+		"command_topic": m.topic("command"),
+		"payload_on":    "beeper.enable",
+		"payload_off":   "beeper.disable",
+		"state_on":      "ON",
+		"state_off":     "OFF",
+	})
+	publish("button", "battery_test", map[string]any{
+		"name":          "Battery test",
+		"command_topic": m.topic("command"),
+		"payload_press": "test.battery.start",
+	})
+}
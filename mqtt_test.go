@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+)
+
+// 内嵌的 MQTT 服务器, 返回地址
+func newTestBroker(t *testing.T) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	server := mochi.New(&mochi.Options{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))})
+	if err := server.AddHook(new(auth.AllowHook), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "test", Address: address})); err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+	t.Cleanup(func() { server.Close() })
+	return "tcp://" + address
+}
+
+type testMQTTMessages struct {
+	lock     sync.Mutex
+	messages map[string][]string
+}
+
+// 订阅所有主题, 按主题记录收到的消息
+func newTestMQTTSubscriber(t *testing.T, broker string) (mqtt.Client, *testMQTTMessages) {
+	t.Helper()
+
+	received := &testMQTTMessages{messages: map[string][]string{}}
+	client := mqtt.NewClient(mqtt.NewClientOptions().AddBroker(broker).SetClientID("test-subscriber"))
+	if token := client.Connect(); !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("connect: %v", token.Error())
+	}
+	t.Cleanup(func() { client.Disconnect(100) })
+	token := client.Subscribe("#", 1, func(client mqtt.Client, message mqtt.Message) {
+		received.lock.Lock()
+		defer received.lock.Unlock()
+		received.messages[message.Topic()] = append(received.messages[message.Topic()], string(message.Payload()))
+	})
+	if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+		t.Fatalf("subscribe: %v", token.Error())
+	}
+	return client, received
+}
+
+// 等待主题收到满足条件的消息
+func (r *testMQTTMessages) wait(t *testing.T, topic string, match func(payload string) bool) string {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		r.lock.Lock()
+		messages := r.messages[topic]
+		r.lock.Unlock()
+		for _, payload := range messages {
+			if match == nil || match(payload) {
+				return payload
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s not received", topic)
+	return ""
+}
+
+func TestMQTT(t *testing.T) {
+	broker := newTestBroker(t)
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	var lock sync.Mutex
+	var sent []string
+	snmp.SetSerialSend(func(cmd string) {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, cmd)
+	})
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+
+	client, received := newTestMQTTSubscriber(t, broker)
+
+	m := mqttServer(MQTTConfig{Broker: broker, Topic: "ups", Interval: time.Hour, Discovery: true, AllowShutdown: true}, snmp)
+	notifier, _ := NewNotifier(nil)
+	notifier.AddHandler(m.PublishEvent)
+	snmp.Lock.Lock()
+	snmp.Notifier = notifier
+	snmp.Lock.Unlock()
+	go m.Run()
+	t.Cleanup(func() { m.Close() })
+
+	// 保留的读数、state 和 Home Assistant 配置
+	received.wait(t, "ups/availability", func(payload string) bool { return payload == "online" })
+	received.wait(t, "ups/status", func(payload string) bool { return payload == "online" })
+	received.wait(t, "ups/input_voltage", func(payload string) bool { return payload == "228" })
+	state := map[string]any{}
+	if err := json.Unmarshal([]byte(received.wait(t, "ups/state", nil)), &state); err != nil {
+		t.Fatal(err)
+	}
+	if state["output_voltage"] != 228.0 || state["alarm_count"] != 0.0 || state["battery_temperature"] != 25.0 {
+		t.Errorf("state %v", state)
+	}
+	config := map[string]any{}
+	if err := json.Unmarshal([]byte(received.wait(t, "homeassistant/sensor/ups/battery_charge/config", nil)), &config); err != nil {
+		t.Fatal(err)
+	}
+	if config["state_topic"] != "ups/battery_charge" || config["unit_of_measurement"] != "%" || config["unique_id"] != "ups_battery_charge" {
+		t.Errorf("discovery %v", config)
+	}
+	received.wait(t, "homeassistant/switch/ups/beeper/config", nil)
+
+	// 告警事件
+	serialReceived(snmp, "Q1", "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000")
+	received.wait(t, "ups/event", func(payload string) bool {
+		var event WebhookEvent
+		return json.Unmarshal([]byte(payload), &event) == nil &&
+			event.Event == WebhookAlarmRaised && event.AlarmName == "upsAlarmOnBattery"
+	})
+
+	// 命令
+	command := func(payload string) {
+		t.Helper()
+		token := client.Publish("ups/command", 1, false, payload)
+		if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+			t.Fatalf("publish: %v", token.Error())
+		}
+	}
+	command("beeper.toggle")
+	command("test.battery.start")
+	command(`{"command": "shutdown", "delay": 300}`)
+	time.Sleep(200 * time.Millisecond)
+
+	lock.Lock()
+	want := fmt.Sprint([]string{snmp.Device.SwitchBuzz, snmp.Device.Test})
+	got := fmt.Sprint(sent)
+	lock.Unlock()
+	if got != want {
+		t.Errorf("sent %s, want %s", got, want)
+	}
+	snmp.Lock.Lock()
+	defer snmp.Lock.Unlock()
+	if data.Test.ResultsSummary != 5 || snmp.GetName(data.Test.Id) != "upsTestQuickBatteryTest" {
+		t.Errorf("test %d %s", data.Test.ResultsSummary, snmp.GetName(data.Test.Id))
+	}
+	if control.ShutdownAt.IsZero() || time.Until(control.ShutdownAt) < 290*time.Second {
+		t.Errorf("shutdown at %s", control.ShutdownAt)
+	}
+
+	// 默认不接受 shutdown
+	if err := mqttCommands["shutdown.stop"](m, mqttCommand{}); err != nil {
+		t.Fatal(err)
+	}
+	disabled := mqttServer(MQTTConfig{Broker: broker}, snmp)
+	if err := mqttCommands["shutdown"](disabled, mqttCommand{}); err == nil {
+		t.Error("shutdown accepted without allow-shutdown")
+	}
+	if !control.ShutdownAt.IsZero() {
+		t.Errorf("shutdown at %s", control.ShutdownAt)
+	}
+}
+
+// 测试结束后 upsTestSpinLock 为 3, 再次发送 test.battery.start 仍能开始测试
+func TestMQTTTestTwice(t *testing.T) {
+	broker := newTestBroker(t)
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	sent := recordSerialSend(snmp)
+
+	const (
+		idle   = "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000"
+		inTest = "(228.0 228.0 228.4 017 50.0 26.1 25.0 00001100"
+	)
+	serialReceived(snmp, "Q1", idle)
+
+	client, received := newTestMQTTSubscriber(t, broker)
+	m := mqttServer(MQTTConfig{Broker: broker, Topic: "ups", Interval: time.Hour}, snmp)
+	go m.Run()
+	t.Cleanup(func() { m.Close() })
+	received.wait(t, "ups/availability", func(payload string) bool { return payload == "online" })
+
+	spinLock := func() int {
+		snmp.Lock.Lock()
+		defer snmp.Lock.Unlock()
+		return snmp.Data.Test.SpinLock
+	}
+	for i := 0; i < 2; i++ {
+		token := client.Publish("ups/command", 1, false, "test.battery.start")
+		if !token.WaitTimeout(2*time.Second) || token.Error() != nil {
+			t.Fatalf("publish: %v", token.Error())
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for spinLock() != 2 {
+			if time.Now().After(deadline) {
+				t.Fatalf("test %d not started, spin lock %d", i+1, spinLock())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		serialReceived(snmp, "Q1", inTest)
+		serialReceived(snmp, "Q1", idle)
+		if lock := spinLock(); lock != 3 {
+			t.Fatalf("test %d not completed, spin lock %d", i+1, lock)
+		}
+	}
+	if got := fmt.Sprint(sent()); got != "[T T]" {
+		t.Errorf("sent %s, want [T T]", got)
+	}
+}
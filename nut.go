@@ -0,0 +1,938 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NUT (Network UPS Tools) upsd 网络协议
+// https://networkupstools.org/docs/developer-guide.chunked/net-protocol.html
+
+// 客户端不读取应答时, 写入超时后断开连接
+const nutWriteTimeout = 10 * time.Second
+
+type NUTUser struct {
+	Username string
+	Password string
+
+	Actions  []string // SET, FSD
+	InstCmds []string // all 表示全部
+	Upsmon   string   // primary / secondary
+}
+
+type NUTConfig struct {
+	Address string
+	Port    int
+
+	Name string // UPS 名称
+
+	Users []NUTUser
+}
+
+type NUT struct {
+	Config *NUTConfig
+	Snmp   *SNMP
+
+	Listener net.Listener
+
+	Lock          sync.Mutex
+	Logins        int
+	FSD           bool
+	ShutdownDelay int // ups.delay.shutdown, 秒
+}
+
+type nutClient struct {
+	Conn     net.Conn
+	Username string
+	Password string
+	LoggedIn bool
+	Primary  bool
+
+	replies []string // handle 在 Snmp.Lock 中只缓存应答, 解锁后由 flush 发送
+}
+
+type nutVar struct {
+	Name     string
+	Get      func(n *NUT) (string, bool)
+	Set      func(n *NUT, value string) error
+	Type     string // RW 变量的类型, NUT GET TYPE 使用
+	Describe string
+}
+
+// 从 SNMP 服务读取数值, 按 scale 换算单位。
+func nutNumber(name string, index int, scale float64, format string) func(n *NUT) (string, bool) {
+	return func(n *NUT) (string, bool) {
+		value, err := n.Snmp.GetValue(name, index)
+		if err != nil || value == nil {
+			return "", false
+		}
+		v, ok := value.(int)
+		if !ok {
+			return "", false
+		}
+		return fmt.Sprintf(format, float64(v)/scale), true
+	}
+}
+
+func nutString(name string) func(n *NUT) (string, bool) {
+	return func(n *NUT) (string, bool) {
+		value, err := n.Snmp.GetValue(name, 0)
+		if err != nil || value == nil {
+			return "", false
+		}
+		s, ok := value.(string)
+		if !ok || s == "" {
+			return "", false
+		}
+		return s, true
+	}
+}
+
+func nutConst(value string) func(n *NUT) (string, bool) {
+	return func(n *NUT) (string, bool) {
+		return value, true
+	}
+}
+
+func nutSetInt(name string, scale int) func(n *NUT, value string) error {
+	return func(n *NUT, value string) error {
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		return n.Snmp.SetValue(name, 0, v/scale)
+	}
+}
+
+var nutVars = []nutVar{
+	{Name: "device.type", Get: nutConst("ups")},
+	{Name: "device.mfr", Get: nutString("upsIdentManufacturer")},
+	{Name: "device.model", Get: nutString("upsIdentModel")},
+	{Name: "driver.name", Get: nutConst("santak-ups-snmp-server")},
+
+	{Name: "ups.mfr", Get: nutString("upsIdentManufacturer")},
+	{Name: "ups.model", Get: nutString("upsIdentModel")},
+	{Name: "ups.firmware", Get: nutString("upsIdentUPSSoftwareVersion")},
+	{Name: "ups.firmware.aux", Get: nutString("upsIdentAgentSoftwareVersion")},
+	{
+		Name: "ups.id",
+		Get:  nutString("upsIdentName"),
+		Set: func(n *NUT, value string) error {
+			return n.Snmp.SetValue("upsIdentName", 0, value)
+		},
+		Type:     "STRING:63",
+		Describe: "UPS system identifier",
+	},
+	{Name: "ups.status", Get: (*NUT).status},
+	{Name: "ups.load", Get: nutNumber("upsOutputPercentLoad", 1, 1, "%.0f")},
+	{Name: "ups.realpower", Get: nutNumber("upsOutputPower", 1, 1, "%.0f")},
+	{Name: "ups.power.nominal", Get: nutNumber("upsConfigOutputVA", 0, 1, "%.0f")},
+	{Name: "ups.realpower.nominal", Get: nutNumber("upsConfigOutputPower", 0, 1, "%.0f")},
+	{Name: "ups.temperature", Get: nutNumber("upsBatteryTemperature", 0, 1, "%.0f")},
+	{Name: "ups.beeper.status", Get: (*NUT).beeperStatus},
+	{Name: "ups.test.result", Get: nutString("upsTestResultsDetail")},
+	{
+		Name: "ups.delay.shutdown",
+		Get: func(n *NUT) (string, bool) {
+			n.Lock.Lock()
+			defer n.Lock.Unlock()
+			return strconv.Itoa(n.ShutdownDelay), true
+		},
+		Set: func(n *NUT, value string) error {
+			v, err := strconv.Atoi(value)
+			if err != nil || v < 0 {
+				return fmt.Errorf("invalid delay: %s", value)
+			}
+			n.Lock.Lock()
+			n.ShutdownDelay = v
+			n.Lock.Unlock()
+			return nil
+		},
+		Type:     "NUMBER",
+		Describe: "Interval to wait after shutdown with delay command (seconds)",
+	},
+	{Name: "ups.timer.shutdown", Get: nutNumber("upsShutdownAfterDelay", 0, 1, "%.0f")},
+	{Name: "ups.timer.start", Get: nutNumber("upsStartupAfterDelay", 0, 1, "%.0f")},
+	{Name: "ups.timer.reboot", Get: nutNumber("upsRebootWithDuration", 0, 1, "%.0f")},
+
+	{Name: "battery.charge", Get: nutNumber("upsEstimatedChargeRemaining", 0, 1, "%.0f")},
+	{Name: "battery.runtime", Get: nutNumber("upsEstimatedMinutesRemaining", 0, 1.0/60, "%.0f")},
+	{
+		Name: "battery.runtime.low",
+		Get:  nutNumber("upsConfigLowBattTime", 0, 1.0/60, "%.0f"),
+		Set:  nutSetInt("upsConfigLowBattTime", 60),
+		Type: "NUMBER",
+
+		Describe: "Remaining battery runtime when UPS switches to LB (seconds)",
+	},
+	{Name: "battery.voltage", Get: nutNumber("upsBatteryVoltage", 0, 10, "%.1f")},
+	{Name: "battery.current", Get: nutNumber("upsBatteryCurrent", 0, 10, "%.1f")},
+	{Name: "battery.temperature", Get: nutNumber("upsBatteryTemperature", 0, 1, "%.0f")},
+
+	{Name: "input.voltage", Get: nutNumber("upsInputVoltage", 1, 1, "%.1f")},
+	{Name: "input.current", Get: nutNumber("upsInputCurrent", 1, 10, "%.1f")},
+	{Name: "input.frequency", Get: nutNumber("upsInputFrequency", 1, 10, "%.1f")},
+	{Name: "input.realpower", Get: nutNumber("upsInputTruePower", 1, 1, "%.0f")},
+	{Name: "input.voltage.nominal", Get: nutNumber("upsConfigInputVoltage", 0, 1, "%.0f")},
+	{Name: "input.frequency.nominal", Get: nutNumber("upsConfigInputFreq", 0, 1, "%.0f")},
+	{
+		Name: "input.transfer.low",
+		Get:  nutNumber("upsConfigLowVoltageTransferPoint", 0, 1, "%.0f"),
+		Set:  nutSetInt("upsConfigLowVoltageTransferPoint", 1),
+		Type: "NUMBER",
+
+		Describe: "Low voltage transfer point (V)",
+	},
+	{
+		Name: "input.transfer.high",
+		Get:  nutNumber("upsConfigHighVoltageTransferPoint", 0, 1, "%.0f"),
+		Set:  nutSetInt("upsConfigHighVoltageTransferPoint", 1),
+		Type: "NUMBER",
+
+		Describe: "High voltage transfer point (V)",
+	},
+
+	{Name: "output.voltage", Get: nutNumber("upsOutputVoltage", 1, 1, "%.1f")},
+	{Name: "output.current", Get: nutNumber("upsOutputCurrent", 1, 10, "%.1f")},
+	{Name: "output.frequency", Get: nutNumber("upsOutputFrequency", 0, 10, "%.1f")},
+	{Name: "output.voltage.nominal", Get: nutNumber("upsConfigOutputVoltage", 0, 1, "%.0f")},
+	{Name: "output.frequency.nominal", Get: nutNumber("upsConfigOutputFreq", 0, 1, "%.0f")},
+
+	{Name: "bypass.voltage", Get: nutNumber("upsBypassVoltage", 1, 1, "%.1f")},
+	{Name: "bypass.frequency", Get: nutNumber("upsBypassFrequency", 0, 10, "%.1f")},
+}
+
+type nutCmd struct {
+	Name     string
+	Describe string
+	Command  func(d Device) string // 用到的设备命令, 为空表示设备不支持, nil 时总是支持
+	Run      func(n *NUT, value string) error
+}
+
+// 当前设备是否支持, LIST CMD 只列出支持的命令
+func (n *NUT) cmdSupported(cmd *nutCmd) bool {
+	return cmd.Command == nil || cmd.Command(n.Snmp.Device) != ""
+}
+
+// 发送设备命令
+func nutDeviceCmd(get func(device Device) string) func(n *NUT, value string) error {
+	return func(n *NUT, value string) error {
+		n.Snmp.TtySend(get(n.Snmp.Device))
+		return nil
+	}
+}
+
+// 切换蜂鸣器到指定的 upsConfigAudibleStatus, 协议只有翻转命令。
+func nutBeeper(enable bool) func(n *NUT, value string) error {
+	return func(n *NUT, value string) error {
+		if (n.Snmp.Data.Config.AudibleStatus == 2) != enable {
+			n.Snmp.TtySend(n.Snmp.Device.SwitchBuzz)
+		}
+		return nil
+	}
+}
+
+// 通过 upsTestId 开始或中止测试, 与 SNMP 写入相同地更新测试结果并发送 Trap。
+func nutTest(name string) func(n *NUT, value string) error {
+	return func(n *NUT, value string) error {
+		return startTest(n.Snmp, name)
+	}
+}
+
+func nutControl(name string, value func(n *NUT) int) func(n *NUT, value string) error {
+	return func(n *NUT, _ string) error {
+		return n.Snmp.SetValue(name, 0, value(n))
+	}
+}
+
+var nutCmds = []nutCmd{
+	{
+		Name:     "test.battery.start",
+		Describe: "Start a battery test",
+		Command:  mt1000ProTests["upsTestQuickBatteryTest"].Command,
+		Run:      nutTest("upsTestQuickBatteryTest"),
+	},
+	{
+		Name:     "test.battery.start.quick",
+		Describe: "Start a quick battery test",
+		Command:  mt1000ProTests["upsTestQuickBatteryTest"].Command,
+		Run:      nutTest("upsTestQuickBatteryTest"),
+	},
+	{
+		Name:     "test.battery.start.deep",
+		Describe: "Start a deep battery test",
+		Command:  mt1000ProTests["upsTestDeepBatteryCalibration"].Command,
+		Run:      nutTest("upsTestDeepBatteryCalibration"),
+	},
+	{
+		Name:     "test.battery.stop",
+		Describe: "Stop the battery test",
+		Command:  func(d Device) string { return d.CancelAllTest },
+		Run:      nutTest("upsTestAbortTestInProgress"),
+	},
+	{
+		Name:     "beeper.toggle",
+		Describe: "Toggle the UPS beeper",
+		Command:  func(d Device) string { return d.SwitchBuzz },
+		Run:      nutDeviceCmd(func(d Device) string { return d.SwitchBuzz }),
+	},
+	{
+		Name:     "beeper.enable",
+		Describe: "Enable the UPS beeper",
+		Command:  func(d Device) string { return d.SwitchBuzz },
+		Run:      nutBeeper(true),
+	},
+	{
+		Name:     "beeper.disable",
+		Describe: "Disable the UPS beeper",
+		Command:  func(d Device) string { return d.SwitchBuzz },
+		Run:      nutBeeper(false),
+	},
+	{
+		Name:     "shutdown.return",
+		Describe: "Turn off the load and return when power is back",
+		Command:  func(d Device) string { return d.Poweroff },
+		Run: nutControl("upsShutdownAfterDelay", func(n *NUT) int {
+			n.Lock.Lock()
+			defer n.Lock.Unlock()
+			return n.ShutdownDelay
+		}),
+	},
+	{
+		Name:     "shutdown.stop",
+		Describe: "Stop a shutdown in progress",
+		Run:      nutControl("upsShutdownAfterDelay", func(n *NUT) int { return -1 }),
+	},
+	{
+		Name:     "shutdown.reboot",
+		Describe: "Shut down the load briefly while rebooting the UPS",
+		Command:  func(d Device) string { return d.PoweroffAndStart },
+		Run:      nutControl("upsRebootWithDuration", func(n *NUT) int { return 60 }),
+	},
+	{
+		Name:     "load.on",
+		Describe: "Turn on the load immediately",
+		Command:  func(d Device) string { return d.CancelAllPoweroff },
+		Run:      nutControl("upsStartupAfterDelay", func(n *NUT) int { return 0 }),
+	},
+}
+
+func nutFindVar(name string) *nutVar {
+	for i := range nutVars {
+		if nutVars[i].Name == name {
+			return &nutVars[i]
+		}
+	}
+	return nil
+}
+
+func nutFindCmd(name string) *nutCmd {
+	for i := range nutCmds {
+		if nutCmds[i].Name == name {
+			return &nutCmds[i]
+		}
+	}
+	return nil
+}
+
+func (n *NUT) status() (string, bool) {
+	var status []string
+
+	n.Lock.Lock()
+	if n.FSD {
+		status = append(status, "FSD")
+	}
+	n.Lock.Unlock()
+
+	source, _ := n.Snmp.GetValue("upsOutputSource", 0)
+	switch source {
+	case 4:
+		status = append(status, "OL", "BYPASS")
+	case 5:
+		status = append(status, "OB")
+	case 6:
+		status = append(status, "OL", "BOOST")
+	case 7:
+		status = append(status, "OL", "TRIM")
+	case 2:
+		status = append(status, "OFF")
+	default:
+		status = append(status, "OL")
+	}
+
+	if battery, _ := n.Snmp.GetValue("upsBatteryStatus", 0); battery == 3 || battery == 4 {
+		status = append(status, "LB")
+	}
+	if test, _ := n.Snmp.GetValue("upsTestResultsSummary", 0); test == 5 {
+		status = append(status, "CAL")
+	}
+	if alarm.Exist("upsAlarmOutputOverload") {
+		status = append(status, "OVER")
+	}
+	if alarm.Exist("upsAlarmUpsSystemOff") && source != 2 {
+		status = append(status, "OFF")
+	}
+	if alarm.Exist("upsAlarmChargerFailed") || alarm.Exist("upsAlarmBatteryBad") {
+		status = append(status, "RB")
+	}
+	return strings.Join(status, " "), true
+}
+
+// 与 UPS 通讯中断时数据已过期
+func (n *NUT) stale() bool {
+	return alarm.Exist("upsAlarmCommunicationsLost")
+}
+
+func (n *NUT) beeperStatus() (string, bool) {
+	value, err := n.Snmp.GetValue("upsConfigAudibleStatus", 0)
+	if err != nil {
+		return "", false
+	}
+	switch value {
+	case 1:
+		return "disabled", true
+	case 2:
+		return "enabled", true
+	case 3:
+		return "muted", true
+	}
+	return "", false
+}
+
+func (n *NUT) findUser(username string) *NUTUser {
+	for i := range n.Config.Users {
+		if n.Config.Users[i].Username == username {
+			return &n.Config.Users[i]
+		}
+	}
+	return nil
+}
+
+// 检查用户权限, action: SET / FSD / PRIMARY
+func (n *NUT) checkAction(c *nutClient, action string) bool {
+	user := n.findUser(c.Username)
+	if user == nil || user.Password != c.Password {
+		return false
+	}
+	// 与 upsd 相同, upsmon primary 只额外获得 FSD 和 PRIMARY 权限
+	if (action == "FSD" || action == "PRIMARY") &&
+		(strings.EqualFold(user.Upsmon, "primary") || strings.EqualFold(user.Upsmon, "master")) {
+		return true
+	}
+	for _, a := range user.Actions {
+		if strings.EqualFold(a, action) {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *NUT) checkInstCmd(c *nutClient, cmd string) bool {
+	user := n.findUser(c.Username)
+	if user == nil || user.Password != c.Password {
+		return false
+	}
+	for _, a := range user.InstCmds {
+		if a == "all" || a == cmd {
+			return true
+		}
+	}
+	return false
+}
+
+// 按 NUT 规则拆分命令行, 支持双引号和反斜杠转义。
+func nutSplit(line string) ([]string, error) {
+	var args []string
+	var current strings.Builder
+	inQuote := false
+	escape := false
+	hasArg := false
+	for _, c := range line {
+		switch {
+		case escape:
+			current.WriteRune(c)
+			escape = false
+		case c == '\\':
+			escape = true
+			hasArg = true
+		case c == '"':
+			inQuote = !inQuote
+			hasArg = true
+		case (c == ' ' || c == '\t') && !inQuote:
+			if hasArg {
+				args = append(args, current.String())
+				current.Reset()
+				hasArg = false
+			}
+		default:
+			current.WriteRune(c)
+			hasArg = true
+		}
+	}
+	if inQuote || escape {
+		return nil, fmt.Errorf("unterminated argument")
+	}
+	if hasArg {
+		args = append(args, current.String())
+	}
+	return args, nil
+}
+
+func nutQuote(value string) string {
+	value = strings.ReplaceAll(value, "\\", "\\\\")
+	value = strings.ReplaceAll(value, "\"", "\\\"")
+	return "\"" + value + "\""
+}
+
+func nutServer(config NUTConfig, snmp *SNMP) (*NUT, error) {
+	listen := fmt.Sprintf("%s:%d", config.Address, config.Port)
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	return &NUT{
+		Config:        &config,
+		Snmp:          snmp,
+		Listener:      listener,
+		ShutdownDelay: 20,
+	}, nil
+}
+
+// 启动 NUT 服务器。
+func (n *NUT) Run() {
+	Logger.Infof("NUT server is running on %s", n.Listener.Addr().String())
+	for {
+		conn, err := n.Listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			Logger.Infof("NUT server stopped: %s", err.Error())
+			return
+		}
+		go n.serve(conn)
+	}
+}
+
+// 关闭 NUT 服务器。
+func (n *NUT) Close() error {
+	return n.Listener.Close()
+}
+
+func (n *NUT) serve(conn net.Conn) {
+	defer conn.Close()
+	Logger.Debugf("NUT client connected: %s", conn.RemoteAddr().String())
+
+	c := &nutClient{Conn: conn}
+	defer func() {
+		if c.LoggedIn {
+			n.Lock.Lock()
+			n.Logins--
+			n.Lock.Unlock()
+		}
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		Logger.Debugf("NUT recv: %s", line)
+		args, err := nutSplit(line)
+		if err != nil {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+		} else if len(args) == 0 {
+			continue
+		} else {
+			n.Snmp.Lock.Lock()
+			ok := n.handle(c, args)
+			n.Snmp.Lock.Unlock()
+			if !ok {
+				n.flush(c)
+				return
+			}
+		}
+		if !n.flush(c) {
+			return
+		}
+	}
+}
+
+func (n *NUT) reply(c *nutClient, lines ...string) {
+	c.replies = append(c.replies, lines...)
+}
+
+// 发送缓存的应答, 写入失败或超时返回 false
+func (n *NUT) flush(c *nutClient) bool {
+	if len(c.replies) == 0 {
+		return true
+	}
+	var buffer strings.Builder
+	for _, line := range c.replies {
+		Logger.Debugf("NUT send: %s", line)
+		buffer.WriteString(line + "\n")
+	}
+	c.replies = c.replies[:0]
+
+	c.Conn.SetWriteDeadline(time.Now().Add(nutWriteTimeout))
+	_, err := c.Conn.Write([]byte(buffer.String()))
+	if err != nil {
+		Logger.Errorf("NUT write faild: %s", err.Error())
+		return false
+	}
+	return true
+}
+
+func (n *NUT) checkUPS(c *nutClient, name string) bool {
+	if name != n.Config.Name {
+		n.reply(c, "ERR UNKNOWN-UPS")
+		return false
+	}
+	return true
+}
+
+// 处理一条命令, 返回 false 表示断开连接。
+func (n *NUT) handle(c *nutClient, args []string) bool {
+	switch strings.ToUpper(args[0]) {
+	case "VER", "VERSION":
+		n.reply(c, "Network UPS Tools upsd 2.8.0 - santak-ups-snmp-server")
+	case "NETVER":
+		n.reply(c, "1.3")
+	case "HELP":
+		n.reply(c, "Commands: HELP VER GET LIST SET INSTCMD LOGIN LOGOUT USERNAME PASSWORD STARTTLS")
+	case "STARTTLS":
+		n.reply(c, "ERR FEATURE-NOT-CONFIGURED")
+	case "USERNAME":
+		if len(args) != 2 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+		} else if c.Username != "" {
+			n.reply(c, "ERR ALREADY-SET-USERNAME")
+		} else {
+			c.Username = args[1]
+			n.reply(c, "OK")
+		}
+	case "PASSWORD":
+		if len(args) != 2 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+		} else if c.Password != "" {
+			n.reply(c, "ERR ALREADY-SET-PASSWORD")
+		} else {
+			c.Password = args[1]
+			n.reply(c, "OK")
+		}
+	case "LOGIN":
+		if len(args) != 2 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+			break
+		}
+		if c.LoggedIn {
+			n.reply(c, "ERR ALREADY-LOGGED-IN")
+			break
+		}
+		if c.Username == "" {
+			n.reply(c, "ERR USERNAME-REQUIRED")
+			break
+		}
+		if c.Password == "" {
+			n.reply(c, "ERR PASSWORD-REQUIRED")
+			break
+		}
+		user := n.findUser(c.Username)
+		if user == nil || user.Password != c.Password {
+			n.reply(c, "ERR ACCESS-DENIED")
+			break
+		}
+		if !n.checkUPS(c, args[1]) {
+			break
+		}
+		c.LoggedIn = true
+		n.Lock.Lock()
+		n.Logins++
+		n.Lock.Unlock()
+		Logger.Infof("NUT client %s logged in as %s", c.Conn.RemoteAddr().String(), c.Username)
+		n.reply(c, "OK")
+	case "PRIMARY", "MASTER":
+		if len(args) != 2 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+			break
+		}
+		if !n.checkAction(c, "PRIMARY") {
+			n.reply(c, "ERR ACCESS-DENIED")
+			break
+		}
+		if !n.checkUPS(c, args[1]) {
+			break
+		}
+		c.Primary = true
+		n.reply(c, "OK "+strings.ToUpper(args[0])+"-GRANTED")
+	case "FSD":
+		if len(args) != 2 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+			break
+		}
+		if !n.checkAction(c, "FSD") {
+			n.reply(c, "ERR ACCESS-DENIED")
+			break
+		}
+		if !n.checkUPS(c, args[1]) {
+			break
+		}
+		Logger.Warnf("NUT client %s set forced shutdown", c.Username)
+		n.Lock.Lock()
+		n.FSD = true
+		n.Lock.Unlock()
+		n.reply(c, "OK FSD-SET")
+	case "LOGOUT":
+		n.reply(c, "OK Goodbye")
+		return false
+	case "LIST":
+		n.handleList(c, args[1:])
+	case "GET":
+		n.handleGet(c, args[1:])
+	case "SET":
+		n.handleSet(c, args[1:])
+	case "INSTCMD":
+		n.handleInstCmd(c, args[1:])
+	default:
+		n.reply(c, "ERR UNKNOWN-COMMAND")
+	}
+	return true
+}
+
+func (n *NUT) description() string {
+	model, err := n.Snmp.GetValue("upsIdentModel", 0)
+	if err != nil {
+		return "UPS"
+	}
+	return fmt.Sprintf("%v", model)
+}
+
+func (n *NUT) handleList(c *nutClient, args []string) {
+	if len(args) == 0 {
+		n.reply(c, "ERR INVALID-ARGUMENT")
+		return
+	}
+	sub := strings.ToUpper(args[0])
+	if sub == "UPS" {
+		n.reply(c,
+			"BEGIN LIST UPS",
+			fmt.Sprintf("UPS %s %s", n.Config.Name, nutQuote(n.description())),
+			"END LIST UPS",
+		)
+		return
+	}
+	if len(args) < 2 {
+		n.reply(c, "ERR INVALID-ARGUMENT")
+		return
+	}
+	name := args[1]
+	if !n.checkUPS(c, name) {
+		return
+	}
+	switch sub {
+	case "VAR", "RW":
+		if n.stale() {
+			n.reply(c, "ERR DATA-STALE")
+			return
+		}
+		lines := []string{fmt.Sprintf("BEGIN LIST %s %s", sub, name)}
+		for _, v := range n.vars() {
+			if sub == "RW" && v.Set == nil {
+				continue
+			}
+			if value, ok := v.Get(n); ok {
+				lines = append(lines, fmt.Sprintf("%s %s %s %s", sub, name, v.Name, nutQuote(value)))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("END LIST %s %s", sub, name))
+		n.reply(c, lines...)
+	case "CMD":
+		lines := []string{fmt.Sprintf("BEGIN LIST CMD %s", name)}
+		for i := range nutCmds {
+			if n.cmdSupported(&nutCmds[i]) {
+				lines = append(lines, fmt.Sprintf("CMD %s %s", name, nutCmds[i].Name))
+			}
+		}
+		lines = append(lines, fmt.Sprintf("END LIST CMD %s", name))
+		n.reply(c, lines...)
+	case "CLIENT":
+		lines := []string{fmt.Sprintf("BEGIN LIST CLIENT %s", name)}
+		lines = append(lines, fmt.Sprintf("END LIST CLIENT %s", name))
+		n.reply(c, lines...)
+	case "ENUM", "RANGE":
+		if len(args) < 3 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+			return
+		}
+		n.reply(c,
+			fmt.Sprintf("BEGIN LIST %s %s %s", sub, name, args[2]),
+			fmt.Sprintf("END LIST %s %s %s", sub, name, args[2]),
+		)
+	default:
+		n.reply(c, "ERR INVALID-ARGUMENT")
+	}
+}
+
+// 按名称排序的变量列表
+func (n *NUT) vars() []nutVar {
+	vars := make([]nutVar, len(nutVars))
+	copy(vars, nutVars)
+	sort.Slice(vars, func(i, j int) bool {
+		return vars[i].Name < vars[j].Name
+	})
+	return vars
+}
+
+func (n *NUT) handleGet(c *nutClient, args []string) {
+	if len(args) < 2 {
+		n.reply(c, "ERR INVALID-ARGUMENT")
+		return
+	}
+	sub := strings.ToUpper(args[0])
+	name := args[1]
+	if !n.checkUPS(c, name) {
+		return
+	}
+	switch sub {
+	case "NUMLOGINS":
+		n.Lock.Lock()
+		logins := n.Logins
+		n.Lock.Unlock()
+		n.reply(c, fmt.Sprintf("NUMLOGINS %s %d", name, logins))
+	case "UPSDESC":
+		n.reply(c, fmt.Sprintf("UPSDESC %s %s", name, nutQuote(n.description())))
+	case "VAR", "TYPE", "DESC":
+		if len(args) != 3 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+			return
+		}
+		v := nutFindVar(args[2])
+		if v == nil {
+			n.reply(c, "ERR VAR-NOT-SUPPORTED")
+			return
+		}
+		if sub == "VAR" && n.stale() {
+			n.reply(c, "ERR DATA-STALE")
+			return
+		}
+		value, ok := v.Get(n)
+		if !ok {
+			n.reply(c, "ERR VAR-NOT-SUPPORTED")
+			return
+		}
+		switch sub {
+		case "VAR":
+			n.reply(c, fmt.Sprintf("VAR %s %s %s", name, v.Name, nutQuote(value)))
+		case "TYPE":
+			tp := "NUMBER"
+			if v.Set != nil {
+				tp = "RW " + v.Type
+			} else if _, err := strconv.ParseFloat(value, 64); err != nil {
+				tp = "STRING:" + strconv.Itoa(len(value))
+			}
+			n.reply(c, fmt.Sprintf("TYPE %s %s %s", name, v.Name, tp))
+		case "DESC":
+			desc := v.Describe
+			if desc == "" {
+				desc = "Description unavailable"
+			}
+			n.reply(c, fmt.Sprintf("DESC %s %s %s", name, v.Name, nutQuote(desc)))
+		}
+	case "CMDDESC":
+		if len(args) != 3 {
+			n.reply(c, "ERR INVALID-ARGUMENT")
+			return
+		}
+		cmd := nutFindCmd(args[2])
+		if cmd == nil || !n.cmdSupported(cmd) {
+			n.reply(c, "ERR CMD-NOT-SUPPORTED")
+			return
+		}
+		n.reply(c, fmt.Sprintf("CMDDESC %s %s %s", name, cmd.Name, nutQuote(cmd.Describe)))
+	default:
+		n.reply(c, "ERR INVALID-ARGUMENT")
+	}
+}
+
+func (n *NUT) handleSet(c *nutClient, args []string) {
+	if len(args) != 4 || strings.ToUpper(args[0]) != "VAR" {
+		n.reply(c, "ERR INVALID-ARGUMENT")
+		return
+	}
+	if c.Username == "" {
+		n.reply(c, "ERR USERNAME-REQUIRED")
+		return
+	}
+	if c.Password == "" {
+		n.reply(c, "ERR PASSWORD-REQUIRED")
+		return
+	}
+	if !n.checkAction(c, "SET") {
+		n.reply(c, "ERR ACCESS-DENIED")
+		return
+	}
+	if !n.checkUPS(c, args[1]) {
+		return
+	}
+	v := nutFindVar(args[2])
+	if v == nil {
+		n.reply(c, "ERR VAR-NOT-SUPPORTED")
+		return
+	}
+	if v.Set == nil {
+		n.reply(c, "ERR READONLY")
+		return
+	}
+	err := v.Set(n, args[3])
+	if err != nil {
+		Logger.Errorf("NUT set %s=%s faild: %s", v.Name, args[3], err.Error())
+		n.reply(c, "ERR INVALID-VALUE")
+		return
+	}
+	Logger.Infof("NUT client %s set %s=%s", c.Username, v.Name, args[3])
+	n.reply(c, "OK")
+}
+
+func (n *NUT) handleInstCmd(c *nutClient, args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		n.reply(c, "ERR INVALID-ARGUMENT")
+		return
+	}
+	if c.Username == "" {
+		n.reply(c, "ERR USERNAME-REQUIRED")
+		return
+	}
+	if c.Password == "" {
+		n.reply(c, "ERR PASSWORD-REQUIRED")
+		return
+	}
+	if !n.checkUPS(c, args[0]) {
+		return
+	}
+	cmd := nutFindCmd(args[1])
+	if cmd == nil || !n.cmdSupported(cmd) {
+		n.reply(c, "ERR CMD-NOT-SUPPORTED")
+		return
+	}
+	if !n.checkInstCmd(c, cmd.Name) {
+		n.reply(c, "ERR ACCESS-DENIED")
+		return
+	}
+	value := ""
+	if len(args) == 3 {
+		value = args[2]
+	}
+	err := cmd.Run(n, value)
+	if err != nil {
+		Logger.Errorf("NUT instcmd %s faild: %s", cmd.Name, err.Error())
+		n.reply(c, "ERR INSTCMD-FAILED")
+		return
+	}
+	Logger.Infof("NUT client %s run instcmd %s", c.Username, cmd.Name)
+	n.reply(c, "OK")
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNUTClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// 启动监听随机端口的 NUT 服务器, UPS 名称为 ups
+func newTestNUT(t *testing.T, snmp *SNMP, users ...NUTUser) *NUT {
+	t.Helper()
+
+	n, err := nutServer(NUTConfig{Address: "127.0.0.1", Port: 0, Name: "ups", Users: users}, snmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go n.Run()
+	t.Cleanup(func() { n.Close() })
+	return n
+}
+
+func newTestNUTClient(t *testing.T, n *NUT) *testNUTClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", n.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testNUTClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+// 发送一条命令, 读取单行应答或 BEGIN ... END 之间的全部行
+func (c *testNUTClient) send(line string) []string {
+	c.t.Helper()
+
+	c.conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.conn.Write([]byte(line + "\n")); err != nil {
+		c.t.Fatal(err)
+	}
+	var lines []string
+	for {
+		reply, err := c.reader.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("%s: %s", line, err)
+		}
+		reply = strings.TrimRight(reply, "\n")
+		lines = append(lines, reply)
+		if !strings.HasPrefix(lines[0], "BEGIN ") || strings.HasPrefix(reply, "END ") {
+			return lines
+		}
+	}
+}
+
+func (c *testNUTClient) expect(line string, want string) {
+	c.t.Helper()
+	if got := c.send(line); len(got) != 1 || got[0] != want {
+		c.t.Errorf("%s: %q, want %q", line, got, want)
+	}
+}
+
+func (c *testNUTClient) login(username string, password string) {
+	c.t.Helper()
+	c.expect("USERNAME "+username, "OK")
+	c.expect("PASSWORD "+password, "OK")
+	c.expect("LOGIN ups", "OK")
+}
+
+func TestNUTSplit(t *testing.T) {
+	for _, test := range []struct {
+		line string
+		want []string
+	}{
+		{"GET VAR ups ups.status", []string{"GET", "VAR", "ups", "ups.status"}},
+		{`SET VAR ups ups.id "rack 1"`, []string{"SET", "VAR", "ups", "ups.id", "rack 1"}},
+		{`SET VAR ups ups.id "a \"b\" \\c"`, []string{"SET", "VAR", "ups", "ups.id", `a "b" \c`}},
+		{`SET VAR ups ups.id ""`, []string{"SET", "VAR", "ups", "ups.id", ""}},
+		{"  LIST\tUPS  ", []string{"LIST", "UPS"}},
+	} {
+		got, err := nutSplit(test.line)
+		if err != nil || strings.Join(got, "|") != strings.Join(test.want, "|") || len(got) != len(test.want) {
+			t.Errorf("nutSplit(%q) = %q, %v, want %q", test.line, got, err, test.want)
+		}
+	}
+	if _, err := nutSplit(`SET VAR ups ups.id "rack`); err == nil {
+		t.Error("unterminated quote accepted")
+	}
+	if got := nutQuote(`a "b" \c`); got != `"a \"b\" \\c"` {
+		t.Errorf("nutQuote %s", got)
+	}
+}
+
+func TestNUTList(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+	c := newTestNUTClient(t, newTestNUT(t, snmp))
+
+	if got := c.send("LIST UPS"); len(got) != 3 || !strings.HasPrefix(got[1], "UPS ups ") {
+		t.Errorf("LIST UPS: %q", got)
+	}
+
+	vars := map[string]string{}
+	for _, line := range c.send("LIST VAR ups") {
+		args, err := nutSplit(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if args[0] == "VAR" {
+			vars[args[2]] = args[3]
+		}
+	}
+	for name, want := range map[string]string{
+		"ups.status":          "OL",
+		"input.voltage":       "228.0",
+		"output.frequency":    "50.0",
+		"battery.temperature": "25",
+		"device.type":         "ups",
+	} {
+		if vars[name] != want {
+			t.Errorf("LIST VAR %s = %q, want %q", name, vars[name], want)
+		}
+	}
+
+	rw := c.send("LIST RW ups")
+	if len(rw) < 3 || !strings.HasPrefix(rw[1], "RW ups ") {
+		t.Errorf("LIST RW: %q", rw)
+	}
+	for _, line := range rw[1 : len(rw)-1] {
+		if v := nutFindVar(strings.Fields(line)[2]); v == nil || v.Set == nil {
+			t.Errorf("LIST RW: %s is not writable", line)
+		}
+	}
+	// mt1000-pro 没有 TL 和 CT, 不列出深度测试和中止测试
+	cmds := map[string]bool{}
+	for _, line := range c.send("LIST CMD ups") {
+		if fields := strings.Fields(line); len(fields) == 3 && fields[0] == "CMD" {
+			cmds[fields[2]] = true
+		}
+	}
+	if len(cmds) != len(nutCmds)-2 || !cmds["test.battery.start"] || cmds["test.battery.start.deep"] || cmds["test.battery.stop"] {
+		t.Errorf("LIST CMD: %v", cmds)
+	}
+	c.expect("GET CMDDESC ups test.battery.stop", "ERR CMD-NOT-SUPPORTED")
+	c.expect("LIST VAR other", "ERR UNKNOWN-UPS")
+	c.expect("LIST VAR", "ERR INVALID-ARGUMENT")
+}
+
+func TestNUTGet(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	serialReceived(snmp, "Q1", "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000")
+	c := newTestNUTClient(t, newTestNUT(t, snmp))
+
+	c.expect("GET VAR ups ups.status", `VAR ups ups.status "OB"`)
+	c.expect("GET VAR ups output.voltage", `VAR ups output.voltage "228.0"`)
+	c.expect("GET TYPE ups battery.runtime.low", "TYPE ups battery.runtime.low RW NUMBER")
+	c.expect("GET TYPE ups input.voltage", "TYPE ups input.voltage NUMBER")
+	c.expect("GET DESC ups ups.delay.shutdown", `DESC ups ups.delay.shutdown "Interval to wait after shutdown with delay command (seconds)"`)
+	c.expect("GET CMDDESC ups beeper.toggle", `CMDDESC ups beeper.toggle "Toggle the UPS beeper"`)
+	c.expect("GET NUMLOGINS ups", "NUMLOGINS ups 0")
+	c.expect("GET VAR ups ups.unknown", "ERR VAR-NOT-SUPPORTED")
+	c.expect("GET CMDDESC ups unknown", "ERR CMD-NOT-SUPPORTED")
+	c.expect("GET VAR other ups.status", "ERR UNKNOWN-UPS")
+	c.expect("FOO", "ERR UNKNOWN-COMMAND")
+
+	// 与 UPS 通讯中断时读数已过期
+	snmp.Lock.Lock()
+	alarm.Add("upsAlarmCommunicationsLost")
+	snmp.Lock.Unlock()
+	c.expect("GET VAR ups ups.status", "ERR DATA-STALE")
+	c.expect("LIST VAR ups", "ERR DATA-STALE")
+}
+
+// upsmon primary 只获得 FSD 和 PRIMARY, SET 和 INSTCMD 需在 actions / instcmds 中列出
+func TestNUTAuth(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	n := newTestNUT(t, snmp,
+		NUTUser{Username: "monuser", Password: "secret", Upsmon: "primary"},
+		NUTUser{Username: "admin", Password: "admin", Actions: []string{"SET"}, InstCmds: []string{"beeper.toggle"}},
+	)
+
+	anonymous := newTestNUTClient(t, n)
+	anonymous.expect("SET VAR ups ups.id test", "ERR USERNAME-REQUIRED")
+	anonymous.expect("INSTCMD ups beeper.toggle", "ERR USERNAME-REQUIRED")
+	anonymous.expect("USERNAME admin", "OK")
+	anonymous.expect("USERNAME admin", "ERR ALREADY-SET-USERNAME")
+	anonymous.expect("LOGIN ups", "ERR PASSWORD-REQUIRED")
+	anonymous.expect("PASSWORD wrong", "OK")
+	anonymous.expect("LOGIN ups", "ERR ACCESS-DENIED")
+	anonymous.expect("SET VAR ups ups.id test", "ERR ACCESS-DENIED")
+
+	monitor := newTestNUTClient(t, n)
+	monitor.login("monuser", "secret")
+	monitor.expect("LOGIN ups", "ERR ALREADY-LOGGED-IN")
+	monitor.expect("PRIMARY ups", "OK PRIMARY-GRANTED")
+	monitor.expect("SET VAR ups ups.id test", "ERR ACCESS-DENIED")
+	monitor.expect("INSTCMD ups beeper.toggle", "ERR ACCESS-DENIED")
+	monitor.expect("INSTCMD ups shutdown.return", "ERR ACCESS-DENIED")
+	monitor.expect("GET NUMLOGINS ups", "NUMLOGINS ups 1")
+	monitor.expect("FSD ups", "OK FSD-SET")
+	monitor.expect("GET VAR ups ups.status", `VAR ups ups.status "FSD OL"`)
+
+	admin := newTestNUTClient(t, n)
+	admin.login("admin", "admin")
+	admin.expect("PRIMARY ups", "ERR ACCESS-DENIED")
+	admin.expect("FSD ups", "ERR ACCESS-DENIED")
+	admin.expect("INSTCMD ups shutdown.return", "ERR ACCESS-DENIED")
+	admin.expect("LOGOUT", "OK Goodbye")
+}
+
+func TestNUTSet(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	c := newTestNUTClient(t, newTestNUT(t, snmp, NUTUser{Username: "admin", Password: "admin", Actions: []string{"set"}}))
+	c.login("admin", "admin")
+
+	c.expect("SET VAR ups ups.delay.shutdown 120", "OK")
+	c.expect("SET VAR ups battery.runtime.low 300", "OK")
+	c.expect("GET VAR ups ups.delay.shutdown", `VAR ups ups.delay.shutdown "120"`)
+	c.expect("GET VAR ups battery.runtime.low", `VAR ups battery.runtime.low "300"`)
+
+	c.expect("SET VAR ups ups.delay.shutdown soon", "ERR INVALID-VALUE")
+	c.expect("SET VAR ups input.voltage 230", "ERR READONLY")
+	c.expect("SET VAR ups ups.unknown 1", "ERR VAR-NOT-SUPPORTED")
+	c.expect("SET VAR other ups.id test", "ERR UNKNOWN-UPS")
+}
+
+// 测试命令与 SNMP 写入 upsTestId 相同, 完成后更新测试结果并发送 upsTrapTestCompleted
+func TestNUTInstCmd(t *testing.T) {
+	snmp, traps := newTestTrapAgent(t, "mt1000-pro")
+	sent := recordSerialSend(snmp)
+	c := newTestNUTClient(t, newTestNUT(t, snmp, NUTUser{Username: "admin", Password: "admin", InstCmds: []string{"all"}}))
+	c.login("admin", "admin")
+
+	const (
+		idle   = "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000"
+		inTest = "(228.0 228.0 228.4 017 50.0 26.1 25.0 00001100"
+	)
+	serialReceived(snmp, "Q1", idle)
+	for i := 0; i < 2; i++ {
+		c.expect("INSTCMD ups test.battery.start.quick", "OK")
+		c.expect("INSTCMD ups test.battery.start", "ERR INSTCMD-FAILED")
+		serialReceived(snmp, "Q1", inTest)
+		c.expect("GET VAR ups ups.status", `VAR ups ups.status "OL CAL"`)
+		serialReceived(snmp, "Q1", idle)
+		c.expect("GET VAR ups ups.test.result", `VAR ups ups.test.result "Quick battery test passed"`)
+	}
+	if n := len(traps.find(t, snmp, "upsTrapTestCompleted")); n != 2 {
+		t.Errorf("received %d upsTrapTestCompleted, want 2", n)
+	}
+
+	c.expect("INSTCMD ups test.battery.stop", "ERR CMD-NOT-SUPPORTED")
+	c.expect("INSTCMD ups beeper.toggle", "OK")
+	c.expect("INSTCMD ups shutdown.stop", "OK")
+	c.expect("INSTCMD ups unknown", "ERR CMD-NOT-SUPPORTED")
+	if got := strings.Join(sent(), " "); got != "T T Q" {
+		t.Errorf("sent %s, want T T Q", got)
+	}
+}
+
+// 客户端不读取应答时不能一直持有 Snmp.Lock
+func TestNUTSlowClient(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	n := newTestNUT(t, snmp)
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		n.serve(server)
+		close(done)
+	}()
+
+	// net.Pipe 没有缓冲, 服务端写应答时阻塞
+	client.SetWriteDeadline(time.Now().Add(time.Second))
+	if _, err := client.Write([]byte("LIST VAR ups\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	locked := make(chan struct{})
+	go func() {
+		snmp.Lock.Lock()
+		snmp.Lock.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(time.Second):
+		t.Fatal("Snmp.Lock held while writing to the client")
+	}
+
+	// 其它客户端不受影响
+	newTestNUTClient(t, n).expect("VER", "Network UPS Tools upsd 2.8.0 - santak-ups-snmp-server")
+
+	client.Close()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("serve did not return after the client closed")
+	}
+}
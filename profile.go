@@ -0,0 +1,331 @@
+package main
+
+import (
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// 内置设备配置, 运行目录下的 profiles 目录可以覆盖或新增
+//
+//go:embed profiles/*.yml
+var builtinProfiles embed.FS
+
+const defaultDeviceProfile = "mt1000-pro"
+
+// 启动时探测 UPS 型号
+const autoDeviceProfile = "auto"
+
+type DeviceCommands struct {
+	GetInfo         string `yaml:"get-info"`         // Q1
+	GetRated        string `yaml:"get-rated"`        // F
+	GetManufacturer string `yaml:"get-manufacturer"` // I
+
+	Test             string `yaml:"test"`                // T
+	TestToBatteryLow string `yaml:"test-to-battery-low"` // TL
+	TestWithMinimum  string `yaml:"test-with-minimum"`   // T<m>
+
+	Poweroff         string `yaml:"poweroff"`           // S<m>
+	PoweroffAndStart string `yaml:"poweroff-and-start"` // S<m>R<m2>
+
+	SwitchBuzz string `yaml:"switch-buzz"` // Q
+
+	CancelAllPoweroff string `yaml:"cancel-all-poweroff"` // C
+	CancelAllTest     string `yaml:"cancel-all-test"`     // CT
+
+	// 三进三出 UPS
+	ExtraGetInfo   string `yaml:"extra-get-info"`    // G1
+	ExtraGetError  string `yaml:"extra-get-error"`   // G2
+	ExtraGetTPInfo string `yaml:"extra-get-tp-info"` // G3
+	ExtraGetRated  string `yaml:"extra-get-rated"`   // GF
+}
+
+// 负载百分比对应的放电时间
+type RuntimePoint struct {
+	Load    float64 `yaml:"load"`    // 负载 %
+	Minutes float64 `yaml:"minutes"` // 放电时间 分钟
+}
+
+type DeviceBattery struct {
+	FloatVoltage  float64        `yaml:"float-voltage"`  // 充满时的电池电压
+	CutoffVoltage float64        `yaml:"cutoff-voltage"` // 放电截止电压
+	Runtime       []RuntimePoint `yaml:"runtime"`
+}
+
+// 铭牌额定值
+type DeviceRating struct {
+	OutputVA                 int `yaml:"output-va"`
+	OutputPower              int `yaml:"output-power"`
+	LowBatteryTime           int `yaml:"low-battery-time"`
+	LowVoltageTransferPoint  int `yaml:"low-voltage-transfer-point"`
+	HighVoltageTransferPoint int `yaml:"high-voltage-transfer-point"`
+}
+
+// 自动识别规则, 未填写的条件不参与匹配
+type DeviceDetect struct {
+	Manufacturer string `yaml:"manufacturer"`  // 正则, 匹配 I 应答的公司名称
+	Model        string `yaml:"model"`         // 正则, 匹配 I 应答的型号
+	RatedCurrent int    `yaml:"rated-current"` // F 应答的额定电流
+	Online       *bool  `yaml:"online"`        // Q1 状态 b3 为 0
+	ThreePhase   *bool  `yaml:"three-phase"`   // GF / G1 有应答
+}
+
+type DeviceProfile struct {
+	Name         string `yaml:"name"`
+	Manufacturer string `yaml:"manufacturer"`
+	Model        string `yaml:"model"`
+	Driver       string `yaml:"driver"` // 见 deviceDrivers
+
+	Detect DeviceDetect `yaml:"detect"`
+
+	Services []string `yaml:"services"` // 启用的 SNMP 对象
+
+	Commands DeviceCommands `yaml:"commands"`
+	Battery  DeviceBattery  `yaml:"battery"`
+	Rating   DeviceRating   `yaml:"rating"`
+}
+
+// 解析设备配置
+func ParseDeviceProfile(dataBytes []byte) (*DeviceProfile, error) {
+	profile := &DeviceProfile{}
+	err := yaml.Unmarshal(dataBytes, profile)
+	if err != nil {
+		return nil, err
+	}
+	if profile.Name == "" {
+		return nil, fmt.Errorf("profile name is empty")
+	}
+	if _, ok := deviceDrivers[profile.Driver]; !ok {
+		return nil, fmt.Errorf("profile %s: unknown driver '%s'", profile.Name, profile.Driver)
+	}
+	for _, expr := range []string{profile.Detect.Manufacturer, profile.Detect.Model} {
+		if _, err := regexp.Compile(expr); err != nil {
+			return nil, fmt.Errorf("profile %s: %s", profile.Name, err.Error())
+		}
+	}
+	sort.Slice(profile.Battery.Runtime, func(i, j int) bool {
+		return profile.Battery.Runtime[i].Load < profile.Battery.Runtime[j].Load
+	})
+	return profile, nil
+}
+
+// 加载设备配置。
+// name: 配置文件路径, 或 profiles 目录下 / 内置的配置名。
+func LoadDeviceProfile(name string) (*DeviceProfile, error) {
+	if name == "" {
+		name = defaultDeviceProfile
+	}
+
+	if strings.HasSuffix(name, ".yml") || strings.HasSuffix(name, ".yaml") {
+		dataBytes, err := os.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		return ParseDeviceProfile(dataBytes)
+	}
+
+	profiles, err := LoadDeviceProfiles()
+	if err != nil {
+		return nil, err
+	}
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+	return nil, fmt.Errorf("device profile '%s' not found", name)
+}
+
+// 加载全部设备配置, profiles 目录中同名的配置覆盖内置配置
+func LoadDeviceProfiles() ([]*DeviceProfile, error) {
+	byName := map[string]*DeviceProfile{}
+
+	builtin, err := builtinProfiles.ReadDir("profiles")
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range builtin {
+		dataBytes, err := builtinProfiles.ReadFile("profiles/" + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		profile, err := ParseDeviceProfile(dataBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", entry.Name(), err.Error())
+		}
+		byName[profile.Name] = profile
+	}
+
+	files, _ := filepath.Glob(filepath.Join("profiles", "*.yml"))
+	for _, file := range files {
+		dataBytes, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		profile, err := ParseDeviceProfile(dataBytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err.Error())
+		}
+		byName[profile.Name] = profile
+	}
+
+	var profiles []*DeviceProfile
+	for _, profile := range byName {
+		profiles = append(profiles, profile)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles, nil
+}
+
+// 按启用的服务名生成 EnableService, 启用的字段为非零值
+func profileEnableService(services []string) (SNMPData, error) {
+	enabled := map[string]bool{}
+	for _, name := range services {
+		enabled[name] = true
+	}
+
+	result := SNMPData{
+		Ident:   &SNMPDataIdent{},
+		Battery: &SNMPDataBattery{},
+		Input:   &SNMPDataInput{},
+		Output:  &SNMPDataOutput{},
+		Bypass:  &SNMPDataBypass{},
+		Alarm:   &SNMPDataAlarm{},
+		Test:    &SNMPDataTest{},
+		Control: &SNMPDataControl{},
+		Config:  &SNMPDataConfig{},
+	}
+
+	root := reflect.ValueOf(&result).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		group := root.Field(i)
+		if group.Kind() != reflect.Ptr || group.IsNil() {
+			continue
+		}
+		group = group.Elem()
+		for j := 0; j < group.NumField(); j++ {
+			tag := group.Type().Field(j).Tag.Get("snmp")
+			id := strings.Split(tag, ",")[0]
+			if id == "" || !enabled[id] {
+				continue
+			}
+			delete(enabled, id)
+			field := group.Field(j)
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString("1")
+			case reflect.Int:
+				field.SetInt(1)
+			case reflect.Uint32:
+				field.SetUint(1)
+			}
+		}
+	}
+
+	if len(enabled) != 0 {
+		var unknown []string
+		for name := range enabled {
+			unknown = append(unknown, name)
+		}
+		sort.Strings(unknown)
+		return result, fmt.Errorf("unknown services: %s", strings.Join(unknown, ", "))
+	}
+
+	return result, nil
+}
+
+// 按负载百分比插值计算放电时间(分钟), 超出表范围时按两端线段外推
+func (b *DeviceBattery) RuntimeMinutes(load float64) float64 {
+	points := b.Runtime
+	switch len(points) {
+	case 0:
+		return 0
+	case 1:
+		return points[0].Minutes
+	}
+
+	i := sort.Search(len(points), func(i int) bool {
+		return points[i].Load >= load
+	})
+	if i == 0 {
+		i = 1
+	}
+	if i == len(points) {
+		i = len(points) - 1
+	}
+	p0 := points[i-1]
+	p1 := points[i]
+	if p1.Load == p0.Load {
+		return p0.Minutes
+	}
+	minutes := p0.Minutes + (p1.Minutes-p0.Minutes)/(p1.Load-p0.Load)*(load-p0.Load)
+	if minutes < 0 {
+		return 0
+	}
+	return minutes
+}
+
+// 按电池电压估算剩余电量 %
+func (b *DeviceBattery) Charge(voltage float64) float64 {
+	if b.FloatVoltage <= b.CutoffVoltage {
+		return 0
+	}
+	charge := (voltage - b.CutoffVoltage) / (b.FloatVoltage - b.CutoffVoltage) * 100
+	if charge > 100 {
+		return 100
+	}
+	if charge < 0 {
+		return 0
+	}
+	return charge
+}
+
+// 按设备配置生成 Device
+func NewDevice(profile *DeviceProfile) (Device, error) {
+	device, ok := deviceDrivers[profile.Driver]
+	if !ok {
+		return device, fmt.Errorf("unknown driver '%s'", profile.Driver)
+	}
+
+	enable, err := profileEnableService(profile.Services)
+	if err != nil {
+		return device, fmt.Errorf("profile %s: %s", profile.Name, err.Error())
+	}
+
+	commands := profile.Commands
+
+	device.Profile = profile
+	device.EnableService = enable
+
+	device.GetInfo = commands.GetInfo
+	device.GetRated = commands.GetRated
+	device.GetManufacturer = commands.GetManufacturer
+
+	device.Test = commands.Test
+	device.TestToBatteryLow = commands.TestToBatteryLow
+	device.TestWithMinimum = commands.TestWithMinimum
+
+	device.Poweroff = commands.Poweroff
+	device.PoweroffAndStart = commands.PoweroffAndStart
+
+	device.SwitchBuzz = commands.SwitchBuzz
+
+	device.CancelAllPoweroff = commands.CancelAllPoweroff
+	device.CancelAllTest = commands.CancelAllTest
+
+	device.ExtraGetInfo = commands.ExtraGetInfo
+	device.ExtraGetError = commands.ExtraGetError
+	device.ExtraGetTPInfo = commands.ExtraGetTPInfo
+	device.ExtraGetRated = commands.ExtraGetRated
+
+	return device, nil
+}
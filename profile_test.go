@@ -0,0 +1,145 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestParseDeviceProfile(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		yaml string
+		err  string // 为空时应解析成功
+	}{
+		{"minimal", "name: test\ndriver: single-phase\n", ""},
+		{"three-phase", "name: test\ndriver: three-phase\ndetect:\n  manufacturer: ^SANTAK\n", ""},
+		{"malformed", "name: test\ndriver: [single-phase\n", "yaml"},
+		{"wrong type", "name: test\ndriver: single-phase\nbattery:\n  runtime: 10\n", "yaml"},
+		{"empty name", "driver: single-phase\n", "profile name is empty"},
+		{"empty driver", "name: test\n", "unknown driver ''"},
+		{"unknown driver", "name: test\ndriver: dual-phase\n", "unknown driver 'dual-phase'"},
+		{"manufacturer regexp", "name: test\ndriver: single-phase\ndetect:\n  manufacturer: \"(\"\n", "profile test: error parsing regexp"},
+		{"model regexp", "name: test\ndriver: single-phase\ndetect:\n  model: \"[\"\n", "profile test: error parsing regexp"},
+	} {
+		profile, err := ParseDeviceProfile([]byte(test.yaml))
+		if test.err == "" {
+			if err != nil || profile == nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestParseDeviceProfileSortsRuntime(t *testing.T) {
+	profile, err := ParseDeviceProfile([]byte(`
+name: test
+driver: single-phase
+battery:
+  runtime:
+    - {load: 100, minutes: 3}
+    - {load: 25, minutes: 20}
+    - {load: 50, minutes: 9}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, load := range []float64{25, 50, 100} {
+		if profile.Battery.Runtime[i].Load != load {
+			t.Errorf("runtime[%d].load = %v, want %v", i, profile.Battery.Runtime[i].Load, load)
+		}
+	}
+}
+
+// 内置配置都能解析, 且启用的服务名都存在
+func TestBuiltinProfiles(t *testing.T) {
+	profiles, err := LoadDeviceProfiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) == 0 {
+		t.Fatal("no builtin profiles")
+	}
+	for _, profile := range profiles {
+		if _, err := NewDevice(profile); err != nil {
+			t.Errorf("%s: %s", profile.Name, err)
+		}
+	}
+	if _, err := LoadDeviceProfile("no-such-ups"); err == nil {
+		t.Error("unknown profile loaded")
+	}
+}
+
+func TestProfileEnableService(t *testing.T) {
+	enable, err := profileEnableService([]string{"upsBatteryVoltage", "upsTestId"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enable.Battery.Voltage == 0 || enable.Test.Id == "" {
+		t.Error("enabled service not set")
+	}
+	if enable.Battery.Current != 0 {
+		t.Error("disabled service set")
+	}
+
+	_, err = profileEnableService([]string{"upsBatteryVoltage", "upsBogus", "upsAlsoBogus"})
+	if err == nil || err.Error() != "unknown services: upsAlsoBogus, upsBogus" {
+		t.Errorf("unknown services: %v", err)
+	}
+}
+
+func TestBatteryRuntimeMinutes(t *testing.T) {
+	battery := DeviceBattery{Runtime: []RuntimePoint{{50, 10}, {100, 3.5}}}
+	for _, test := range []struct {
+		load    float64
+		minutes float64
+	}{
+		{0, 16.5}, // 低于表范围按第一段外推
+		{50, 10},
+		{75, 6.75},
+		{100, 3.5},
+		{125, 0.25}, // 超出表范围按最后一段外推
+		{150, 0},    // 不小于 0
+	} {
+		if got := battery.RuntimeMinutes(test.load); math.Abs(got-test.minutes) > 1e-9 {
+			t.Errorf("RuntimeMinutes(%v) = %v, want %v", test.load, got, test.minutes)
+		}
+	}
+
+	if got := (&DeviceBattery{}).RuntimeMinutes(50); got != 0 {
+		t.Errorf("empty table: %v", got)
+	}
+	if got := (&DeviceBattery{Runtime: []RuntimePoint{{50, 8}}}).RuntimeMinutes(90); got != 8 {
+		t.Errorf("single point: %v", got)
+	}
+	if got := (&DeviceBattery{Runtime: []RuntimePoint{{50, 8}, {50, 6}}}).RuntimeMinutes(90); got != 8 {
+		t.Errorf("same load: %v", got)
+	}
+}
+
+func TestBatteryCharge(t *testing.T) {
+	battery := DeviceBattery{FloatVoltage: 27.4, CutoffVoltage: 21.6}
+	for _, test := range []struct {
+		voltage float64
+		charge  float64
+	}{
+		{27.4, 100},
+		{30, 100},
+		{24.5, 50},
+		{21.6, 0},
+		{20, 0},
+	} {
+		if got := battery.Charge(test.voltage); math.Abs(got-test.charge) > 1e-9 {
+			t.Errorf("Charge(%v) = %v, want %v", test.voltage, got, test.charge)
+		}
+	}
+
+	// 浮充电压未配置或配置错误
+	if got := (&DeviceBattery{FloatVoltage: 21.6, CutoffVoltage: 21.6}).Charge(24); got != 0 {
+		t.Errorf("invalid voltages: %v", got)
+	}
+}
@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -80,6 +81,23 @@ type RatingInfo struct {
 	FrequencyRating float32
 }
 
+// UPS 基本信息
+// 输入：I<CR>
+// 输出：#Company_Name UPS_Model Version<CR>
+//
+//	#SANTAK          MT1000-PRO V1.0
+//
+// 信息段格式定义如下:
+// 公司名称:15 个字符
+// UPS 型号:10 个字符
+// 版本:10 个字符
+// 各信息段之间有一个空格符, 不足部分以空格补齐
+type UPSInfo struct {
+	Company string
+	Model   string
+	Version string
+}
+
 // -- 三进三出 --
 
 // G1<cr>
@@ -178,7 +196,11 @@ func ProtoParse(data string) (any, error) {
 	case QueryByteChar:
 		return ParseQueryResult(data)
 	case RatingByteChar:
-		return ParseRatingInfo(data)
+		// F 和 I 的应答都以 '#' 开头, F 固定为 4 个信息段
+		if result, err := ParseRatingInfo(data); err == nil {
+			return result, nil
+		}
+		return ParseUPSInfo(data)
 	case ExtraQueryByteChar:
 		return ParseExtra(data)
 	default:
@@ -191,6 +213,103 @@ func ProtoParse(data string) (any, error) {
 	}
 }
 
+// 命令对应应答的起始字符, 0 表示该命令没有应答
+func ReplyPrefix(cmd string) byte {
+	switch cmd {
+	case "Q1":
+		return QueryByteChar
+	case "F", "I":
+		return RatingByteChar
+	case "G1", "G2", "G3", "GF":
+		return ExtraQueryByteChar
+	}
+	return 0
+}
+
+// 应答的信息段是否符合命令的格式。
+// F 和 I、G1 至 GF 的起始字符相同, Query 用它丢弃上一条超时命令的迟到应答。
+func ReplyMatches(cmd string, reply string) bool {
+	prefix := ReplyPrefix(cmd)
+	if prefix == 0 {
+		return true
+	}
+	if len(reply) == 0 || reply[0] != prefix {
+		return false
+	}
+	split := strings.Split(reply[1:], " ")
+	switch cmd {
+	case "F":
+		return len(split) == 4 && isNumbers(split)
+	case "I":
+		return !ReplyMatches("F", reply)
+	case "G1":
+		return len(split) == 8 && isNumbers(split)
+	case "G2":
+		if len(split) != 3 {
+			return false
+		}
+		for _, group := range split {
+			if strings.Trim(group, "01") != "" {
+				return false
+			}
+		}
+		return true
+	case "G3":
+		if len(split) != 4 {
+			return false
+		}
+		for _, phases := range split {
+			if strings.Count(phases, "/") != 2 {
+				return false
+			}
+		}
+		return true
+	case "GF":
+		return len(split) == 8 && !isNumbers(split)
+	}
+	return true
+}
+
+func isNumbers(split []string) bool {
+	for _, s := range split {
+		if _, err := strconv.ParseFloat(s, 32); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// 按发送的命令解析应答, cmd 为空时按起始字符猜测类型
+func ProtoParseReply(cmd string, data string) (any, error) {
+	if cmd == "" {
+		return ProtoParse(data)
+	}
+	if len(data) == 0 {
+		return nil, errors.New("empty data")
+	}
+	if prefix := ReplyPrefix(cmd); prefix != 0 && data[0] != prefix {
+		return nil, errors.New("invalid data")
+	}
+	body := data[1:]
+	switch cmd {
+	case "Q1":
+		return ParseQueryResult(body)
+	case "F":
+		return ParseRatingInfo(body)
+	case "I":
+		return ParseUPSInfo(body)
+	case "G1":
+		return ParseExtraQueryResult(strings.Split(body, " "))
+	case "G2":
+		return ParseExtraQueryError(strings.Split(body, " "))
+	case "G3":
+		return ParseTPInfo(strings.Split(body, " "))
+	case "GF":
+		return ParseTPRating(strings.Split(body, " "))
+	}
+	return ProtoParse(data)
+}
+
 func ParseQueryResult(data string) (QueryResult, error) {
 	var result QueryResult
 	split := strings.Split(data, " ")
@@ -240,6 +359,26 @@ func ParseRatingInfo(data string) (RatingInfo, error) {
 	return result, nil
 }
 
+func ParseUPSInfo(data string) (UPSInfo, error) {
+	var result UPSInfo
+	if len(strings.TrimSpace(data)) == 0 {
+		return result, errors.New("invalid UPSInfo")
+	}
+	field := func(start int, end int) string {
+		if start >= len(data) {
+			return ""
+		}
+		if end > len(data) {
+			end = len(data)
+		}
+		return strings.TrimSpace(data[start:end])
+	}
+	result.Company = field(0, 15)
+	result.Model = field(16, 26)
+	result.Version = field(27, 37)
+	return result, nil
+}
+
 func ParseExtra(data string) (any, error) {
 	split := strings.Split(data, " ")
 	switch len(split) {
@@ -274,68 +413,58 @@ func ParseExtraQueryResult(split []string) (ExtraQueryResult, error) {
 	return result, nil
 }
 
+// G2 每组为 8 个字符, 第一个字符为最高位 x7
+func parseBits(group string) [8]bool {
+	var bits [8]bool
+	for i, c := range group {
+		bit := 7 - i
+		if bit < 0 {
+			break
+		}
+		bits[bit] = c == '1'
+	}
+	return bits
+}
+
 func ParseExtraQueryError(split []string) (ExtraQueryError, error) {
 	var result ExtraQueryError
 
 	if len(split) != 3 {
 		return result, errors.New("invalid ExtraQueryError")
 	}
-
-	// A 组
-	for i, c := range split[0] {
-		switch i {
-		case 0:
-			result.Rectifier = c == '1'
-		case 1:
-			result.BatteryLowProtection = c == '1'
-		case 2:
-			result.BatteryLow = c == '1'
-		case 3:
-			result.TPInOneOut = c == '1'
-		case 4:
-			result.BatterySupply = c == '1'
-		case 5:
-			result.BatteryEqualization = c == '1'
-		case 6:
-			result.RectifierRunning = c == '1'
+	for _, group := range split {
+		if len(group) != 8 {
+			return result, errors.New("invalid ExtraQueryError")
 		}
 	}
 
+	// A 组
+	a := parseBits(split[0])
+	result.Rectifier = a[6]
+	result.BatteryLowProtection = a[5]
+	result.BatteryLow = a[4]
+	result.TPInOneOut = a[3]
+	result.BatterySupply = a[2]
+	result.BatteryEqualization = a[1]
+	result.RectifierRunning = a[0]
+
 	// B 组
-	for i, c := range split[1] {
-		switch i {
-		case 0:
-			result.BypassFreqError = c == '1'
-		case 1:
-			result.ManualBypass = c == '1'
-		case 2:
-			result.BypassNomal = c == '1'
-		case 3:
-			result.StaticBypass = c == '1'
-		case 4:
-			result.InverterRunning = c == '1'
-		}
-	}
+	b := parseBits(split[1])
+	result.BypassFreqError = b[4]
+	result.ManualBypass = b[3]
+	result.BypassNomal = b[2]
+	result.StaticBypass = b[1]
+	result.InverterRunning = b[0]
 
 	// C 组
-	for i, c := range split[2] {
-		switch i {
-		case 0:
-			result.EmergencyStop = c == '1'
-		case 1:
-			result.BatteryInputHigh = c == '1'
-		case 2:
-			result.ManualBypassStop = c == '1'
-		case 3:
-			result.OverloadStop = c == '1'
-		case 4:
-			result.InverterOutputVoltage = c == '1'
-		case 5:
-			result.OverTemperature = c == '1'
-		case 6:
-			result.OutputShortCircuit = c == '1'
-		}
-	}
+	c := parseBits(split[2])
+	result.EmergencyStop = c[6]
+	result.BatteryInputHigh = c[5]
+	result.ManualBypassStop = c[4]
+	result.OverloadStop = c[3]
+	result.InverterOutputVoltage = c[2]
+	result.OverTemperature = c[1]
+	result.OutputShortCircuit = c[0]
 
 	return result, nil
 }
@@ -377,6 +506,16 @@ func ParseTPInfo(split []string) (TPInfo, error) {
 	result.OutputS = parseFloat(info[1])
 	result.OutputT = parseFloat(info[2])
 
+	info = strings.Split(split[3], "/")
+
+	if len(info) != 3 {
+		return result, errors.New("invalid TPInfo")
+	}
+
+	result.RPercent = parseFloat(info[0])
+	result.SPercent = parseFloat(info[1])
+	result.TPercent = parseFloat(info[2])
+
 	return result, nil
 }
 
@@ -402,3 +541,20 @@ func ParseTPRating(split []string) (TPRating, error) {
 
 	return result, nil
 }
+
+// 关机延时 S<n>
+// <n> 的范围是 .2, .3, ..., .9, 01, 02, ..., 10, 单位为分钟
+func FormatShutdownDelay(seconds int) string {
+	if seconds < 60 {
+		tenths := seconds / 6
+		if tenths < 2 {
+			tenths = 2
+		}
+		return fmt.Sprintf(".%d", tenths)
+	}
+	minutes := seconds / 60
+	if minutes > 10 {
+		minutes = 10
+	}
+	return fmt.Sprintf("%02d", minutes)
+}
@@ -0,0 +1,140 @@
+package main
+
+import "testing"
+
+// 应答样例取自 docs/科华(山特)通讯协议通讯内部标准
+func TestReplyMatches(t *testing.T) {
+	replies := map[string]string{
+		"Q1": "(228.0 228.0 228.4 006 50.2 27.4 25.0 00001000",
+		"F":  "#220.0 007 24.00 50.0",
+		"I":  "#SANTAK          MT1000-PRO V1.0",
+		"G1": "!240 094 0123 025.0 +35.0 50.1 52.0 50.0",
+		"G2": "!00000010 00000100 00000000",
+		"G3": "!222.0/222.0/222.0 221.0/221.0/221.0 220.0/220.0/220.0 014.0/015.0/014.0",
+		"GF": "!220V/380V^3P4W 050 220V/380V^3P4W 050 220V/3P3W^^^^^ 050 396 150KVA^^^^",
+	}
+	for cmd := range replies {
+		for replyCmd, reply := range replies {
+			if got := ReplyMatches(cmd, reply); got != (cmd == replyCmd) {
+				t.Errorf("ReplyMatches(%s, %s reply) = %v", cmd, replyCmd, got)
+			}
+		}
+	}
+	if !ReplyMatches("T", "") {
+		t.Error("command without reply rejected")
+	}
+}
+
+// G2 每组 8 位, 第一个字符为 x7。
+// 协议样例 "!00000010 00000100 00000000": 三进三出型 UPS, 对电池均充状态中(a1), 旁路交流电正常(b2)
+func TestParseExtraQueryError(t *testing.T) {
+	v, err := ProtoParseReply("G2", "!00000010 00000100 00000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := v.(ExtraQueryError); got != (ExtraQueryError{BatteryEqualization: true, BypassNomal: true}) {
+		t.Errorf("sample: %+v", got)
+	}
+
+	for _, test := range []struct {
+		reply string
+		want  ExtraQueryError
+	}{
+		{"!01000000 00000000 00000000", ExtraQueryError{Rectifier: true}},
+		{"!00000001 00000000 00000000", ExtraQueryError{RectifierRunning: true}},
+		{"!00001100 00000000 00000000", ExtraQueryError{TPInOneOut: true, BatterySupply: true}},
+		{"!00000000 00010000 00000000", ExtraQueryError{BypassFreqError: true}},
+		{"!00000000 00000011 00000000", ExtraQueryError{StaticBypass: true, InverterRunning: true}},
+		{"!00000000 00000000 01000000", ExtraQueryError{EmergencyStop: true}},
+		{"!00000000 00000000 00000001", ExtraQueryError{OutputShortCircuit: true}},
+		// x7 为保留位
+		{"!10000000 10000000 10000000", ExtraQueryError{}},
+	} {
+		v, err := ProtoParseReply("G2", test.reply)
+		if err != nil {
+			t.Errorf("%s: %s", test.reply, err)
+			continue
+		}
+		if got := v.(ExtraQueryError); got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.reply, got, test.want)
+		}
+	}
+
+	for _, reply := range []string{
+		"!00000010 00000100",
+		"!0000010 00000100 00000000",
+		"!00000010 00000100 000000000",
+	} {
+		if _, err := ProtoParseReply("G2", reply); err == nil {
+			t.Errorf("%s: accepted", reply)
+		}
+	}
+}
+
+// 其余命令的样例及说明同样取自协议文档
+func TestProtoParseReply(t *testing.T) {
+	for _, test := range []struct {
+		cmd   string
+		reply string
+		want  any
+	}{
+		{"Q1", "(228.0 228.0 228.4 017 50.0 27.4 25.0 00001001", QueryResult{
+			IPVoltage: 228, IPFaultVoltage: 228, OPVoltage: 228.4, OPCurrentPercent: 17,
+			IPFreq: 50, BatteryVoltage: 27.4, Temperature: 25,
+			Status: UPSStatus{UPSType: true, BuzzerActive: true},
+		}},
+		{"F", "#220.0 007 24.00 50.0", RatingInfo{
+			VoltageRating: 220, CurrentRating: 7, BatteryVoltage: 24, FrequencyRating: 50,
+		}},
+		{"I", "#SANTAK          MT1000-PRO V1.0", UPSInfo{
+			Company: "SANTAK", Model: "MT1000-PRO", Version: "V1.0",
+		}},
+		// 电池电压 240V, 剩余容量 94%, 剩余时间 123 分钟, 电流 25A, 35.0 度, 输入 50.1Hz, 旁路 52.0Hz, 输出 50.0Hz
+		{"G1", "!240 094 0123 025.0 +35.0 50.1 52.0 50.0", ExtraQueryResult{
+			BatteryVoltage: 240, BatteryCapacity: 94, BatteryTimeRemaining: 123, BatteryCurrent: 25,
+			Temperature: 35, IPFreq: 50.1, BypassFreq: 52, OPFreq: 50,
+		}},
+		// 输入 222V, 旁路 221V, 输出 220V, 负载 R 14% S 15% T 14%
+		{"G3", "!222.0/222.0/222.0 221.0/221.0/221.0 220.0/220.0/220.0 014.0/015.0/014.0", TPInfo{
+			InputR: 222, InputS: 222, InputT: 222,
+			BypassR: 221, BypassS: 221, BypassT: 221,
+			OutputR: 220, OutputS: 220, OutputT: 220,
+			RPercent: 14, SPercent: 15, TPercent: 14,
+		}},
+		// "^" 为补齐用的空格
+		{"GF", "!220V/380V^3P4W 050 220V/380V^3P4W 050 220V/3P3W^^^^^ 050 396 150KVA^^^^", TPRating{
+			RectifierInfo: "220V/380V 3P4W", RectifierFreq: 50,
+			BypassInfo: "220V/380V 3P4W", BypassFreq: 50,
+			OuputInfo: "220V/3P3W", OuputFreq: 50,
+			BatteryVoltage: 396, PowerRating: "150KVA",
+		}},
+	} {
+		got, err := ProtoParseReply(test.cmd, test.reply)
+		if err != nil {
+			t.Errorf("%s: %s", test.cmd, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("%s: %+v, want %+v", test.cmd, got, test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		cmd   string
+		reply string
+	}{
+		{"Q1", ""},
+		{"Q1", "#220.0 007 24.00 50.0"},
+		{"Q1", "(228.0 228.0 228.4 017 50.0 27.4 25.0"},
+		{"F", "#220.0 007 24.00"},
+		{"I", "#"},
+		{"G1", "!240 094 0123 025.0 +35.0 50.1 52.0"},
+		{"G3", "!222.0/222.0 221.0/221.0/221.0 220.0/220.0/220.0 014.0/015.0/014.0"},
+		{"G3", "!222.0/222.0/222.0 221.0/221.0/221.0 220.0/220.0/220.0 014.0/015.0"},
+		{"GF", "!220V/380V^3P4W 050 220V/380V^3P4W 050"},
+	} {
+		if _, err := ProtoParseReply(test.cmd, test.reply); err == nil {
+			t.Errorf("%s: %q accepted", test.cmd, test.reply)
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+func openPty() (*os.File, *os.File, string, error) {
+	return nil, nil, "", errors.New("pty is only supported on linux, use --port with a null-modem cable")
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// 告警规则。
+// 每条规则把一个读数表达式映射到 upsWellKnownAlarms 中的告警, 每次 Q1 轮询后计算:
+// 条件持续 For 后产生告警, 清除条件持续 ClearFor 后清除。
+// 表达式中的读数为 SNMP 原始值 (如 upsBatteryVoltage 单位为 0.1V), 表的列写作 upsInputVoltage.1。
+
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+type AlarmRuleConfig struct {
+	Name     string
+	Alarm    string        // upsWellKnownAlarms 中的告警名
+	Expr     string        // 产生告警的条件
+	Clear    string        // 清除告警的条件, 为空时为 Expr 不成立
+	For      time.Duration // 条件持续多久后产生告警
+	ClearFor time.Duration // 清除条件持续多久后清除告警
+	Severity string        // info / warning / critical, 默认 warning
+}
+
+type AlarmRule struct {
+	Config *AlarmRuleConfig
+
+	expr  ruleExpr
+	clear ruleExpr
+
+	Active  bool
+	pending time.Time // 条件开始成立的时间, 零值表示条件不成立
+	err     string    // 最近一次计算的错误, 避免重复日志
+}
+
+type AlarmRules struct {
+	Rules []*AlarmRule
+	Snmp  *SNMP
+
+	now func() time.Time
+}
+
+// 解析并检查规则
+func NewAlarmRules(snmp *SNMP, configs []AlarmRuleConfig) (*AlarmRules, error) {
+	rules := &AlarmRules{Snmp: snmp, now: time.Now}
+	alarmsOID := snmp.GetOID("upsWellKnownAlarms", -1) + "."
+	for i, config := range configs {
+		config := config
+		if config.Name == "" {
+			config.Name = fmt.Sprintf("%s#%d", config.Alarm, i+1)
+		}
+		if config.Severity == "" {
+			config.Severity = SeverityWarning
+		}
+		switch config.Severity {
+		case SeverityInfo, SeverityWarning, SeverityCritical:
+		default:
+			return nil, fmt.Errorf("rule %s: invalid severity '%s'", config.Name, config.Severity)
+		}
+		oid, err := snmp.Mib.OID(config.Alarm)
+		if err != nil || !strings.HasPrefix("."+oid.String(), alarmsOID) {
+			return nil, fmt.Errorf("rule %s: '%s' is not in upsWellKnownAlarms", config.Name, config.Alarm)
+		}
+
+		rule := &AlarmRule{Config: &config}
+		rule.expr, err = parseRuleExpr(snmp, config.Expr)
+		if err != nil {
+			return nil, fmt.Errorf("rule %s: %w", config.Name, err)
+		}
+		if config.Clear != "" {
+			rule.clear, err = parseRuleExpr(snmp, config.Clear)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: clear: %w", config.Name, err)
+			}
+		}
+		rules.Rules = append(rules.Rules, rule)
+	}
+	return rules, nil
+}
+
+// 计算所有规则, 返回各规则告警应处的状态。调用方需持有 Snmp.Lock
+func (r *AlarmRules) Evaluate() []AlarmState {
+	if r == nil {
+		return nil
+	}
+	now := r.now()
+	var states []AlarmState
+	for _, rule := range r.Rules {
+		rule.evaluate(r.Snmp, now)
+		states = append(states, AlarmState{Name: rule.Config.Alarm, Active: rule.Active})
+	}
+	return states
+}
+
+func (rule *AlarmRule) evaluate(snmp *SNMP, now time.Time) {
+	get := func(name string, index int) (float64, error) {
+		value, err := snmp.GetValue(name, index)
+		if err != nil {
+			return 0, err
+		}
+		v, ok := metricValue(value)
+		if !ok {
+			return 0, fmt.Errorf("%s is not a number", name)
+		}
+		return v, nil
+	}
+
+	// 条件无法计算 (如读数未启用) 时保持当前状态
+	expr, hold := rule.expr, rule.Config.For
+	if rule.Active {
+		expr, hold = rule.clear, rule.Config.ClearFor
+	}
+	var met bool
+	if expr == nil {
+		v, err := rule.expr.eval(get)
+		if rule.logError(err) {
+			return
+		}
+		met = v == 0
+	} else {
+		v, err := expr.eval(get)
+		if rule.logError(err) {
+			return
+		}
+		met = v != 0
+	}
+
+	if !met {
+		rule.pending = time.Time{}
+		return
+	}
+	if rule.pending.IsZero() {
+		rule.pending = now
+	}
+	if now.Sub(rule.pending) < hold {
+		return
+	}
+	rule.pending = time.Time{}
+	rule.Active = !rule.Active
+
+	action := "cleared"
+	if rule.Active {
+		action = "raised"
+	}
+	log := Logger.Infof
+	if rule.Active {
+		switch rule.Config.Severity {
+		case SeverityWarning:
+			log = Logger.Warnf
+		case SeverityCritical:
+			log = Logger.Errorf
+		}
+	}
+	log("Rule %s %s %s (%s)", rule.Config.Name, action, rule.Config.Alarm, rule.Config.Severity)
+}
+
+// 记录计算错误, 同样的错误只记录一次, 返回是否有错误
+func (rule *AlarmRule) logError(err error) bool {
+	if err == nil {
+		rule.err = ""
+		return false
+	}
+	if err.Error() != rule.err {
+		rule.err = err.Error()
+		Logger.Warnf("Rule %s: %s", rule.Config.Name, rule.err)
+	}
+	return true
+}
+
+// 表达式, 布尔值以 1 / 0 表示
+type ruleExpr interface {
+	eval(get func(name string, index int) (float64, error)) (float64, error)
+}
+
+type ruleNumber float64
+
+type ruleValue struct {
+	Name  string
+	Index int
+}
+
+type ruleUnary struct {
+	Op string
+	X  ruleExpr
+}
+
+type ruleBinary struct {
+	Op   string
+	X, Y ruleExpr
+}
+
+func (n ruleNumber) eval(get func(name string, index int) (float64, error)) (float64, error) {
+	return float64(n), nil
+}
+
+func (v ruleValue) eval(get func(name string, index int) (float64, error)) (float64, error) {
+	return get(v.Name, v.Index)
+}
+
+func ruleBool(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func (u ruleUnary) eval(get func(name string, index int) (float64, error)) (float64, error) {
+	x, err := u.X.eval(get)
+	if err != nil {
+		return 0, err
+	}
+	if u.Op == "!" {
+		return ruleBool(x == 0), nil
+	}
+	return -x, nil
+}
+
+func (b ruleBinary) eval(get func(name string, index int) (float64, error)) (float64, error) {
+	x, err := b.X.eval(get)
+	if err != nil {
+		return 0, err
+	}
+	// 短路
+	if b.Op == "&&" && x == 0 {
+		return 0, nil
+	}
+	if b.Op == "||" && x != 0 {
+		return 1, nil
+	}
+	y, err := b.Y.eval(get)
+	if err != nil {
+		return 0, err
+	}
+	switch b.Op {
+	case "&&", "||":
+		return ruleBool(y != 0), nil
+	case "<":
+		return ruleBool(x < y), nil
+	case "<=":
+		return ruleBool(x <= y), nil
+	case ">":
+		return ruleBool(x > y), nil
+	case ">=":
+		return ruleBool(x >= y), nil
+	case "==":
+		return ruleBool(x == y), nil
+	case "!=":
+		return ruleBool(x != y), nil
+	case "+":
+		return x + y, nil
+	case "-":
+		return x - y, nil
+	case "*":
+		return x * y, nil
+	case "/":
+		if y == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return x / y, nil
+	}
+	return 0, fmt.Errorf("invalid operator %s", b.Op)
+}
+
+// 按优先级从低到高
+var ruleBinaryOps = [][]string{
+	{"||"},
+	{"&&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"+", "-"},
+	{"*", "/"},
+}
+
+type ruleParser struct {
+	snmp   *SNMP
+	tokens []string
+	pos    int
+}
+
+// 解析表达式, 读数名必须在 MIB 中存在
+func parseRuleExpr(snmp *SNMP, text string) (ruleExpr, error) {
+	tokens, err := tokenizeRuleExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("empty expression")
+	}
+	p := &ruleParser{snmp: snmp, tokens: tokens}
+	expr, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected '%s' in '%s'", p.tokens[p.pos], text)
+	}
+	return expr, nil
+}
+
+func tokenizeRuleExpr(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			j := i
+			for j < len(text) && (unicode.IsDigit(rune(text[j])) || text[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		case unicode.IsLetter(c):
+			j := i
+			for j < len(text) && (unicode.IsLetter(rune(text[j])) || unicode.IsDigit(rune(text[j])) || text[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		default:
+			if i+1 < len(text) {
+				switch text[i : i+2] {
+				case "&&", "||", "<=", ">=", "==", "!=":
+					tokens = append(tokens, text[i:i+2])
+					i += 2
+					continue
+				}
+			}
+			if !strings.ContainsRune("()<>+-*/!", c) {
+				return nil, fmt.Errorf("invalid character '%c' in '%s'", c, text)
+			}
+			tokens = append(tokens, string(c))
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func (p *ruleParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *ruleParser) binary(level int) (ruleExpr, error) {
+	if level == len(ruleBinaryOps) {
+		return p.unary()
+	}
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		found := false
+		for _, o := range ruleBinaryOps[level] {
+			if op == o {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return x, nil
+		}
+		p.pos++
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = ruleBinary{Op: op, X: x, Y: y}
+	}
+}
+
+func (p *ruleParser) unary() (ruleExpr, error) {
+	token := p.peek()
+	if token == "" {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	p.pos++
+	switch {
+	case token == "!" || token == "-":
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return ruleUnary{Op: token, X: x}, nil
+	case token == "(":
+		x, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, fmt.Errorf("missing ')'")
+		}
+		p.pos++
+		return x, nil
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		v, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%s'", token)
+		}
+		return ruleNumber(v), nil
+	case unicode.IsLetter(rune(token[0])):
+		name, index := token, 0
+		if i := strings.IndexByte(token, '.'); i >= 0 {
+			n, err := strconv.Atoi(token[i+1:])
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid index in '%s'", token)
+			}
+			name, index = token[:i], n
+		}
+		if _, err := p.snmp.Mib.OID(name); err != nil {
+			return nil, fmt.Errorf("unknown object '%s'", name)
+		}
+		return ruleValue{Name: name, Index: index}, nil
+	}
+	return nil, fmt.Errorf("unexpected '%s'", token)
+}
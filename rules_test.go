@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRuleExpr(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	values := map[string]float64{
+		"upsBatteryTemperature":             42,
+		"upsOutputPercentLoad.1":            85,
+		"upsInputVoltage.1":                 160,
+		"upsConfigLowVoltageTransferPoint":  173,
+		"upsConfigHighVoltageTransferPoint": 273,
+	}
+	get := func(name string, index int) (float64, error) {
+		v, ok := values[alarmHistoryReadingKey(name, index)]
+		if !ok {
+			return 0, fmt.Errorf("%s.%d not found", name, index)
+		}
+		return v, nil
+	}
+
+	tests := []struct {
+		expr string
+		want float64
+	}{
+		{"upsBatteryTemperature > 40", 1},
+		{"upsBatteryTemperature >= 42 && upsOutputPercentLoad.1 < 80", 0},
+		{"upsInputVoltage.1 < upsConfigLowVoltageTransferPoint || upsInputVoltage.1 > upsConfigHighVoltageTransferPoint", 1},
+		{"!(upsOutputPercentLoad.1 > 80)", 0},
+		{"1 + 2 * 3 == 7", 1},
+		{"(1 + 2) * 3", 9},
+		{"-upsBatteryTemperature + 2.5", -39.5},
+		{"upsBatteryTemperature / 2 != 21", 0},
+		// 短路时不读取右侧的读数
+		{"upsBatteryTemperature > 50 && upsBatteryVoltage > 0", 0},
+	}
+	for _, test := range tests {
+		expr, err := parseRuleExpr(snmp, test.expr)
+		if err != nil {
+			t.Errorf("%s: %s", test.expr, err)
+			continue
+		}
+		got, err := expr.eval(get)
+		if err != nil || got != test.want {
+			t.Errorf("%s = %v %v, want %v", test.expr, got, err, test.want)
+		}
+	}
+
+	for _, text := range []string{"", "upsBatteryTemperature >", "(1 + 2", "upsNoSuchObject > 1", "upsInputVoltage.0 > 1", "1 2", "a $ b"} {
+		if _, err := parseRuleExpr(snmp, text); err == nil {
+			t.Errorf("%q parsed", text)
+		}
+	}
+	expr, _ := parseRuleExpr(snmp, "upsBatteryVoltage > 0")
+	if _, err := expr.eval(get); err == nil {
+		t.Error("missing reading evaluated")
+	}
+}
+
+// 条件持续 for 后产生告警, 回到清除阈值以下并持续 clear-for 后清除
+func TestAlarmRules(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	rules, err := NewAlarmRules(snmp, []AlarmRuleConfig{{
+		Alarm:    "upsAlarmTempBad",
+		Expr:     "upsBatteryTemperature > 40",
+		Clear:    "upsBatteryTemperature < 35",
+		For:      30 * time.Second,
+		ClearFor: 10 * time.Second,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	rules.now = func() time.Time { return now }
+	alarm.Rules = rules
+
+	steps := []struct {
+		after  time.Duration
+		temp   float64
+		active bool
+	}{
+		{0, 45, false},
+		{20 * time.Second, 45, false},
+		{5 * time.Second, 38, false}, // 中断后重新计时
+		{time.Second, 45, false},
+		{30 * time.Second, 45, true},
+		{time.Second, 38, true}, // 高于清除阈值
+		{time.Second, 30, true},
+		{9 * time.Second, 30, true},
+		{time.Second, 30, false},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		serialReceived(snmp, "Q1", fmt.Sprintf("(228.0 228.0 228.4 017 50.0 27.1 %04.1f 00001000", step.temp))
+		snmp.Lock.Lock()
+		active := alarm.Exist("upsAlarmTempBad")
+		snmp.Lock.Unlock()
+		if active != step.active {
+			t.Fatalf("step %d: upsAlarmTempBad %v, want %v", i, active, step.active)
+		}
+	}
+}
+
+// 规则与状态位产生的同一告警合并, 任一方成立即有效
+func TestAlarmRulesMerge(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	rules, err := NewAlarmRules(snmp, []AlarmRuleConfig{{
+		Alarm: "upsAlarmOutputOverload",
+		Expr:  "upsOutputPercentLoad.1 > 80",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alarm.Rules = rules
+
+	for _, step := range []struct {
+		load   int
+		active bool
+	}{{50, false}, {85, true}, {130, true}, {79, false}} {
+		serialReceived(snmp, "Q1", fmt.Sprintf("(228.0 228.0 228.4 %03d 50.0 27.1 25.0 00001000", step.load))
+		snmp.Lock.Lock()
+		active := alarm.Exist("upsAlarmOutputOverload")
+		snmp.Lock.Unlock()
+		if active != step.active {
+			t.Fatalf("load %d: upsAlarmOutputOverload %v, want %v", step.load, active, step.active)
+		}
+	}
+}
+
+func TestAlarmRulesInvalid(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	for _, config := range []AlarmRuleConfig{
+		{Alarm: "upsBatteryTemperature", Expr: "1"},
+		{Alarm: "upsAlarmNoSuchAlarm", Expr: "1"},
+		{Alarm: "upsAlarmTempBad", Expr: "upsBatteryTemperature >"},
+		{Alarm: "upsAlarmTempBad", Expr: "1", Clear: "("},
+		{Alarm: "upsAlarmTempBad", Expr: "1", Severity: "fatal"},
+	} {
+		if _, err := NewAlarmRules(snmp, []AlarmRuleConfig{config}); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 通知的最小发送间隔。
+// 状态持续期间重复发送的通知 (如 upsTrapOnBattery) 在间隔内只发送一次,
+// 状态结束后调用 Reset, 下次进入该状态时立即发送。
+
+// 经过 ScheduleTrap 发送的通知及默认间隔, trap-interval 只能配置这些通知。
+// RFC 1628: upsTrapOnBattery 在电池供电期间每分钟最多发送一次
+var defaultTrapIntervals = map[string]time.Duration{
+	"upsTrapOnBattery": time.Minute,
+}
+
+type TrapScheduler struct {
+	Intervals map[string]time.Duration // 通知名 -> 最小间隔, 未配置时不限制
+
+	lock sync.Mutex
+	last map[string]time.Time
+	now  func() time.Time
+}
+
+// 以默认间隔为基础, intervals 中的同名项覆盖默认值
+func NewTrapScheduler(intervals map[string]time.Duration) *TrapScheduler {
+	s := &TrapScheduler{
+		Intervals: map[string]time.Duration{},
+		last:      map[string]time.Time{},
+		now:       time.Now,
+	}
+	for name, interval := range defaultTrapIntervals {
+		s.Intervals[name] = interval
+	}
+	for name, interval := range intervals {
+		s.Intervals[name] = interval
+	}
+	return s
+}
+
+// 检查配置的通知名, 其它通知 (如 upsTrapAlarmEntryAdded) 每次都发送, 不能限制间隔
+func CheckTrapIntervals(intervals map[string]time.Duration) error {
+	var unknown []string
+	for name := range intervals {
+		if _, ok := defaultTrapIntervals[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	var supported []string
+	for name := range defaultTrapIntervals {
+		supported = append(supported, name)
+	}
+	sort.Strings(supported)
+	return fmt.Errorf("unsupported traps %s, only %s can be rate limited", strings.Join(unknown, ", "), strings.Join(supported, ", "))
+}
+
+// 判断现在是否可以发送, 可以时记录发送时间
+func (s *TrapScheduler) Due(name string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	interval := s.Intervals[name]
+	if interval <= 0 {
+		return true
+	}
+	now := s.now()
+	if last, ok := s.last[name]; ok && now.Sub(last) < interval {
+		return false
+	}
+	s.last[name] = now
+	return true
+}
+
+// 状态结束, 下次立即发送
+func (s *TrapScheduler) Reset(name string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.last, name)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTrapScheduler(t *testing.T) {
+	scheduler := NewTrapScheduler(map[string]time.Duration{
+		"upsTrapTestCompleted":   10 * time.Second,
+		"upsTrapAlarmEntryAdded": 0,
+	})
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	scheduler.now = func() time.Time { return now }
+
+	steps := []struct {
+		after time.Duration
+		name  string
+		reset bool
+		due   bool
+	}{
+		{0, "upsTrapOnBattery", false, true},
+		{time.Second, "upsTrapOnBattery", false, false},
+		{58 * time.Second, "upsTrapOnBattery", false, false},
+		{time.Second, "upsTrapOnBattery", false, true},
+		{time.Second, "upsTrapOnBattery", true, true},
+		{0, "upsTrapOnBattery", false, false},
+		{0, "upsTrapTestCompleted", false, true},
+		{5 * time.Second, "upsTrapTestCompleted", false, false},
+		{5 * time.Second, "upsTrapTestCompleted", false, true},
+		{0, "upsTrapAlarmEntryAdded", false, true},
+		{0, "upsTrapAlarmEntryAdded", false, true},
+	}
+	for i, step := range steps {
+		now = now.Add(step.after)
+		if step.reset {
+			scheduler.Reset(step.name)
+		}
+		if due := scheduler.Due(step.name); due != step.due {
+			t.Fatalf("step %d: %s due %v, want %v", i, step.name, due, step.due)
+		}
+	}
+}
+
+func TestCheckTrapIntervals(t *testing.T) {
+	if err := CheckTrapIntervals(map[string]time.Duration{"upsTrapOnBattery": 0}); err != nil {
+		t.Fatal(err)
+	}
+	err := CheckTrapIntervals(map[string]time.Duration{
+		"upsTrapOnBattery":       time.Minute,
+		"upsTrapTestCompleted":   time.Minute,
+		"upsTrapAlarmEntryAdded": time.Minute,
+	})
+	want := "unsupported traps upsTrapAlarmEntryAdded, upsTrapTestCompleted, only upsTrapOnBattery can be rate limited"
+	if err == nil || err.Error() != want {
+		t.Fatalf("error %v, want %q", err, want)
+	}
+}
@@ -1,77 +1,315 @@
 package main
 
-import "go.bug.st/serial"
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// 重新打开串口的退避时间
+const (
+	reconnectMinDelay = time.Second
+	reconnectMaxDelay = 30 * time.Second
+)
+
+var (
+	ErrDisconnected   = errors.New("disconnected")
+	ErrTimeout        = errors.New("timeout")
+	ErrInvalidCommand = errors.New("invalid command") // UPS 原样返回了命令
+	ErrNoData         = errors.New("no data")         // UPS 返回 "@"
+)
+
+// QueryError 记录出错的命令
+type QueryError struct {
+	Cmd string
+	Err error
+}
+
+func (e *QueryError) Error() string {
+	return "query '" + e.Cmd + "': " + e.Err.Error()
+}
+
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
 
 type TTYConfig struct {
 	Port string
 
-	Received func(userData any, value string)
+	Open func(port string) (io.ReadWriteCloser, error) // 为空时按 2400 8N1 打开串口
+
+	Timeout time.Duration // Query 默认超时
+
+	// 重新打开串口的退避时间, 为空时使用 reconnectMinDelay / reconnectMaxDelay
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+
+	Capture *Capture // 不为空时录制收发的每一行
+
+	// cmd 为产生该应答的命令, 非 Query 收到的行 cmd 为空
+	Received func(userData any, cmd string, value string)
 }
 
 type TTY struct {
-	Serial   serial.Port
+	Serial   io.ReadWriteCloser
+	Reader   *bufio.Reader
 	UserData any
+	Config   TTYConfig
+
+	portLock sync.Mutex
+	closed   bool
+
+	lock        sync.Mutex // 保证同一时间只有一条命令在等待应答
+	pending     chan string
+	pendingLock sync.Mutex
 }
 
 func (tty *TTY) Close() error {
+	tty.portLock.Lock()
+	defer tty.portLock.Unlock()
+	tty.closed = true
+	if tty.Serial == nil {
+		return nil
+	}
 	return tty.Serial.Close()
 }
 
+func (tty *TTY) port() io.ReadWriteCloser {
+	tty.portLock.Lock()
+	defer tty.portLock.Unlock()
+	return tty.Serial
+}
+
+func (tty *TTY) isClosed() bool {
+	tty.portLock.Lock()
+	defer tty.portLock.Unlock()
+	return tty.closed
+}
+
+// 关闭当前串口, 读取协程会按退避时间重新打开
+func (tty *TTY) Reconnect() {
+	tty.portLock.Lock()
+	defer tty.portLock.Unlock()
+	if tty.Serial == nil {
+		return
+	}
+	Logger.Warnf("Close port '%s' for reconnect", tty.Config.Port)
+	tty.Serial.Close()
+	tty.Serial = nil
+}
+
+func (tty *TTY) open() error {
+	s, err := tty.Config.Open(tty.Config.Port)
+	if err != nil {
+		return err
+	}
+	tty.portLock.Lock()
+	defer tty.portLock.Unlock()
+	if tty.closed {
+		s.Close()
+		return ErrDisconnected
+	}
+	tty.Serial = s
+	tty.Reader = bufio.NewReader(s)
+	return nil
+}
+
+// 一直尝试打开串口, 直到成功或 TTY 被关闭
+func (tty *TTY) reopen() {
+	delay := tty.Config.ReconnectMinDelay
+	for !tty.isClosed() {
+		err := tty.open()
+		if err == nil {
+			Logger.Infof("Port '%s' opened", tty.Config.Port)
+			return
+		}
+		Logger.Errorf("Open port '%s' faild: %s, retry in %s", tty.Config.Port, err.Error(), delay)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > tty.Config.ReconnectMaxDelay {
+			delay = tty.Config.ReconnectMaxDelay
+		}
+	}
+}
+
 func (tty *TTY) SetUserData(value any) {
+	tty.portLock.Lock()
+	defer tty.portLock.Unlock()
 	tty.UserData = value
 }
 
+func (tty *TTY) userData() any {
+	tty.portLock.Lock()
+	defer tty.portLock.Unlock()
+	return tty.UserData
+}
+
+func (tty *TTY) write(value string) error {
+	port := tty.port()
+	if port == nil {
+		return ErrDisconnected
+	}
+	Logger.Debugf("tty send: %s", value)
+	tty.Config.Capture.Record(CaptureSend, value)
+	_, err := port.Write([]byte(value + "\r"))
+	return err
+}
+
+// 发送不需要应答的命令
 func (tty *TTY) Send(value string) error {
 	if value == "" {
 		return nil
 	}
-	Logger.Debugf("tty send: %s", value)
-	_, err := tty.Serial.Write([]byte(value + "\r"))
-	return err
+	tty.lock.Lock()
+	defer tty.lock.Unlock()
+	return tty.write(value)
 }
 
-func serialReadLine(tty *TTY) string {
-	buf := make([]byte, 128)
-	result := make([]byte, 0)
+// 发送命令并等待对应的应答行。
+// UPS 原样返回命令时返回 ErrInvalidCommand, 返回 "@" 时返回 ErrNoData。
+func (tty *TTY) Query(cmd string, timeout time.Duration) (string, error) {
+	if cmd == "" {
+		return "", &QueryError{Cmd: cmd, Err: ErrInvalidCommand}
+	}
+	if timeout <= 0 {
+		timeout = tty.Config.Timeout
+	}
+
+	tty.lock.Lock()
+	defer tty.lock.Unlock()
+
+	ch := make(chan string, 8)
+	tty.pendingLock.Lock()
+	tty.pending = ch
+	tty.pendingLock.Unlock()
+	defer func() {
+		tty.pendingLock.Lock()
+		tty.pending = nil
+		tty.pendingLock.Unlock()
+	}()
+
+	err := tty.write(cmd)
+	if err != nil {
+		return "", &QueryError{Cmd: cmd, Err: err}
+	}
+
+	prefix := ReplyPrefix(cmd)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
 	for {
-		n, err := tty.Serial.Read(buf[0:])
-		if err != nil {
-			if err.Error() == "The handle is invalid." {
-				return ""
+		select {
+		case line := <-ch:
+			if line == cmd {
+				return "", &QueryError{Cmd: cmd, Err: ErrInvalidCommand}
 			}
-			Logger.Errorf("read err: %s", err.Error())
-			break
+			if line == "@" {
+				return "", &QueryError{Cmd: cmd, Err: ErrNoData}
+			}
+			if prefix != 0 {
+				i := strings.IndexByte(line, prefix)
+				if i >= 0 {
+					line = line[i:]
+				}
+				if i < 0 || !ReplyMatches(cmd, line) {
+					// 上一条超时命令的迟到应答
+					Logger.Debugf("tty drop: %s", line)
+					continue
+				}
+			}
+			return line, nil
+		case <-deadline.C:
+			return "", &QueryError{Cmd: cmd, Err: ErrTimeout}
 		}
-		if string(buf[0:n]) == "\r" {
-			break
+	}
+}
+
+// Query 并把应答交给 Received 处理
+func (tty *TTY) Poll(cmd string, timeout time.Duration) error {
+	if cmd == "" {
+		return nil
+	}
+	value, err := tty.Query(cmd, timeout)
+	if err != nil {
+		return err
+	}
+	if tty.Config.Received != nil {
+		tty.Config.Received(tty.userData(), cmd, value)
+	}
+	return nil
+}
+
+func (tty *TTY) dispatch(value string) {
+	tty.pendingLock.Lock()
+	ch := tty.pending
+	tty.pendingLock.Unlock()
+	if ch != nil {
+		select {
+		case ch <- value:
+		default:
+			Logger.Warnf("tty drop: %s", value)
 		}
-		result = append(result, buf[:n]...)
+		return
+	}
+	if tty.Config.Received != nil {
+		tty.Config.Received(tty.userData(), "", value)
+	}
+}
+
+func serialReadLine(tty *TTY) (string, error) {
+	result, err := tty.Reader.ReadString(EndByteChar)
+	if err != nil {
+		return "", err
 	}
+	result = strings.Trim(result, "\r\n")
 	if len(result) == 0 {
-		return ""
+		return "", nil
 	}
-	Logger.Debugf("tty recv: %s", string(result))
-	return string(result)
+	Logger.Debugf("tty recv: %s", result)
+	tty.Config.Capture.Record(CaptureRecv, result)
+	return result, nil
 }
 
-func serialInit(config TTYConfig) (*TTY, error) {
+func serialOpen(port string) (io.ReadWriteCloser, error) {
 	mode := &serial.Mode{
 		BaudRate: 2400,
 		DataBits: 8,
 		Parity:   serial.NoParity,
 		StopBits: serial.OneStopBit,
 	}
+	return serial.Open(port, mode)
+}
 
-	Logger.Infof("Try open port: '%s'", config.Port)
-
-	s, err := serial.Open(config.Port, mode)
-	if err != nil {
-		Logger.Fatalf("Open port faild: %s", err.Error())
-		return nil, err
+func serialInit(config TTYConfig) (*TTY, error) {
+	if config.Timeout <= 0 {
+		config.Timeout = time.Second
+	}
+	if config.Open == nil {
+		config.Open = serialOpen
+	}
+	if config.ReconnectMinDelay <= 0 {
+		config.ReconnectMinDelay = reconnectMinDelay
+	}
+	if config.ReconnectMaxDelay <= 0 {
+		config.ReconnectMaxDelay = reconnectMaxDelay
+	}
+	if config.ReconnectMaxDelay < config.ReconnectMinDelay {
+		config.ReconnectMaxDelay = config.ReconnectMinDelay
 	}
 
 	ret := &TTY{
-		Serial: s,
+		Config: config,
+	}
+
+	Logger.Infof("Try open port: '%s'", config.Port)
+
+	err := ret.open()
+	if err != nil {
+		Logger.Errorf("Open port faild: %s", err.Error())
 	}
 
 	go func() {
@@ -81,9 +319,24 @@ func serialInit(config TTYConfig) (*TTY, error) {
 				Logger.Infof("Received signal. Stopping read operation...")
 				return
 			default:
-				result := serialReadLine(ret)
+				if ret.port() == nil {
+					if ret.isClosed() {
+						return
+					}
+					ret.reopen()
+					continue
+				}
+				result, err := serialReadLine(ret)
+				if err != nil {
+					if ret.isClosed() {
+						return
+					}
+					Logger.Errorf("read err: %s", err.Error())
+					ret.Reconnect()
+					continue
+				}
 				if len(result) != 0 {
-					config.Received(ret.UserData, result)
+					ret.dispatch(result)
 				}
 			}
 		}
@@ -98,14 +351,57 @@ func createSerialSend(tty *TTY) func(value string) {
 	}
 }
 
-func serialReceived(userData any, value string) {
+func serialReceived(userData any, cmd string, value string) {
 	if userData == nil {
 		// Linux receiving too fast
 		return
 	}
 	snmp := userData.(*SNMP)
-	err := snmp.Device.OnReceive(snmp, data, value)
+	snmp.Lock.Lock()
+	defer snmp.Lock.Unlock()
+	err := snmp.Device.OnReceive(snmp, data, cmd, value)
 	if err != nil {
-		Logger.Errorf("OnReceive data: %s, err: %s", value, err.Error())
+		Logger.Errorf("OnReceive cmd: %s, data: %s, err: %s", cmd, value, err.Error())
+	}
+}
+
+// Watchdog 检测通讯中断
+// 协议规定连续 10 秒无应答认为通讯链路中断
+type Watchdog struct {
+	Timeout  time.Duration
+	LastSeen time.Time
+	Lost     bool
+
+	OnLost    func()
+	OnRestore func()
+}
+
+// 收到有效应答时调用
+func (w *Watchdog) Feed() {
+	w.LastSeen = time.Now()
+	if w.Lost {
+		w.Lost = false
+		Logger.Infof("Communication restored")
+		if w.OnRestore != nil {
+			w.OnRestore()
+		}
+	}
+}
+
+// 每次轮询后调用
+func (w *Watchdog) Check() {
+	if w.Lost {
+		return
+	}
+	if w.LastSeen.IsZero() {
+		w.LastSeen = time.Now()
+	}
+	if time.Since(w.LastSeen) < w.Timeout {
+		return
+	}
+	w.Lost = true
+	Logger.Errorf("Communication lost, no reply for %s", w.Timeout)
+	if w.OnLost != nil {
+		w.OnLost()
 	}
 }
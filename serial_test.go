@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 通过 Open 接入模拟 UPS, handle 返回每条命令的应答行
+func newTestTTY(t *testing.T, config TTYConfig, handle func(cmd string) []string) *TTY {
+	t.Helper()
+
+	ups, port := net.Pipe()
+	go func() {
+		reader := bufio.NewReader(ups)
+		for {
+			cmd, err := reader.ReadString('\r')
+			if err != nil {
+				return
+			}
+			for _, line := range handle(strings.TrimSuffix(cmd, "\r")) {
+				if _, err := ups.Write([]byte(line + "\r")); err != nil {
+					return
+				}
+			}
+		}
+	}()
+
+	config.Port = "test"
+	config.Open = func(string) (io.ReadWriteCloser, error) { return port, nil }
+	if config.Timeout == 0 {
+		config.Timeout = 500 * time.Millisecond
+	}
+	tty, err := serialInit(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tty.Close()
+		ups.Close()
+	})
+	return tty
+}
+
+func TestTTYQuery(t *testing.T) {
+	const q1 = "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000"
+	tty := newTestTTY(t, TTYConfig{}, func(cmd string) []string {
+		switch cmd {
+		case "Q1":
+			return []string{q1}
+		case "F":
+			return []string{"\x00#220.0 007 24.00 50.0"} // 起始字符前的杂散字节
+		case "G1":
+			return []string{"@"}
+		}
+		return []string{cmd}
+	})
+
+	for _, test := range []struct {
+		cmd   string
+		reply string
+		err   error
+	}{
+		{"Q1", q1, nil},
+		{"F", "#220.0 007 24.00 50.0", nil},
+		{"G1", "", ErrNoData},
+		{"X9", "", ErrInvalidCommand},
+	} {
+		reply, err := tty.Query(test.cmd, 0)
+		if reply != test.reply || !errors.Is(err, test.err) {
+			t.Errorf("%s: %q, %v, want %q, %v", test.cmd, reply, err, test.reply, test.err)
+		}
+		var queryErr *QueryError
+		if err != nil && (!errors.As(err, &queryErr) || queryErr.Cmd != test.cmd) {
+			t.Errorf("%s: error %v does not record the command", test.cmd, err)
+		}
+	}
+}
+
+// 超时命令的应答迟到时, 即使起始字符相同也不能当作下一条命令的应答
+func TestTTYQueryTimeout(t *testing.T) {
+	const (
+		replyI  = "#SANTAK          MT1000-PRO V1.0"
+		replyF  = "#220.0 007 24.00 50.0"
+		replyGF = "!220V/380V^3P4W 050 220V/380V^3P4W 050 220V/3P3W^^^^^ 050 396 150KVA^^^^"
+		replyG1 = "!240 094 0123 025.0 +35.0 50.1 52.0 50.0"
+	)
+	tty := newTestTTY(t, TTYConfig{}, func(cmd string) []string {
+		switch cmd {
+		case "F":
+			return []string{replyI, replyF}
+		case "G1":
+			return []string{replyGF, replyG1}
+		}
+		return nil
+	})
+
+	start := time.Now()
+	_, err := tty.Query("I", 50*time.Millisecond)
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("I: %v, want timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("I: timed out after %s", elapsed)
+	}
+	if reply, err := tty.Query("F", 0); reply != replyF || err != nil {
+		t.Errorf("F: %q, %v, want %q", reply, err, replyF)
+	}
+	if reply, err := tty.Query("G1", 0); reply != replyG1 || err != nil {
+		t.Errorf("G1: %q, %v, want %q", reply, err, replyG1)
+	}
+}
+
+// 没有等待中的 Query 时收到的行交给 Received, cmd 为空
+func TestTTYUnsolicited(t *testing.T) {
+	const q1 = "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000"
+	received := make(chan [2]string, 1)
+	tty := newTestTTY(t, TTYConfig{
+		Received: func(userData any, cmd string, value string) {
+			received <- [2]string{cmd, value}
+		},
+	}, func(cmd string) []string {
+		if cmd == "Q" {
+			return []string{q1}
+		}
+		return nil
+	})
+
+	if err := tty.Send("Q"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if got != [2]string{"", q1} {
+			t.Errorf("received %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("unsolicited line not received")
+	}
+}
+
+// 打开失败时按退避时间重试, 间隔加倍直到上限; Reconnect 后重新打开
+func TestTTYReconnect(t *testing.T) {
+	sim, err := NewSimulator(SimulatorConfig{Model: "mt1000-pro"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+
+	var lock sync.Mutex
+	var attempts []time.Time
+	fail := 4
+	tty, err := serialInit(TTYConfig{
+		Port: "simulator",
+		Open: func(port string) (io.ReadWriteCloser, error) {
+			lock.Lock()
+			defer lock.Unlock()
+			attempts = append(attempts, time.Now())
+			if len(attempts) <= fail {
+				return nil, errors.New("no such device")
+			}
+			return sim.Open(port)
+		},
+		Timeout:           time.Second,
+		ReconnectMinDelay: 20 * time.Millisecond,
+		ReconnectMaxDelay: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+
+	query := func() {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			_, err := tty.Query("Q1", 100*time.Millisecond)
+			if err == nil {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Q1 after reconnect: %s", err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	query()
+
+	lock.Lock()
+	if len(attempts) != fail+1 {
+		t.Fatalf("%d open attempts, want %d", len(attempts), fail+1)
+	}
+	// 第一次在 serialInit 中打开, 之后的间隔为 20, 40, 50(上限) 毫秒
+	for i, want := range []time.Duration{20, 40, 50} {
+		gap := attempts[i+2].Sub(attempts[i+1])
+		if gap < want*time.Millisecond || gap > want*time.Millisecond+200*time.Millisecond {
+			t.Errorf("retry %d after %s, want %dms", i+1, gap, want)
+		}
+	}
+	lock.Unlock()
+
+	tty.Reconnect()
+	query()
+	lock.Lock()
+	if len(attempts) != fail+2 {
+		t.Errorf("%d open attempts after Reconnect, want %d", len(attempts), fail+2)
+	}
+	lock.Unlock()
+}
+
+// 超过 Timeout 没有应答时调用一次 OnLost, 收到应答后调用一次 OnRestore
+func TestWatchdog(t *testing.T) {
+	var lost, restored int
+	w := &Watchdog{
+		Timeout:   50 * time.Millisecond,
+		OnLost:    func() { lost++ },
+		OnRestore: func() { restored++ },
+	}
+
+	w.Check()
+	if w.Lost || lost != 0 {
+		t.Fatal("lost before timeout")
+	}
+	w.Feed()
+	if restored != 0 {
+		t.Fatal("restored without loss")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	w.Check()
+	w.Check()
+	if !w.Lost || lost != 1 {
+		t.Fatalf("lost %v, OnLost called %d times, want once", w.Lost, lost)
+	}
+
+	w.Feed()
+	w.Feed()
+	if w.Lost || restored != 1 {
+		t.Fatalf("lost %v, OnRestore called %d times, want once", w.Lost, restored)
+	}
+	w.Check()
+	if w.Lost || lost != 1 {
+		t.Fatal("lost right after restore")
+	}
+}
@@ -0,0 +1,720 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// UPS 模拟器, 按山特串口协议应答, 用于没有 UPS 的环境下测试 TTY / Device / SNMP。
+
+// 协议规定的测试时间和 C 取消开机延时后的开机时间
+const (
+	simulatorQuickTest    = 10 * time.Second
+	simulatorRestartDelay = 10 * time.Second
+)
+
+// 电量低于该值时置位电池低电压
+const simulatorLowBattery = 20.0
+
+// 模拟的机型
+type SimulatorModel struct {
+	Name string
+
+	Company string // I 应答, 为空时返回 "@"
+	Model   string
+	Version string
+
+	Online     bool // Q1 b3 = 0, 电池电压为单体电压 S.SS
+	ThreePhase bool // 支持 G1 / G2 / G3 / GF
+
+	Rating RatingInfo
+
+	FloatVoltage  float64 // 充满时的电池电压
+	CutoffVoltage float64 // 放电截止电压
+	FullLoadTime  time.Duration
+
+	TPRating string // GF 应答
+}
+
+var simulatorModels = map[string]SimulatorModel{
+	"mt1000-pro": {
+		Name:          "mt1000-pro",
+		Company:       "SANTAK",
+		Model:         "MT1000-PRO",
+		Version:       "V1.0",
+		Rating:        RatingInfo{VoltageRating: 220, CurrentRating: 7, BatteryVoltage: 24, FrequencyRating: 50},
+		FloatVoltage:  27.4,
+		CutoffVoltage: 21.6,
+		FullLoadTime:  3*time.Minute + 30*time.Second,
+	},
+	"single-phase-online": {
+		Name:          "single-phase-online",
+		Company:       "SANTAK",
+		Model:         "C1K",
+		Version:       "V2.1",
+		Online:        true,
+		Rating:        RatingInfo{VoltageRating: 220, CurrentRating: 4, BatteryVoltage: 36, FrequencyRating: 50},
+		FloatVoltage:  2.25,
+		CutoffVoltage: 1.75,
+		FullLoadTime:  4 * time.Minute,
+	},
+	"three-phase": {
+		Name:          "three-phase",
+		Company:       "SANTAK",
+		Model:         "3C3-15KS",
+		Version:       "V3.0",
+		Online:        true,
+		ThreePhase:    true,
+		Rating:        RatingInfo{VoltageRating: 220, CurrentRating: 22, BatteryVoltage: 396, FrequencyRating: 50},
+		FloatVoltage:  2.25,
+		CutoffVoltage: 1.75,
+		FullLoadTime:  5 * time.Minute,
+		TPRating:      "!220V/380V^3P4W 050 220V/380V^3P4W 050 220V/380V^3P4W 050 396 15KVA^^^^^",
+	},
+}
+
+// 模拟器当前状态, 场景和测试代码可以直接修改
+type SimulatorState struct {
+	InputVoltage  float64
+	FaultVoltage  float64
+	OutputVoltage float64
+	Frequency     float64
+	Load          int     // 输出负载 %
+	Charge        float64 // 电池电量 %
+	Temperature   float64
+
+	UtilityFail  bool // b7
+	BatteryLow   bool // b6 由电量计算, 置位 ForceLowBattery 时始终为 1
+	BypassActive bool // b5
+	Failed       bool // b4
+	Testing      bool // b2
+	Shutdown     bool // b1 关机倒计时中
+	Beeper       bool // b0
+
+	ForceLowBattery bool
+	OutputOff       bool
+
+	// G2 附加的故障位, 与由状态计算的位做或运算
+	ExtraError [3]uint8
+}
+
+type SimulatorStep struct {
+	After time.Duration `yaml:"after"` // 距上一步的时间
+	Event string        `yaml:"event"` // 见 Simulator.Apply
+	Load  *int          `yaml:"load"`  // event 为 load 时使用
+	G2    string        `yaml:"g2"`    // event 为 fault 时附加的 G2 位, 如 "00000000 00000000 00001000"
+}
+
+type SimulatorConfig struct {
+	Model    string
+	Speed    float64 // 时间倍速, 影响测试、关机延时、电池放电和场景
+	Scenario []SimulatorStep
+}
+
+type Simulator struct {
+	Config SimulatorConfig
+	Model  SimulatorModel
+
+	lock  sync.Mutex
+	state SimulatorState
+
+	start    time.Time
+	lastTick time.Duration
+
+	testUntil     time.Duration // 0: 无定时测试
+	testToLow     bool
+	shutdownAt    time.Duration // 0: 未计划关机
+	restartAt     time.Duration // 0: 未计划开机
+	restartOnMain bool          // S<n> 不带 R, 市电恢复后 10 秒开机
+
+	stop chan struct{}
+}
+
+func NewSimulator(config SimulatorConfig) (*Simulator, error) {
+	if config.Model == "" {
+		config.Model = defaultDeviceProfile
+	}
+	if config.Speed <= 0 {
+		config.Speed = 1
+	}
+	model, ok := simulatorModels[config.Model]
+	if !ok {
+		return nil, fmt.Errorf("unknown simulator model '%s'", config.Model)
+	}
+
+	s := &Simulator{
+		Config: config,
+		Model:  model,
+		start:  time.Now(),
+		stop:   make(chan struct{}),
+	}
+	s.state = SimulatorState{
+		InputVoltage:  float64(model.Rating.VoltageRating),
+		FaultVoltage:  float64(model.Rating.VoltageRating),
+		OutputVoltage: float64(model.Rating.VoltageRating),
+		Frequency:     float64(model.Rating.FrequencyRating),
+		Load:          20,
+		Charge:        100,
+		Temperature:   25,
+		Beeper:        true,
+	}
+
+	if len(config.Scenario) != 0 {
+		go s.runScenario(config.Scenario)
+	}
+	return s, nil
+}
+
+// 停止场景
+func (s *Simulator) Close() {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+}
+
+// 模拟时间
+func (s *Simulator) now() time.Duration {
+	return time.Duration(float64(time.Since(s.start)) * s.Config.Speed)
+}
+
+// 读取当前状态
+func (s *Simulator) State() SimulatorState {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.advance()
+	return s.state
+}
+
+// 修改状态
+func (s *Simulator) Update(fn func(state *SimulatorState)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.advance()
+	fn(&s.state)
+}
+
+func (s *Simulator) batteryVoltage() float64 {
+	return s.Model.CutoffVoltage + (s.Model.FloatVoltage-s.Model.CutoffVoltage)*s.state.Charge/100
+}
+
+// 当前负载下的满电放电时间
+func (s *Simulator) runtime() time.Duration {
+	load := math.Max(float64(s.state.Load), 5)
+	return time.Duration(float64(s.Model.FullLoadTime) * 100 / load)
+}
+
+func (s *Simulator) onBattery() bool {
+	return (s.state.UtilityFail || s.state.Testing) && !s.state.OutputOff
+}
+
+// 按模拟时间推进电池、测试和关机计时
+func (s *Simulator) advance() {
+	now := s.now()
+	dt := now - s.lastTick
+	s.lastTick = now
+
+	if s.onBattery() {
+		s.state.Charge -= float64(dt) / float64(s.runtime()) * 100
+	} else if !s.state.UtilityFail {
+		// 约 1 小时充满
+		s.state.Charge += float64(dt) / float64(time.Hour) * 100
+	}
+	s.state.Charge = math.Max(0, math.Min(100, s.state.Charge))
+	s.state.BatteryLow = s.state.ForceLowBattery || s.state.Charge < simulatorLowBattery
+
+	if s.state.Testing {
+		if (s.testToLow && s.state.BatteryLow) || (s.testUntil != 0 && now >= s.testUntil) {
+			s.endTest()
+		}
+	}
+
+	if s.shutdownAt != 0 && now >= s.shutdownAt {
+		s.shutdownAt = 0
+		s.state.Shutdown = false
+		s.state.OutputOff = true
+		s.endTest()
+	}
+
+	if s.state.OutputOff && s.restartOnMain && !s.state.UtilityFail && s.restartAt == 0 {
+		s.restartAt = now + simulatorRestartDelay
+	}
+	if s.restartAt != 0 && now >= s.restartAt {
+		s.restartAt = 0
+		s.restartOnMain = false
+		s.state.OutputOff = false
+	}
+
+	// 电池耗尽后关闭输出
+	if s.state.UtilityFail && s.state.Charge <= 0 {
+		s.state.OutputOff = true
+		s.restartOnMain = true
+	}
+
+	if s.state.OutputOff {
+		s.state.OutputVoltage = 0
+	} else {
+		s.state.OutputVoltage = float64(s.Model.Rating.VoltageRating)
+	}
+}
+
+func (s *Simulator) endTest() {
+	s.state.Testing = false
+	s.testUntil = 0
+	s.testToLow = false
+}
+
+func (s *Simulator) startTest(duration time.Duration, toLow bool) {
+	if s.state.UtilityFail || s.state.OutputOff {
+		return
+	}
+	s.state.Testing = true
+	s.testToLow = toLow
+	s.testUntil = 0
+	if duration > 0 {
+		s.testUntil = s.now() + duration
+	}
+}
+
+func formatBits(bits [8]bool) string {
+	var b strings.Builder
+	for i := 7; i >= 0; i-- {
+		if bits[i] {
+			b.WriteByte('1')
+		} else {
+			b.WriteByte('0')
+		}
+	}
+	return b.String()
+}
+
+func orBits(bits [8]bool, extra uint8) string {
+	for i := 0; i < 8; i++ {
+		if extra&(1<<i) != 0 {
+			bits[i] = true
+		}
+	}
+	return formatBits(bits)
+}
+
+func (s *Simulator) replyQ1() string {
+	state := s.state
+	inputVoltage := state.InputVoltage
+	frequency := state.Frequency
+	if state.UtilityFail {
+		inputVoltage = 0
+		frequency = 0
+	}
+	load := state.Load
+	if state.OutputOff {
+		load = 0
+	}
+
+	battery := fmt.Sprintf("%04.1f", s.batteryVoltage())
+	if s.Model.Online {
+		battery = fmt.Sprintf("%.2f", s.batteryVoltage())
+	}
+
+	status := [8]bool{
+		7: state.UtilityFail,
+		6: state.BatteryLow,
+		5: state.BypassActive,
+		4: state.Failed,
+		3: !s.Model.Online,
+		2: state.Testing,
+		1: state.Shutdown,
+		0: state.Beeper,
+	}
+
+	return fmt.Sprintf("(%05.1f %05.1f %05.1f %03d %04.1f %s %04.1f %s",
+		inputVoltage, state.FaultVoltage, state.OutputVoltage, load, frequency, battery, state.Temperature, formatBits(status))
+}
+
+func (s *Simulator) replyF() string {
+	r := s.Model.Rating
+	battery := fmt.Sprintf("%05.2f", r.BatteryVoltage)
+	if r.BatteryVoltage >= 100 {
+		battery = fmt.Sprintf("%05.1f", r.BatteryVoltage)
+	}
+	return fmt.Sprintf("#%05.1f %03d %s %04.1f", r.VoltageRating, r.CurrentRating, battery, r.FrequencyRating)
+}
+
+func (s *Simulator) replyI() string {
+	if s.Model.Company == "" {
+		return "@"
+	}
+	return fmt.Sprintf("#%-15s %-10s %-10s", s.Model.Company, s.Model.Model, s.Model.Version)
+}
+
+func (s *Simulator) replyG1() string {
+	state := s.state
+	remaining := 0
+	if s.onBattery() || state.UtilityFail {
+		remaining = int(float64(s.runtime()) * state.Charge / 100 / float64(time.Minute))
+	} else {
+		remaining = int(float64(s.runtime()) / float64(time.Minute))
+	}
+	cells := float64(s.Model.Rating.BatteryVoltage) / 2
+	current := float64(state.Load) / 100 * float64(s.Model.Rating.CurrentRating)
+	if !s.onBattery() {
+		current = 0
+		if state.Charge < 100 {
+			current = 5
+		}
+	}
+	frequency := state.Frequency
+	if state.UtilityFail {
+		frequency = 0
+	}
+	return fmt.Sprintf("!%03d %03d %04d %05.1f %+05.1f %04.1f %04.1f %04.1f",
+		int(math.Round(s.batteryVoltage()*cells)), int(math.Round(state.Charge)), remaining, current,
+		state.Temperature, frequency, frequency, s.Model.Rating.FrequencyRating)
+}
+
+func (s *Simulator) replyG2() string {
+	state := s.state
+	a := [8]bool{
+		5: state.Charge <= 0,
+		4: state.BatteryLow,
+		2: s.onBattery(),
+		0: !state.UtilityFail,
+	}
+	b := [8]bool{
+		2: !state.UtilityFail,
+		1: !state.BypassActive,
+		0: !state.OutputOff && !state.BypassActive,
+	}
+	c := [8]bool{}
+	return fmt.Sprintf("!%s %s %s", orBits(a, state.ExtraError[0]), orBits(b, state.ExtraError[1]), orBits(c, state.ExtraError[2]))
+}
+
+func (s *Simulator) replyG3() string {
+	state := s.state
+	input := state.InputVoltage
+	if state.UtilityFail {
+		input = 0
+	}
+	load := float64(state.Load)
+	if state.OutputOff {
+		load = 0
+	}
+	phase := func(v float64) string {
+		return fmt.Sprintf("%05.1f/%05.1f/%05.1f", v, v, v)
+	}
+	return fmt.Sprintf("!%s %s %s %s", phase(input), phase(input), phase(state.OutputVoltage), phase(load))
+}
+
+var simulatorShutdownRegexp = regexp.MustCompile(`^S(\.[2-9]|0[1-9]|10)(?:R(\d{4}))?$`)
+var simulatorTestRegexp = regexp.MustCompile(`^T(\d{2})$`)
+
+// 解析 S<n> 的延时
+func parseShutdownDelay(value string) time.Duration {
+	if strings.HasPrefix(value, ".") {
+		tenths, _ := strconv.Atoi(value[1:])
+		return time.Duration(tenths) * 6 * time.Second
+	}
+	minutes, _ := strconv.Atoi(value)
+	return time.Duration(minutes) * time.Minute
+}
+
+// 处理一条命令, ok 为 false 时该命令没有应答
+func (s *Simulator) Handle(cmd string) (reply string, ok bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.advance()
+
+	switch cmd {
+	case "Q1":
+		return s.replyQ1(), true
+	case "F":
+		return s.replyF(), true
+	case "I":
+		return s.replyI(), true
+	case "T":
+		s.startTest(simulatorQuickTest, false)
+		return "", false
+	case "TL":
+		s.startTest(0, true)
+		return "", false
+	case "CT":
+		s.endTest()
+		return "", false
+	case "Q":
+		s.state.Beeper = !s.state.Beeper
+		return "", false
+	case "C":
+		if s.state.OutputOff {
+			// 开机延时中取消, 10 秒后开机
+			s.restartAt = s.now() + simulatorRestartDelay
+		}
+		s.shutdownAt = 0
+		s.state.Shutdown = false
+		return "", false
+	}
+
+	if s.Model.ThreePhase {
+		switch cmd {
+		case "G1":
+			return s.replyG1(), true
+		case "G2":
+			return s.replyG2(), true
+		case "G3":
+			return s.replyG3(), true
+		case "GF":
+			return s.Model.TPRating, true
+		}
+	}
+
+	if match := simulatorTestRegexp.FindStringSubmatch(cmd); match != nil {
+		minutes, _ := strconv.Atoi(match[1])
+		if minutes >= 1 {
+			s.startTest(time.Duration(minutes)*time.Minute, false)
+			return "", false
+		}
+	}
+
+	if match := simulatorShutdownRegexp.FindStringSubmatch(cmd); match != nil {
+		now := s.now()
+		delay := parseShutdownDelay(match[1])
+		s.shutdownAt = now + delay
+		s.state.Shutdown = true
+		s.restartAt = 0
+		s.restartOnMain = true
+		if match[2] != "" {
+			minutes, _ := strconv.Atoi(match[2])
+			s.restartOnMain = false
+			s.restartAt = now + delay + time.Duration(minutes)*time.Minute
+		}
+		return "", false
+	}
+
+	// 无效命令原样返回
+	return cmd, true
+}
+
+// 在 rw 上按协议应答, 直到读取出错
+func (s *Simulator) Serve(rw io.ReadWriter) error {
+	reader := bufio.NewReader(rw)
+	for {
+		line, err := reader.ReadString(EndByteChar)
+		if err != nil {
+			return err
+		}
+		cmd := strings.Trim(line, "\r\n")
+		if cmd == "" {
+			continue
+		}
+		Logger.Debugf("simulator recv: %s", cmd)
+		reply, ok := s.Handle(cmd)
+		if !ok {
+			continue
+		}
+		Logger.Debugf("simulator send: %s", reply)
+		_, err = rw.Write([]byte(reply + "\r"))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// 进程内连接, 可直接作为 TTYConfig.Open 使用
+func (s *Simulator) Open(port string) (io.ReadWriteCloser, error) {
+	client, server := net.Pipe()
+	go func() {
+		s.Serve(server)
+		server.Close()
+	}()
+	return client, nil
+}
+
+// 场景事件
+func (s *Simulator) Apply(step SimulatorStep) error {
+	var err error
+	s.Update(func(state *SimulatorState) {
+		switch step.Event {
+		case "mains-failure":
+			state.UtilityFail = true
+			state.FaultVoltage = 0
+		case "mains-restore":
+			state.UtilityFail = false
+			state.FaultVoltage = state.InputVoltage
+		case "low-battery":
+			state.ForceLowBattery = true
+			state.Charge = math.Min(state.Charge, simulatorLowBattery-1)
+		case "battery-restore":
+			state.ForceLowBattery = false
+			state.Charge = 100
+		case "overload":
+			state.Load = 130
+		case "load":
+			if step.Load == nil {
+				err = errors.New("load event needs 'load'")
+				return
+			}
+			state.Load = *step.Load
+		case "self-test":
+			s.startTest(simulatorQuickTest, false)
+		case "fault":
+			state.Failed = true
+			if step.G2 != "" {
+				state.ExtraError, err = parseSimulatorBits(step.G2)
+			}
+		case "clear":
+			state.Failed = false
+			state.ExtraError = [3]uint8{}
+			state.BypassActive = false
+		case "bypass":
+			state.BypassActive = true
+		default:
+			err = fmt.Errorf("unknown event '%s'", step.Event)
+		}
+	})
+	return err
+}
+
+func parseSimulatorBits(value string) ([3]uint8, error) {
+	var result [3]uint8
+	groups := strings.Fields(value)
+	if len(groups) != 3 {
+		return result, fmt.Errorf("invalid bits '%s'", value)
+	}
+	for i, group := range groups {
+		bits, err := strconv.ParseUint(group, 2, 8)
+		if err != nil {
+			return result, fmt.Errorf("invalid bits '%s'", value)
+		}
+		result[i] = uint8(bits)
+	}
+	return result, nil
+}
+
+func (s *Simulator) runScenario(steps []SimulatorStep) {
+	for _, step := range steps {
+		delay := time.Duration(float64(step.After) / s.Config.Speed)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+		Logger.Infof("Simulator event: %s", step.Event)
+		err := s.Apply(step)
+		if err != nil {
+			Logger.Errorf("Simulator event '%s' faild: %s", step.Event, err.Error())
+		}
+	}
+}
+
+// 内置场景
+var simulatorScenarios = map[string][]SimulatorStep{
+	"mains-failure": {
+		{After: 10 * time.Second, Event: "mains-failure"},
+		{After: 60 * time.Second, Event: "mains-restore"},
+	},
+	"low-battery": {
+		{After: 10 * time.Second, Event: "mains-failure"},
+		{After: 20 * time.Second, Event: "low-battery"},
+		{After: 60 * time.Second, Event: "mains-restore"},
+		{After: 10 * time.Second, Event: "battery-restore"},
+	},
+	"overload": {
+		{After: 10 * time.Second, Event: "overload"},
+		{After: 30 * time.Second, Event: "load", Load: func() *int { v := 20; return &v }()},
+	},
+	"self-test": {
+		{After: 10 * time.Second, Event: "self-test"},
+	},
+	"fault": {
+		{After: 10 * time.Second, Event: "fault", G2: "01000000 00000000 00000010"},
+		{After: 30 * time.Second, Event: "clear"},
+	},
+}
+
+// 加载场景, name 为内置场景名或 YAML 文件路径
+func LoadSimulatorScenario(name string) ([]SimulatorStep, error) {
+	if name == "" {
+		return nil, nil
+	}
+	if steps, ok := simulatorScenarios[name]; ok {
+		return steps, nil
+	}
+	dataBytes, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	var steps []SimulatorStep
+	err = yaml.Unmarshal(dataBytes, &steps)
+	if err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// simulate 子命令: 在 pty 或串口上运行模拟器
+func runSimulate(args []string) {
+	flags := pflag.NewFlagSet("simulate", pflag.ExitOnError)
+	model := flags.StringP("model", "m", defaultDeviceProfile, "模拟的机型 (mt1000-pro / single-phase-online / three-phase)")
+	scenario := flags.StringP("scenario", "s", "", "场景名 (mains-failure / low-battery / overload / self-test / fault) 或 YAML 文件路径")
+	speed := flags.Float64("speed", 1, "时间倍速")
+	port := flags.StringP("port", "p", "", "在串口上应答 (可选, 默认创建 pty)")
+	logLevel := flags.String("log-level", "info", "日志等级")
+	flags.Parse(args)
+
+	setLogLevel(Logger, *logLevel)
+
+	steps, err := LoadSimulatorScenario(*scenario)
+	if err != nil {
+		Logger.Fatalf("Load scenario faild: %s", err.Error())
+	}
+	sim, err := NewSimulator(SimulatorConfig{
+		Model:    *model,
+		Speed:    *speed,
+		Scenario: steps,
+	})
+	if err != nil {
+		Logger.Fatal(err.Error())
+	}
+	defer sim.Close()
+
+	var rw io.ReadWriteCloser
+	if *port != "" {
+		rw, err = serialOpen(*port)
+		if err != nil {
+			Logger.Fatalf("Open port '%s' faild: %s", *port, err.Error())
+		}
+		Logger.Infof("Simulator %s listening on %s", sim.Model.Name, *port)
+	} else {
+		master, slave, path, err := openPty()
+		if err != nil {
+			Logger.Fatalf("Open pty faild: %s", err.Error())
+		}
+		defer slave.Close()
+		rw = master
+		Logger.Infof("Simulator %s listening on %s", sim.Model.Name, path)
+	}
+	defer rw.Close()
+
+	go func() {
+		err := sim.Serve(rw)
+		if err != nil {
+			Logger.Errorf("Simulator stopped: %s", err.Error())
+		}
+		sigs <- syscall.SIGTERM
+	}()
+
+	<-sigs
+}
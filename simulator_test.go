@@ -0,0 +1,238 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestSimulator(t *testing.T, config SimulatorConfig) (*Simulator, *TTY) {
+	t.Helper()
+
+	sim, err := NewSimulator(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+
+	tty, err := serialInit(TTYConfig{
+		Port:    "simulator",
+		Open:    sim.Open,
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+	return sim, tty
+}
+
+// 每个模拟机型都应被探测为对应的配置
+func TestSimulatorDetect(t *testing.T) {
+	for _, name := range []string{"mt1000-pro", "single-phase-online", "three-phase"} {
+		t.Run(name, func(t *testing.T) {
+			_, tty := newTestSimulator(t, SimulatorConfig{Model: name})
+			profile, err := DetectDeviceProfile(tty, probeWait)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if profile.Name != name {
+				t.Fatalf("detected %s, want %s", profile.Name, name)
+			}
+		})
+	}
+}
+
+// 启动时串口不存在, 重新连接后仍按探测结果选择配置, 而不是默认配置
+func TestSimulatorDetectAfterReconnect(t *testing.T) {
+	sim, err := NewSimulator(SimulatorConfig{Model: "three-phase"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+
+	// 比一轮 ProbeDevice 的重试时间更长
+	available := time.Now().Add(probeRetry * time.Second)
+	tty, err := serialInit(TTYConfig{
+		Port: "simulator",
+		Open: func(port string) (io.ReadWriteCloser, error) {
+			if time.Now().Before(available) {
+				return nil, errors.New("no such device")
+			}
+			return sim.Open(port)
+		},
+		Timeout:           time.Second,
+		ReconnectMinDelay: 100 * time.Millisecond,
+		ReconnectMaxDelay: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+
+	profile, err := DetectDeviceProfile(tty, probeWait)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != "three-phase" {
+		t.Fatalf("detected %s, want three-phase", profile.Name)
+	}
+}
+
+// 串口一直打不开时等待 wait 后使用默认配置, 其他服务仍能启动
+func TestSimulatorDetectFallback(t *testing.T) {
+	tty, err := serialInit(TTYConfig{
+		Port: "simulator",
+		Open: func(port string) (io.ReadWriteCloser, error) {
+			return nil, errors.New("no such device")
+		},
+		Timeout:           time.Second,
+		ReconnectMinDelay: 100 * time.Millisecond,
+		ReconnectMaxDelay: 100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+
+	start := time.Now()
+	profile, err := DetectDeviceProfile(tty, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.Name != defaultDeviceProfile {
+		t.Fatalf("detected %s, want %s", profile.Name, defaultDeviceProfile)
+	}
+	// 最后一轮 ProbeDevice 最多重试 probeRetry 次
+	if elapsed := time.Since(start); elapsed > time.Second+probeRetry*probeTimeout {
+		t.Errorf("fell back after %s", elapsed)
+	}
+}
+
+func TestSimulatorReplies(t *testing.T) {
+	_, tty := newTestSimulator(t, SimulatorConfig{Model: "three-phase"})
+
+	for _, cmd := range []string{"Q1", "F", "I", "G1", "G2", "G3", "GF"} {
+		reply, err := tty.Query(cmd, 0)
+		if err != nil {
+			t.Fatalf("%s: %s", cmd, err)
+		}
+		_, err = ProtoParseReply(cmd, reply)
+		if err != nil {
+			t.Fatalf("%s: parse '%s': %s", cmd, reply, err)
+		}
+	}
+
+	_, err := tty.Query("X9", 0)
+	if !errors.Is(err, ErrInvalidCommand) {
+		t.Fatalf("X9: got %v, want invalid command", err)
+	}
+}
+
+func TestSimulatorMainsFailure(t *testing.T) {
+	sim, tty := newTestSimulator(t, SimulatorConfig{Model: "mt1000-pro"})
+
+	sim.Apply(SimulatorStep{Event: "mains-failure"})
+	reply, err := tty.Query("Q1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := ProtoParseReply("Q1", reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status := v.(QueryResult).Status
+	if !status.UtilityFail || !status.UPSType {
+		t.Fatalf("unexpected status %s", reply)
+	}
+
+	// 市电异常时不能自检
+	tty.Send("T")
+	if sim.State().Testing {
+		t.Fatal("test started on battery")
+	}
+}
+
+func TestSimulatorShutdownRestart(t *testing.T) {
+	sim, _ := newTestSimulator(t, SimulatorConfig{Model: "mt1000-pro", Speed: 600})
+
+	// .2 分钟后关机, 1 分钟后开机: 实际约 20ms 和 120ms
+	reply, ok := sim.Handle("S.2R0001")
+	if ok {
+		t.Fatalf("unexpected reply '%s'", reply)
+	}
+	if !sim.State().Shutdown {
+		t.Fatal("shutdown not pending")
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !sim.State().OutputOff {
+		if time.Now().After(deadline) {
+			t.Fatal("output not off")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for sim.State().OutputOff {
+		if time.Now().After(deadline) {
+			t.Fatal("output not restored")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSimulatorTest(t *testing.T) {
+	sim, _ := newTestSimulator(t, SimulatorConfig{Model: "mt1000-pro"})
+
+	sim.Handle("T05")
+	if !sim.State().Testing {
+		t.Fatal("test not started")
+	}
+	sim.Handle("CT")
+	if sim.State().Testing {
+		t.Fatal("test not canceled")
+	}
+
+	beeper := sim.State().Beeper
+	sim.Handle("Q")
+	if sim.State().Beeper == beeper {
+		t.Fatal("beeper not toggled")
+	}
+}
+
+func TestSimulatorPty(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("pty is only supported on linux")
+	}
+	sim, err := NewSimulator(SimulatorConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(sim.Close)
+
+	master, slave, path, err := openPty()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		master.Close()
+		slave.Close()
+	})
+	go sim.Serve(master)
+
+	tty, err := serialInit(TTYConfig{Port: path, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { tty.Close() })
+
+	reply, err := tty.Query("I", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(reply, "#SANTAK") {
+		t.Fatalf("unexpected reply '%s'", reply)
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gosnmp/gosnmp"
@@ -16,9 +19,9 @@ import (
 type TimesTamp uint32
 
 type AlarmEntry struct {
-	Index int
-	Descr string
-	Time  TimesTamp
+	Id    int       // upsAlarmId, 同时是表的索引
+	Descr string    // upsAlarmDescr
+	Time  TimesTamp // upsAlarmTime, 检测到告警时的 sysUpTime
 }
 
 type SNMPDataIdent struct { // 基本信息
@@ -94,7 +97,7 @@ type SNMPDataAlarm struct {
 }
 
 type SNMPDataTest struct {
-	Id             string    `snmp:"upsTestId,w"`           // 当前测试ID
+	Id             string    `snmp:"upsTestId,w,oid"`       // 当前测试ID
 	SpinLock       int       `snmp:"upsTestSpinLock,w"`     // 测试锁，自旋锁
 	ResultsSummary int       `snmp:"upsTestResultsSummary"` // 测试状态 1: done, 2: done Warn, 3: done Error, 4: aborted, 5: in progress, 6: noRun
 	ResultsDetail  string    `snmp:"upsTestResultsDetail"`  // 测试结果
@@ -155,7 +158,13 @@ type SNMPFieldInfo struct {
 	SNMPType  string
 }
 
+// SNMP 同时也是共享状态的入口。
+// SNMPData、UserData、告警和 OID 表只能在持有 Lock 时读写:
+// SNMP 请求、串口应答、NUT 命令、指标采集等每个入口各自加锁一次,
+// 入口内部调用的 GetValue / SetValue / alarm 等不再加锁。
 type SNMP struct {
+	Lock sync.Mutex
+
 	Device  Device
 	TtySend func(cmd string)
 
@@ -165,12 +174,16 @@ type SNMP struct {
 
 	Trap             []*gosnmp.GoSNMP
 	TrapAgentAddress string
+	Inform           []*gosnmp.GoSNMP
+	InformQueue      *InformQueue
+	TrapScheduler    *TrapScheduler
+	Notifier         *Notifier // Webhook 通知, 为空时不发送
 
-	Server  *GoSNMPServer.SNMPServer
-	Master  *GoSNMPServer.MasterAgent
-	Public  *GoSNMPServer.SubAgent
-	Private *GoSNMPServer.SubAgent
-	Mib     *smi.MIB
+	Listener GoSNMPServer.ISnmpServerListener
+	Master   *GoSNMPServer.MasterAgent
+	Public   *GoSNMPServer.SubAgent
+	Private  *GoSNMPServer.SubAgent
+	Mib      *smi.MIB
 }
 
 type SNMPAuth struct {
@@ -193,6 +206,10 @@ type SNMPConfig struct {
 
 	Auth []SNMPAuth
 
+	InformQueue string // 未送达的 INFORM 保存到该文件
+
+	TrapIntervals map[string]time.Duration // 通知名 -> 最小发送间隔, 覆盖默认值
+
 	SetCallback func(snmp *SNMP, name string, value interface{}) error
 }
 
@@ -257,10 +274,35 @@ func getFieldInfoFromType(t reflect.Type) []SNMPFieldInfo {
 	return fieldInfos
 }
 
+// 按字段类型写入 SET 的值, 返回写入后的值。
+// gosnmp 解码后 OctetString 为 []byte, ObjectIdentifier 为 string, Integer 为 int
+func setFieldValue(field reflect.Value, value any) (any, error) {
+	switch v := value.(type) {
+	case []byte:
+		if field.Kind() == reflect.String {
+			field.SetString(string(v))
+			return field.Interface(), nil
+		}
+	case string:
+		if field.Kind() == reflect.String {
+			field.SetString(v)
+			return field.Interface(), nil
+		}
+	case int:
+		if field.Kind() == reflect.Int {
+			field.SetInt(int64(v))
+			return field.Interface(), nil
+		}
+	}
+	return nil, fmt.Errorf("wrong type %T for %s", value, field.Type())
+}
+
 func snmp_server(config SNMPConfig, server_enable SNMPData, data *SNMPData) *SNMP {
 	snmp := &SNMP{
 		Data:   data,
 		Config: &config,
+
+		TrapScheduler: NewTrapScheduler(config.TrapIntervals),
 	}
 
 	// 读写共同体
@@ -294,6 +336,8 @@ func snmp_server(config SNMPConfig, server_enable SNMPData, data *SNMPData) *SNM
 	if !useRW {
 		private = GoSNMPServer.SubAgent{
 			CommunityIDs: []string{config.PrivateName},
+			// SET 失败时返回 genErr, 而不是在应答中带回错误字符串
+			UserErrorMarkPacket: true,
 		}
 		master.SubAgents = []*GoSNMPServer.SubAgent{&public, &private}
 	} else {
@@ -355,6 +399,9 @@ func snmp_server(config SNMPConfig, server_enable SNMPData, data *SNMPData) *SNM
 		switch type_name {
 		case "string":
 			tp = gosnmp.OctetString
+			if id.SNMPType == "oid" {
+				tp = gosnmp.ObjectIdentifier
+			}
 		case "int":
 			tp = gosnmp.Integer
 		case "TimesTamp":
@@ -382,6 +429,22 @@ func snmp_server(config SNMPConfig, server_enable SNMPData, data *SNMPData) *SNM
 
 		master.Logger.Infof("Add service [%s](%s) %s", name, m_id, oid_str)
 
+		onGet := func() (interface{}, error) {
+			master.Logger.Debugf("Get: %s", name)
+			if !field.IsValid() {
+				return nil, fmt.Errorf("field not found")
+			}
+			value := field.Interface()
+			master.Logger.Debugf("Get data: %s", value)
+			switch v := value.(type) {
+			case TimesTamp:
+				value = uint32(v)
+			default:
+				value = v
+			}
+			return value, nil
+		}
+
 		var onSet func(value interface{}) error
 		if id.Writable {
 			master.Logger.Infof("Add service [%s](%s) %s is writable", name, m_id, oid_str)
@@ -390,39 +453,36 @@ func snmp_server(config SNMPConfig, server_enable SNMPData, data *SNMPData) *SNM
 				if !field.IsValid() {
 					return fmt.Errorf("field not found")
 				}
-				field.Set(reflect.ValueOf(value))
+				old := reflect.ValueOf(field.Interface())
+				value, err := setFieldValue(field, value)
+				if err != nil {
+					return err
+				}
 				if config.SetCallback != nil {
-					return config.SetCallback(snmp, name, value)
+					err = config.SetCallback(snmp, m_id, value)
+					if err != nil {
+						// 设备拒绝时恢复原值
+						field.Set(old)
+					}
+					return err
 				}
 				return nil
 			}
 			if !useRW {
+				// 读写共同体同样可以读取
 				private.OIDs = append(private.OIDs, &GoSNMPServer.PDUValueControlItem{
 					OID:   oid_str,
 					Type:  tp,
+					OnGet: onGet,
 					OnSet: onSet,
 				})
 				onSet = nil
 			}
 		}
 		public.OIDs = append(public.OIDs, &GoSNMPServer.PDUValueControlItem{
-			OID:  oid_str,
-			Type: tp,
-			OnGet: func() (interface{}, error) {
-				master.Logger.Debugf("Get: %s", name)
-				if !field.IsValid() {
-					return nil, fmt.Errorf("field not found")
-				}
-				value := field.Interface()
-				master.Logger.Debugf("Get data: %s", value)
-				switch v := value.(type) {
-				case TimesTamp:
-					value = uint32(v)
-				default:
-					value = v
-				}
-				return value, nil
-			},
+			OID:   oid_str,
+			Type:  tp,
+			OnGet: onGet,
 			OnSet: onSet,
 		})
 	}
@@ -430,13 +490,17 @@ func snmp_server(config SNMPConfig, server_enable SNMPData, data *SNMPData) *SNM
 	listen := fmt.Sprintf("%s:%d", config.Address, config.Port)
 
 	// 创建并启动服务器
-	server := GoSNMPServer.NewSNMPServer(master)
-	err = server.ListenUDP("udp", listen)
+	err = master.ReadyForWork()
+	if err != nil {
+		master.Logger.Fatalf("Init agent faild: %+v", err)
+	}
+	listener, err := newUDPListener(listen)
 	if err != nil {
 		master.Logger.Fatalf("Error in listen: %+v", err)
 	}
+	listener.SetupLogger(master.Logger)
 
-	snmp.Server = server
+	snmp.Listener = listener
 	snmp.Master = &master
 	snmp.Public = &public
 	if !useRW {
@@ -454,6 +518,8 @@ type TrapConfig struct {
 	Version gosnmp.SnmpVersion
 
 	Auth *SNMPAuth
+
+	Inform bool // 发送 InformRequest, 未确认时重试
 }
 
 type TrapData struct {
@@ -463,11 +529,22 @@ type TrapData struct {
 
 type TrapDataItem struct {
 	OID   string
+	Index int // 实例索引, 标量为 0
 	Type  gosnmp.Asn1BER
 	Value interface{}
 }
 
+// SNMPv2-MIB 中通知必须携带的前两个变量
+const (
+	sysUpTimeOID   = ".1.3.6.1.2.1.1.3.0"
+	snmpTrapOIDOID = ".1.3.6.1.6.3.1.1.4.1.0"
+)
+
 func (s *SNMP) AddTrap(config TrapConfig) error {
+	if config.Inform && config.Version == gosnmp.Version1 && config.Auth == nil {
+		return fmt.Errorf("inform to %s:%d requires SNMP v2c or v3", config.Host, config.Port)
+	}
+
 	g := &gosnmp.GoSNMP{
 		Target:    config.Host,
 		Port:      config.Port,
@@ -478,16 +555,25 @@ func (s *SNMP) AddTrap(config TrapConfig) error {
 	}
 
 	if config.Auth != nil {
-		g.Version = gosnmp.Version3
-		g.MsgFlags = gosnmp.AuthPriv
-		g.SecurityModel = gosnmp.UserSecurityModel
-		g.SecurityParameters = &gosnmp.UsmSecurityParameters{
+		usm := &gosnmp.UsmSecurityParameters{
 			UserName:                 config.Auth.Username,
 			AuthenticationProtocol:   config.Auth.AuthProto,
 			PrivacyProtocol:          config.Auth.PrivProto,
 			AuthenticationPassphrase: config.Auth.AuthKey,
 			PrivacyPassphrase:        config.Auth.PrivKey,
 		}
+		g.Version = gosnmp.Version3
+		g.MsgFlags = gosnmp.AuthPriv
+		g.SecurityModel = gosnmp.UserSecurityModel
+		g.SecurityParameters = usm
+		if !config.Inform {
+			// Trap 由本机引擎发出, 使用 Agent 的引擎 ID, 接收方不需要引擎发现。
+			// INFORM 的权威引擎是接收方, 引擎 ID / boots / time 留空, 由 gosnmp 在首次发送时发现 (RFC 3414 4)
+			engineID := string(s.Master.SecurityConfig.AuthoritativeEngineID.Marshal())
+			g.ContextEngineID = engineID
+			usm.AuthoritativeEngineID = engineID
+			usm.AuthoritativeEngineBoots = s.Master.SecurityConfig.AuthoritativeEngineBoots
+		}
 	}
 
 	// 初始化连接
@@ -497,51 +583,116 @@ func (s *SNMP) AddTrap(config TrapConfig) error {
 		return err
 	}
 
-	s.Trap = append(s.Trap, g)
+	if !config.Inform {
+		s.Trap = append(s.Trap, g)
+		return nil
+	}
+
+	if s.InformQueue == nil {
+		s.InformQueue, err = OpenInformQueue(s.Config.InformQueue)
+		if err != nil {
+			return err
+		}
+	}
+	// 重试由队列负责
+	g.Retries = 0
+	s.Inform = append(s.Inform, g)
+	s.InformQueue.AddTarget(g)
 
 	return nil
 }
 
-func (s *SNMP) SendTrap(data TrapData) error {
-	if len(s.Trap) == 0 {
-		return nil
+// 按接收方的版本构造通知。
+// v1 为 Trap-PDU, enterprise 和 specific-trap 按 RFC 3584 3.2 由通知 OID 得到;
+// v2c / v3 为 SNMPv2-Trap, 以 sysUpTime.0 和 snmpTrapOID.0 开头, 后跟通知定义的对象。
+func (s *SNMP) buildTrap(t *gosnmp.GoSNMP, data TrapData) (gosnmp.SnmpTrap, error) {
+	trapOID := s.GetOID(data.OID, -1)
+	uptime := uint32(getSysUpTime())
+
+	var variables []gosnmp.SnmpPDU
+	for _, v := range data.Data {
+		variables = append(variables, gosnmp.SnmpPDU{
+			Name:  s.GetOID(v.OID, v.Index),
+			Type:  v.Type,
+			Value: v.Value,
+		})
 	}
 
-	enterprise, specific, err := ExtractEnterpriseIDAndSpecificTrap(s.GetOID(data.OID, -1))
-	if err != nil {
-		panic(err.Error())
+	if t.Version != gosnmp.Version1 {
+		return gosnmp.SnmpTrap{
+			Variables: append([]gosnmp.SnmpPDU{
+				{Name: sysUpTimeOID, Type: gosnmp.TimeTicks, Value: uptime},
+				{Name: snmpTrapOIDOID, Type: gosnmp.ObjectIdentifier, Value: trapOID},
+			}, variables...),
+		}, nil
 	}
 
-	trap := gosnmp.SnmpTrap{
-		Variables: []gosnmp.SnmpPDU{
-			{
-				Name:  s.GetOID(data.OID, -1),
-				Type:  gosnmp.ObjectIdentifier,
-				Value: s.GetOID(data.OID, -1),
-			},
-		},
+	enterprise, specific, err := ExtractEnterpriseIDAndSpecificTrap(trapOID)
+	if err != nil {
+		return gosnmp.SnmpTrap{}, err
+	}
+	agentAddress := s.TrapAgentAddress
+	if agentAddress == "" {
+		// 未配置时使用发送 Trap 的本机地址
+		if addr, ok := t.Conn.LocalAddr().(*net.UDPAddr); ok {
+			agentAddress = addr.IP.String()
+		}
+	}
+	return gosnmp.SnmpTrap{
+		Variables:    variables,
 		Enterprise:   enterprise,
-		AgentAddress: s.TrapAgentAddress,
+		AgentAddress: agentAddress,
 		GenericTrap:  6,
 		SpecificTrap: specific,
-		Timestamp:    uint(getRunningTimeInSeconds() * 100),
-	}
-	for _, v := range data.Data {
-		trap.Variables = append(trap.Variables, gosnmp.SnmpPDU{
-			Name:  s.GetOID(v.OID, -1),
-			Type:  v.Type,
-			Value: v.Value,
-		})
-	}
+		Timestamp:    uint(uptime),
+	}, nil
+}
 
+// 向所有接收方发送通知, 某个接收方失败不影响其他接收方, 返回第一个错误
+func (s *SNMP) SendTrap(data TrapData) error {
+	var result error
 	for _, t := range s.Trap {
-		_, err := t.SendTrap(trap)
+		trap, err := s.buildTrap(t, data)
+		if err == nil {
+			if usm, ok := t.SecurityParameters.(*gosnmp.UsmSecurityParameters); ok {
+				usm.AuthoritativeEngineTime = s.Master.SecurityConfig.OnGetAuthoritativeEngineTime()
+			}
+			_, err = t.SendTrap(trap)
+		}
 		if err != nil {
-			return err
+			SNMPLogger.Errorf("Send %s to %s:%d faild: %s", data.OID, t.Target, t.Port, err.Error())
+			if result == nil {
+				result = err
+			}
 		}
 	}
+	// INFORM 等待确认, 放入队列异步发送, 不阻塞调用方
+	for _, t := range s.Inform {
+		trap, err := s.buildTrap(t, data)
+		if err != nil {
+			SNMPLogger.Errorf("Send %s to %s:%d faild: %s", data.OID, t.Target, t.Port, err.Error())
+			if result == nil {
+				result = err
+			}
+			continue
+		}
+		s.InformQueue.Add(t, data.OID, trap.Variables)
+	}
+	return result
+}
 
-	return nil
+// 按最小发送间隔发送, 间隔内的重复通知被丢弃
+func (s *SNMP) ScheduleTrap(data TrapData) error {
+	if !s.TrapScheduler.Due(data.OID) {
+		SNMPLogger.Debugf("Skip %s, sent less than %s ago", data.OID, s.TrapScheduler.Intervals[data.OID])
+		return nil
+	}
+	return s.SendTrap(data)
+}
+
+// 通知对应的状态已结束, 再次进入时立即发送
+func (s *SNMP) ResetTrap(name string) {
+	s.TrapScheduler.Reset(name)
 }
 
 func (s *SNMP) SetDevice(device Device) {
@@ -554,14 +705,51 @@ func (s *SNMP) SetSerialSend(fun func(value string)) {
 
 // 关闭 SNMP 服务器。
 func (s *SNMP) Close() {
-	s.Server.Shutdown()
+	s.Listener.Shutdown()
+	if s.InformQueue != nil {
+		s.InformQueue.Close()
+	}
+	s.Notifier.Close()
 }
 
 // 启动 SNMP 服务器。
 func (s *SNMP) Run() {
-	listen := fmt.Sprintf("%s:%d", s.Config.Address, s.Config.Port)
-	s.Master.Logger.Infof("SNMP server is running on %s", listen)
-	s.Server.ServeForever()
+	s.Master.Logger.Infof("SNMP server is running on %s", s.Listener.Address().String())
+	for {
+		request, replyer, err := s.Listener.NextSnmp()
+		if err != nil {
+			s.Master.Logger.Debugf("SNMP server stopped: %s", err.Error())
+			return
+		}
+		s.serve(request, replyer)
+	}
+}
+
+// 处理一个请求。整个 PDU 在锁内处理, 同一请求中的各变量来自同一时刻,
+// 表重建也不会与 GETNEXT / GETBULK 遍历交错。
+func (s *SNMP) serve(request []byte, replyer GoSNMPServer.IReplyer) {
+	s.Lock.Lock()
+	result, err := func() (result []byte, err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return s.Master.ResponseForBuffer(request)
+	}()
+	s.Lock.Unlock()
+
+	if err != nil {
+		s.Master.Logger.Warnf("ResponseForBuffer Error: %v", err)
+	}
+	if len(result) != 0 {
+		if err := replyer.ReplyPDU(result); err != nil {
+			s.Master.Logger.Errorf("Reply PDU faild: %v", err)
+		}
+	}
+	if err != nil {
+		replyer.Shutdown()
+	}
 }
 
 func (s *SNMP) AddPublicOID(oid *GoSNMPServer.PDUValueControlItem) {
@@ -592,6 +780,27 @@ func (s *SNMP) GetOID(name string, count int) string {
 	return fmt.Sprintf(".%s.%d", oid.String(), count)
 }
 
+// 获取 OID 对应的服务名, 找不到时返回原 OID。
+// 带索引的 OID 返回 name.index。
+func (s *SNMP) GetName(oid string) string {
+	var parsed smi.OID
+	for _, part := range strings.Split(strings.TrimPrefix(oid, "."), ".") {
+		id, err := strconv.Atoi(part)
+		if err != nil {
+			return oid
+		}
+		parsed = append(parsed, id)
+	}
+	sym, index := s.Mib.Symbol(parsed)
+	if sym == nil {
+		return oid
+	}
+	if len(index) == 0 {
+		return sym.Name
+	}
+	return sym.Name + "." + index.String()
+}
+
 func (s *SNMP) Apply() {
 	s.Public.SyncConfig()
 }
@@ -602,8 +811,18 @@ func (s *SNMP) Apply() {
 // count: 表的行数。
 // onGet: 获取数据的回调函数。
 func (s *SNMP) AddTable(name string, obj any, count int, tp gosnmp.Asn1BER, onGet func(obj any, index int) (any, error)) {
-	for i := 0; i < count; i++ {
-		index := i + 1
+	indexes := make([]int, count)
+	for i := range indexes {
+		indexes[i] = i + 1
+	}
+	s.AddTableIndexes(name, obj, indexes, tp, onGet)
+}
+
+// 添加索引不连续的表。
+// indexes: 各行的索引。
+func (s *SNMP) AddTableIndexes(name string, obj any, indexes []int, tp gosnmp.Asn1BER, onGet func(obj any, index int) (any, error)) {
+	for _, index := range indexes {
+		index := index
 		s.Public.OIDs = append(s.Public.OIDs, &GoSNMPServer.PDUValueControlItem{
 			OID:  s.GetOID(name, index),
 			Type: tp,
@@ -639,3 +858,41 @@ func (s *SNMP) RemoveTable(name string, index int) {
 		}
 	}
 }
+
+func (s *SNMP) findOID(agent *GoSNMPServer.SubAgent, oid string) *GoSNMPServer.PDUValueControlItem {
+	if agent == nil {
+		return nil
+	}
+	for _, item := range agent.OIDs {
+		if item.OID == oid {
+			return item
+		}
+	}
+	return nil
+}
+
+// 读取服务当前值, 与 SNMP GET 返回的值相同。调用方需持有 Lock。
+// name: 服务名。
+// index: 索引。0: 标量。其他: 表索引。
+func (s *SNMP) GetValue(name string, index int) (any, error) {
+	item := s.findOID(s.Public, s.GetOID(name, index))
+	if item == nil || item.OnGet == nil {
+		return nil, fmt.Errorf("%s.%d not found", name, index)
+	}
+	return item.OnGet()
+}
+
+// 写入服务值, 与 SNMP SET 走相同的回调。调用方需持有 Lock。
+// name: 服务名。
+// index: 索引。0: 标量。其他: 表索引。
+func (s *SNMP) SetValue(name string, index int, value any) error {
+	oid := s.GetOID(name, index)
+	item := s.findOID(s.Private, oid)
+	if item == nil || item.OnSet == nil {
+		item = s.findOID(s.Public, oid)
+	}
+	if item == nil || item.OnSet == nil {
+		return fmt.Errorf("%s.%d is not writable", name, index)
+	}
+	return item.OnSet(value)
+}
@@ -0,0 +1,1040 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+	"github.com/slayercat/GoSNMPServer"
+)
+
+const upsMIBRoot = ".1.3.6.1.2.1.33"
+
+// 测试日志写入临时目录, 不在源码目录下生成 logs
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "santak-ups-logs")
+	if err != nil {
+		panic(err)
+	}
+	Logger = newLog(dir, "app")
+	SNMPLogger = newLog(dir, "snmp")
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// 启动一个不连接串口的 Agent, 串口应答通过 serialReceived 注入
+func newTestAgent(t *testing.T, profileName string, snmpConfig SNMPConfig) *SNMP {
+	t.Helper()
+
+	profile, err := LoadDeviceProfile(profileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestAgentProfile(t, profile, snmpConfig)
+}
+
+func newTestAgentProfile(t *testing.T, profile *DeviceProfile, snmpConfig SNMPConfig) *SNMP {
+	t.Helper()
+
+	device, err := NewDevice(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data = &SNMPData{
+		Ident:   &SNMPDataIdent{},
+		Battery: &SNMPDataBattery{},
+		Input:   &SNMPDataInput{},
+		Output:  &SNMPDataOutput{},
+		Bypass:  &SNMPDataBypass{},
+		Alarm:   &SNMPDataAlarm{},
+		Test:    &SNMPDataTest{},
+		Control: &SNMPDataControl{},
+		Config:  &SNMPDataConfig{},
+	}
+	alarm = Alarm{}
+	control = Control{}
+
+	if snmpConfig.PublicName == "" {
+		snmpConfig.PublicName = "public"
+	}
+	if snmpConfig.PrivateName == "" {
+		snmpConfig.PrivateName = "private"
+	}
+	snmpConfig.Address = "127.0.0.1"
+	snmpConfig.Port = 0
+	snmpConfig.SetCallback = device.SetCallback
+	snmpConfig.Logger = GoSNMPServer.WrapLogrus(SNMPLogger)
+
+	snmp := snmp_server(snmpConfig, device.EnableService, data)
+	snmp.SetDevice(device)
+	snmp.SetSerialSend(func(cmd string) {})
+
+	alarm.SetSNMP(snmp)
+	control.SetSNMP(snmp)
+
+	err = device.InitCallback(snmp, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go snmp.Run()
+	t.Cleanup(snmp.Close)
+
+	return snmp
+}
+
+func newTestClient(t *testing.T, snmp *SNMP, community string) *gosnmp.GoSNMP {
+	t.Helper()
+	return connectTestClient(t, snmp, &gosnmp.GoSNMP{
+		Community: community,
+		Version:   gosnmp.Version2c,
+	})
+}
+
+// v3 用户与测试 Agent 中 Auth 的第一个用户相同, context 选择共同体
+func newTestClientV3(t *testing.T, snmp *SNMP, context string) *gosnmp.GoSNMP {
+	t.Helper()
+	auth := snmp.Config.Auth[0]
+	return connectTestClient(t, snmp, &gosnmp.GoSNMP{
+		Version:       gosnmp.Version3,
+		SecurityModel: gosnmp.UserSecurityModel,
+		MsgFlags:      gosnmp.AuthPriv,
+		ContextName:   context,
+		SecurityParameters: &gosnmp.UsmSecurityParameters{
+			UserName:                 auth.Username,
+			AuthenticationProtocol:   auth.AuthProto,
+			AuthenticationPassphrase: auth.AuthKey,
+			PrivacyProtocol:          auth.PrivProto,
+			PrivacyPassphrase:        auth.PrivKey,
+		},
+	})
+}
+
+func connectTestClient(t *testing.T, snmp *SNMP, client *gosnmp.GoSNMP) *gosnmp.GoSNMP {
+	t.Helper()
+
+	client.Target = "127.0.0.1"
+	client.Port = uint16(snmp.Listener.Address().(*net.UDPAddr).Port)
+	if client.Timeout == 0 {
+		client.Timeout = 2 * time.Second
+		client.Retries = 1
+	}
+	err := client.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Conn.Close() })
+	return client
+}
+
+// go test -race 下串口应答、告警表重建与多个并发 walk 同时进行
+func TestConcurrentWalk(t *testing.T) {
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+
+	replies := []string{
+		"(228.0 228.0 228.4 006 50.2 27.4 25.0 00001000",
+		"(000.0 228.0 228.4 017 00.0 24.1 25.0 11001001",
+		"(228.0 228.0 228.4 130 50.0 27.4 25.0 00011010",
+	}
+
+	stop := make(chan struct{})
+	var feeder sync.WaitGroup
+	feeder.Add(1)
+	go func() {
+		defer feeder.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			serialReceived(snmp, "Q1", replies[i%len(replies)])
+			serialReceived(snmp, "F", "#220.0 007 24.00 50.0")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	var walkers sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 4; i++ {
+		walkers.Add(1)
+		go func(bulk bool) {
+			defer walkers.Done()
+			client := newTestClient(t, snmp, "public")
+			for n := 0; n < 10; n++ {
+				var pdus []gosnmp.SnmpPDU
+				var err error
+				if bulk {
+					pdus, err = client.BulkWalkAll(upsMIBRoot)
+				} else {
+					pdus, err = client.WalkAll(upsMIBRoot)
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+				if len(pdus) == 0 {
+					errs <- fmt.Errorf("empty walk")
+					return
+				}
+			}
+		}(i%2 == 0)
+	}
+	walkers.Wait()
+	close(stop)
+	feeder.Wait()
+
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// 测试 Agent 的 v3 用户
+var testSNMPUser = SNMPAuth{
+	Username:  "test",
+	AuthKey:   "authpass1",
+	PrivKey:   "privpass1",
+	AuthProto: gosnmp.SHA,
+	PrivProto: gosnmp.AES,
+}
+
+var testSNMPVersions = []gosnmp.SnmpVersion{gosnmp.Version1, gosnmp.Version2c, gosnmp.Version3}
+
+// 启动指定版本的 Agent, 返回按共同体(v3 为 context)创建客户端的函数。
+// 配置了 v3 用户时 Agent 只接受 v3
+func newTestVersionAgent(t *testing.T, profile *DeviceProfile, version gosnmp.SnmpVersion) (*SNMP, func(community string) *gosnmp.GoSNMP) {
+	t.Helper()
+
+	snmpConfig := SNMPConfig{}
+	if version == gosnmp.Version3 {
+		snmpConfig.Auth = []SNMPAuth{testSNMPUser}
+	}
+	snmp := newTestAgentProfile(t, profile, snmpConfig)
+
+	return snmp, func(community string) *gosnmp.GoSNMP {
+		if version == gosnmp.Version3 {
+			return newTestClientV3(t, snmp, community)
+		}
+		return connectTestClient(t, snmp, &gosnmp.GoSNMP{
+			Community: community,
+			Version:   version,
+		})
+	}
+}
+
+func loadTestProfile(t *testing.T, name string) *DeviceProfile {
+	t.Helper()
+	profile, err := LoadDeviceProfile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+// 市电异常且电池低电压, 告警表中有多行
+func feedTestReplies(snmp *SNMP) {
+	serialReceived(snmp, "F", "#220.0 007 24.00 50.0")
+	serialReceived(snmp, "I", "#SANTAK          MT1000-PRO V1.0      ")
+	serialReceived(snmp, "Q1", "(000.0 228.0 228.4 017 00.0 22.1 25.0 11001001")
+}
+
+type testScalar struct {
+	Name     string
+	OID      string
+	Type     gosnmp.Asn1BER
+	Value    any // OctetString 为 string
+	Writable bool
+}
+
+// SNMPData 中已启用的标量及其期望的类型和值, 调用方需持有 snmp.Lock
+func testScalars(snmp *SNMP, services []string) []testScalar {
+	enabled := map[string]bool{}
+	for _, name := range services {
+		enabled[name] = true
+	}
+
+	var result []testScalar
+	root := reflect.ValueOf(snmp.Data).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		group := root.Field(i)
+		if group.Kind() != reflect.Ptr || group.IsNil() {
+			continue
+		}
+		group = group.Elem()
+		for j := 0; j < group.NumField(); j++ {
+			parts := strings.Split(group.Type().Field(j).Tag.Get("snmp"), ",")
+			if !enabled[parts[0]] {
+				continue
+			}
+			scalar := testScalar{
+				Name: parts[0],
+				OID:  snmp.GetOID(parts[0], 0),
+			}
+			for _, part := range parts[1:] {
+				if part == "w" {
+					scalar.Writable = true
+				}
+			}
+			switch v := group.Field(j).Interface().(type) {
+			case string:
+				scalar.Type = gosnmp.OctetString
+				if parts[len(parts)-1] == "oid" {
+					scalar.Type = gosnmp.ObjectIdentifier
+				}
+				scalar.Value = v
+			case int:
+				scalar.Type = gosnmp.Integer
+				scalar.Value = v
+			case TimesTamp:
+				scalar.Type = gosnmp.TimeTicks
+				scalar.Value = uint32(v)
+			}
+			result = append(result, scalar)
+		}
+	}
+	return result
+}
+
+func pduValue(pdu gosnmp.SnmpPDU) any {
+	if b, ok := pdu.Value.([]byte); ok {
+		return string(b)
+	}
+	return pdu.Value
+}
+
+func checkScalar(t *testing.T, pdu gosnmp.SnmpPDU, want testScalar) {
+	t.Helper()
+	if pdu.Type != want.Type {
+		t.Errorf("%s: type %s, want %s", want.Name, pdu.Type, want.Type)
+		return
+	}
+	if !reflect.DeepEqual(pduValue(pdu), want.Value) {
+		t.Errorf("%s: value %#v, want %#v", want.Name, pduValue(pdu), want.Value)
+	}
+}
+
+func TestSNMPGet(t *testing.T) {
+	for _, version := range testSNMPVersions {
+		t.Run(version.String(), func(t *testing.T) {
+			profile := loadTestProfile(t, "mt1000-pro")
+			snmp, client := newTestVersionAgent(t, profile, version)
+			feedTestReplies(snmp)
+
+			snmp.Lock.Lock()
+			scalars := testScalars(snmp, profile.Services)
+			snmp.Lock.Unlock()
+			if len(scalars) != len(profile.Services) {
+				t.Fatalf("%d scalars for %d services", len(scalars), len(profile.Services))
+			}
+
+			public := client("public")
+			for start := 0; start < len(scalars); start += 10 {
+				end := min(start+10, len(scalars))
+				var oids []string
+				for _, scalar := range scalars[start:end] {
+					oids = append(oids, scalar.OID)
+				}
+				result, err := public.Get(oids)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Error != gosnmp.NoError {
+					t.Fatalf("get %v: %s", oids, result.Error)
+				}
+				for i, pdu := range result.Variables {
+					checkScalar(t, pdu, scalars[start+i])
+				}
+			}
+
+			// 表中的单元格
+			result, err := public.Get([]string{
+				snmp.GetOID("upsInputVoltage", 1),
+				snmp.GetOID("upsAlarmId", 1),
+				snmp.GetOID("upsAlarmDescr", 1),
+				snmp.GetOID("upsAlarmTime", 1),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			types := []gosnmp.Asn1BER{gosnmp.Integer, gosnmp.Integer, gosnmp.ObjectIdentifier, gosnmp.TimeTicks}
+			for i, pdu := range result.Variables {
+				if pdu.Type != types[i] {
+					t.Errorf("%s: type %s, want %s", snmp.GetName(pdu.Name), pdu.Type, types[i])
+				}
+			}
+		})
+	}
+}
+
+// 表列的期望类型
+var testColumnTypes = map[string]gosnmp.Asn1BER{
+	"upsInputLineIndex":    gosnmp.Integer,
+	"upsInputFrequency":    gosnmp.Integer,
+	"upsInputVoltage":      gosnmp.Integer,
+	"upsInputCurrent":      gosnmp.Integer,
+	"upsInputTruePower":    gosnmp.Integer,
+	"upsOutputLineIndex":   gosnmp.Integer,
+	"upsOutputVoltage":     gosnmp.Integer,
+	"upsOutputCurrent":     gosnmp.Integer,
+	"upsOutputPower":       gosnmp.Integer,
+	"upsOutputPercentLoad": gosnmp.Integer,
+	"upsBypassLineIndex":   gosnmp.Integer,
+	"upsBypassVoltage":     gosnmp.Integer,
+	"upsBypassCurrent":     gosnmp.Integer,
+	"upsBypassPower":       gosnmp.Integer,
+	"upsAlarmId":           gosnmp.Integer,
+	"upsAlarmDescr":        gosnmp.ObjectIdentifier,
+	"upsAlarmTime":         gosnmp.TimeTicks,
+}
+
+func checkWalk(t *testing.T, snmp *SNMP, profile *DeviceProfile, pdus []gosnmp.SnmpPDU) {
+	t.Helper()
+
+	snmp.Lock.Lock()
+	scalars := testScalars(snmp, profile.Services)
+	rows := map[string]int{
+		"upsInput":  snmp.Data.Input.NumLines,
+		"upsOutput": snmp.Data.Output.NumLines,
+		"upsBypass": snmp.Data.Bypass.NumLines,
+		"upsAlarm":  snmp.Data.Alarm.Present,
+	}
+	snmp.Lock.Unlock()
+
+	byOID := map[string]gosnmp.SnmpPDU{}
+	columns := map[string]int{}
+	last := ""
+	for _, pdu := range pdus {
+		if last != "" && !oidLess(last, pdu.Name) {
+			t.Errorf("walk not increasing: %s after %s", pdu.Name, last)
+		}
+		last = pdu.Name
+		byOID[pdu.Name] = pdu
+
+		if s, ok := pduValue(pdu).(string); ok && strings.HasPrefix(s, "ERROR") {
+			t.Errorf("%s: %s", snmp.GetName(pdu.Name), s)
+		}
+
+		name := snmp.GetName(pdu.Name)
+		column := strings.SplitN(name, ".", 2)[0]
+		if tp, ok := testColumnTypes[column]; ok {
+			columns[column]++
+			if pdu.Type != tp {
+				t.Errorf("%s: type %s, want %s", name, pdu.Type, tp)
+			}
+		}
+	}
+
+	for _, scalar := range scalars {
+		pdu, ok := byOID[scalar.OID]
+		if !ok {
+			t.Errorf("%s missing from walk", scalar.Name)
+			continue
+		}
+		checkScalar(t, pdu, scalar)
+	}
+	for column := range testColumnTypes {
+		for prefix, n := range rows {
+			if strings.HasPrefix(column, prefix) && columns[column] != n {
+				t.Errorf("%s: %d rows, want %d", column, columns[column], n)
+			}
+		}
+	}
+	if rows["upsAlarm"] == 0 {
+		t.Error("no alarms present")
+	}
+}
+
+// 按数值比较 OID
+func oidLess(a, b string) bool {
+	pa := strings.Split(strings.TrimPrefix(a, "."), ".")
+	pb := strings.Split(strings.TrimPrefix(b, "."), ".")
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, _ := strconv.Atoi(pa[i])
+		y, _ := strconv.Atoi(pb[i])
+		if x != y {
+			return x < y
+		}
+	}
+	return len(pa) < len(pb)
+}
+
+func TestSNMPWalk(t *testing.T) {
+	for _, profileName := range []string{"mt1000-pro", "three-phase"} {
+		for _, version := range testSNMPVersions {
+			t.Run(profileName+"/"+version.String(), func(t *testing.T) {
+				profile := loadTestProfile(t, profileName)
+				snmp, client := newTestVersionAgent(t, profile, version)
+				feedTestReplies(snmp)
+
+				public := client("public")
+				pdus, err := public.WalkAll(upsMIBRoot)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkWalk(t, snmp, profile, pdus)
+
+				if version == gosnmp.Version1 {
+					return
+				}
+				pdus, err = public.BulkWalkAll(upsMIBRoot)
+				if err != nil {
+					t.Fatal(err)
+				}
+				checkWalk(t, snmp, profile, pdus)
+			})
+		}
+	}
+}
+
+func TestSNMPSet(t *testing.T) {
+	for _, version := range testSNMPVersions {
+		t.Run(version.String(), func(t *testing.T) {
+			profile := loadTestProfile(t, "mt1000-pro")
+			profile.Services = append(profile.Services, "upsIdentName")
+			snmp, client := newTestVersionAgent(t, profile, version)
+			feedTestReplies(snmp)
+
+			var sent []string
+			snmp.SetSerialSend(func(cmd string) {
+				sent = append(sent, cmd)
+			})
+
+			public := client("public")
+			private := client("private")
+
+			get := func(name string) any {
+				t.Helper()
+				result, err := public.Get([]string{snmp.GetOID(name, 0)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return pduValue(result.Variables[0])
+			}
+			set := func(c *gosnmp.GoSNMP, pdu gosnmp.SnmpPDU) error {
+				t.Helper()
+				result, err := c.Set([]gosnmp.SnmpPDU{pdu})
+				if err != nil {
+					return err
+				}
+				if result.Error != gosnmp.NoError {
+					return fmt.Errorf("%s", result.Error)
+				}
+				return nil
+			}
+
+			// 只读共同体不能写入任何对象
+			snmp.Lock.Lock()
+			scalars := testScalars(snmp, profile.Services)
+			snmp.Lock.Unlock()
+			for _, scalar := range scalars {
+				value := scalar.Value
+				if scalar.Type == gosnmp.OctetString {
+					value = "changed"
+				}
+				err := set(public, gosnmp.SnmpPDU{Name: scalar.OID, Type: scalar.Type, Value: value})
+				if err == nil {
+					t.Errorf("%s: set with public community succeeded", scalar.Name)
+				}
+			}
+
+			name := snmp.GetOID("upsIdentName", 0)
+			err := set(private, gosnmp.SnmpPDU{Name: name, Type: gosnmp.OctetString, Value: "rack-1"})
+			if err != nil {
+				t.Fatalf("set upsIdentName: %s", err)
+			}
+			if v := get("upsIdentName"); v != "rack-1" {
+				t.Fatalf("upsIdentName = %#v", v)
+			}
+
+			// 类型错误时不修改
+			err = set(private, gosnmp.SnmpPDU{Name: snmp.GetOID("upsConfigLowBattTime", 0), Type: gosnmp.OctetString, Value: "1"})
+			if err == nil {
+				t.Fatal("set upsConfigLowBattTime with OctetString succeeded")
+			}
+			if v := get("upsConfigLowBattTime"); v != profile.Rating.LowBatteryTime {
+				t.Fatalf("upsConfigLowBattTime = %#v", v)
+			}
+
+			// 只读对象在读写共同体中同样不可写
+			err = set(private, gosnmp.SnmpPDU{Name: snmp.GetOID("upsBatteryStatus", 0), Type: gosnmp.Integer, Value: 2})
+			if err == nil {
+				t.Fatal("set upsBatteryStatus succeeded")
+			}
+
+			quickTest := snmp.GetOID("upsTestQuickBatteryTest", -1)
+			err = set(private, gosnmp.SnmpPDU{Name: snmp.GetOID("upsTestId", 0), Type: gosnmp.ObjectIdentifier, Value: quickTest})
+			if err != nil {
+				t.Fatalf("set upsTestId: %s", err)
+			}
+			if v := get("upsTestId"); v != quickTest {
+				t.Fatalf("upsTestId = %#v", v)
+			}
+			if v := get("upsTestResultsSummary"); v != 5 {
+				t.Fatalf("upsTestResultsSummary = %#v", v)
+			}
+
+			snmp.Lock.Lock()
+			defer snmp.Lock.Unlock()
+			if len(sent) != 1 || sent[0] != profile.Commands.Test {
+				t.Fatalf("sent %v, want [%s]", sent, profile.Commands.Test)
+			}
+		})
+	}
+}
+
+// 配置了 v3 用户时拒绝 v1 / v2c 请求
+func TestSNMPv3Only(t *testing.T) {
+	profile := loadTestProfile(t, "mt1000-pro")
+	snmp, _ := newTestVersionAgent(t, profile, gosnmp.Version3)
+
+	client := connectTestClient(t, snmp, &gosnmp.GoSNMP{
+		Community: "public",
+		Version:   gosnmp.Version2c,
+		Timeout:   200 * time.Millisecond,
+	})
+	_, err := client.Get([]string{snmp.GetOID("upsIdentModel", 0)})
+	if err == nil {
+		t.Fatal("v2c request answered by v3 only agent")
+	}
+}
+
+// 测试 Trap 接收端收到的通知
+type testTraps struct {
+	lock     sync.Mutex
+	received []*gosnmp.SnmpPacket
+}
+
+// 在空闲端口上启动 Trap 接收端
+func newTestTrapListener(t *testing.T, params *gosnmp.GoSNMP) (uint16, *testTraps) {
+	t.Helper()
+
+	port := freeTestPort(t)
+	return port, startTestTrapListener(t, params, port)
+}
+
+func freeTestPort(t *testing.T) uint16 {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+func startTestTrapListener(t *testing.T, params *gosnmp.GoSNMP, port uint16) *testTraps {
+	t.Helper()
+
+	traps := &testTraps{}
+	listener := gosnmp.NewTrapListener()
+	listener.Params = params
+	listener.OnNewTrap = func(packet *gosnmp.SnmpPacket, addr *net.UDPAddr) {
+		traps.lock.Lock()
+		traps.received = append(traps.received, packet)
+		traps.lock.Unlock()
+	}
+	go listener.Listen(fmt.Sprintf("127.0.0.1:%d", port))
+	select {
+	case <-listener.Listening():
+	case <-time.After(2 * time.Second):
+		t.Fatal("trap listener not started")
+	}
+	t.Cleanup(listener.Close)
+
+	return traps
+}
+
+// 等待指定的通知, v1 按 enterprise / specific-trap 识别, v2c / v3 按 snmpTrapOID.0 识别
+func (traps *testTraps) wait(t *testing.T, snmp *SNMP, name string) *gosnmp.SnmpPacket {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if packets := traps.find(t, snmp, name); len(packets) != 0 {
+			return packets[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%s not received", name)
+	return nil
+}
+
+// 已收到的指定通知
+func (traps *testTraps) find(t *testing.T, snmp *SNMP, name string) []*gosnmp.SnmpPacket {
+	t.Helper()
+
+	trapOID := snmp.GetOID(name, -1)
+	enterprise, specific, err := ExtractEnterpriseIDAndSpecificTrap(trapOID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	traps.lock.Lock()
+	defer traps.lock.Unlock()
+	var packets []*gosnmp.SnmpPacket
+	for _, packet := range traps.received {
+		if packet.Version == gosnmp.Version1 {
+			if packet.Enterprise == enterprise && packet.SpecificTrap == specific {
+				packets = append(packets, packet)
+			}
+		} else if len(packet.Variables) >= 2 && packet.Variables[1].Value == trapOID {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+func TestSNMPTrap(t *testing.T) {
+	for _, version := range testSNMPVersions {
+		t.Run(version.String(), func(t *testing.T) {
+			snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+
+			params := &gosnmp.GoSNMP{
+				Version:   version,
+				Community: "public",
+				Logger:    gosnmp.NewLogger(SNMPLogger),
+			}
+			config := TrapConfig{
+				Host:      "127.0.0.1",
+				Community: "public",
+				Version:   version,
+			}
+			if version == gosnmp.Version3 {
+				params.SecurityModel = gosnmp.UserSecurityModel
+				params.MsgFlags = gosnmp.AuthPriv
+				params.SecurityParameters = &gosnmp.UsmSecurityParameters{
+					UserName:                 testSNMPUser.Username,
+					AuthenticationProtocol:   testSNMPUser.AuthProto,
+					AuthenticationPassphrase: testSNMPUser.AuthKey,
+					PrivacyProtocol:          testSNMPUser.PrivProto,
+					PrivacyPassphrase:        testSNMPUser.PrivKey,
+				}
+				auth := testSNMPUser
+				config.Auth = &auth
+			}
+			port, traps := newTestTrapListener(t, params)
+			config.Port = port
+
+			err := snmp.AddTrap(config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			feedTestReplies(snmp)
+
+			packet := traps.wait(t, snmp, "upsTrapOnBattery")
+			objects := []string{"upsEstimatedMinutesRemaining", "upsSecondsOnBattery", "upsConfigLowBattTime"}
+			variables := packet.Variables
+			if version == gosnmp.Version1 {
+				if packet.GenericTrap != 6 || packet.AgentAddress != "127.0.0.1" {
+					t.Fatalf("generic-trap %d agent-addr %s", packet.GenericTrap, packet.AgentAddress)
+				}
+			} else {
+				if variables[0].Name != sysUpTimeOID || variables[0].Type != gosnmp.TimeTicks {
+					t.Fatalf("first varbind %s %s, want sysUpTime.0", variables[0].Name, variables[0].Type)
+				}
+				if variables[1].Name != snmpTrapOIDOID || variables[1].Type != gosnmp.ObjectIdentifier {
+					t.Fatalf("second varbind %s %s, want snmpTrapOID.0", variables[1].Name, variables[1].Type)
+				}
+				variables = variables[2:]
+			}
+			if len(variables) != len(objects) {
+				t.Fatalf("%d varbinds, want %d", len(variables), len(objects))
+			}
+			for i, name := range objects {
+				if variables[i].Name != snmp.GetOID(name, 0) || variables[i].Type != gosnmp.Integer {
+					t.Errorf("varbind %d: %s %s, want %s.0", i, variables[i].Name, variables[i].Type, name)
+				}
+			}
+
+			packet = traps.wait(t, snmp, "upsTrapAlarmEntryAdded")
+			variables = packet.Variables
+			if version != gosnmp.Version1 {
+				variables = variables[2:]
+			}
+			if len(variables) != 2 || variables[1].Type != gosnmp.ObjectIdentifier {
+				t.Fatalf("unexpected alarm varbinds %v", variables)
+			}
+		})
+	}
+}
+
+// 测试 Agent 向 v2c 接收端发送通知
+func newTestTrapAgent(t *testing.T, profileName string) (*SNMP, *testTraps) {
+	t.Helper()
+
+	snmp := newTestAgent(t, profileName, SNMPConfig{})
+	port, traps := newTestTrapListener(t, &gosnmp.GoSNMP{
+		Version:   gosnmp.Version2c,
+		Community: "public",
+		Logger:    gosnmp.NewLogger(SNMPLogger),
+	})
+	err := snmp.AddTrap(TrapConfig{
+		Host:      "127.0.0.1",
+		Port:      port,
+		Community: "public",
+		Version:   gosnmp.Version2c,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return snmp, traps
+}
+
+// 电池供电期间每次轮询都会产生 upsTrapOnBattery, 间隔内只发送一次, 再次断电时立即发送。
+// 三相机型只有 G2 表示电池供电时同样发送和复位
+func TestSNMPTrapOnBatteryInterval(t *testing.T) {
+	for _, test := range []struct {
+		profile   string
+		cmd       string
+		onBattery string
+		normal    string
+	}{
+		{"mt1000-pro", "Q1", "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000"},
+		{"three-phase", "G2", "!00000100 00000011 00000000", "!00000001 00000111 00000000"},
+	} {
+		t.Run(test.profile, func(t *testing.T) {
+			snmp, traps := newTestTrapAgent(t, test.profile)
+
+			onBattery := func() {
+				for i := 0; i < 5; i++ {
+					serialReceived(snmp, test.cmd, test.onBattery)
+				}
+				traps.wait(t, snmp, "upsTrapOnBattery")
+				// 等待可能多发的通知
+				time.Sleep(100 * time.Millisecond)
+			}
+
+			onBattery()
+			if n := len(traps.find(t, snmp, "upsTrapOnBattery")); n != 1 {
+				t.Fatalf("received %d upsTrapOnBattery, want 1", n)
+			}
+
+			serialReceived(snmp, test.cmd, test.normal)
+			onBattery()
+			if n := len(traps.find(t, snmp, "upsTrapOnBattery")); n != 2 {
+				t.Fatalf("received %d upsTrapOnBattery after mains restore, want 2", n)
+			}
+		})
+	}
+}
+
+// 测试完成和超时都发送 upsTrapTestCompleted, 携带测试组的全部对象
+func TestSNMPTrapTestCompleted(t *testing.T) {
+	snmp, traps := newTestTrapAgent(t, "mt1000-pro")
+	private := newTestClient(t, snmp, "private")
+	set := func(name string, pdu gosnmp.SnmpPDU) {
+		t.Helper()
+		pdu.Name = snmp.GetOID(name, 0)
+		result, err := private.Set([]gosnmp.SnmpPDU{pdu})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Error != gosnmp.NoError {
+			t.Fatalf("set %s: %s", name, result.Error)
+		}
+	}
+	startTest := func() {
+		t.Helper()
+		set("upsTestSpinLock", gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: 1})
+		set("upsTestId", gosnmp.SnmpPDU{Type: gosnmp.ObjectIdentifier, Value: snmp.GetOID("upsTestQuickBatteryTest", -1)})
+	}
+	const (
+		idle   = "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000"
+		inTest = "(228.0 228.0 228.4 017 50.0 26.1 25.0 00001100"
+	)
+	check := func(packet *gosnmp.SnmpPacket, id string, summary int, detail string) {
+		t.Helper()
+		want := []struct {
+			name  string
+			value any
+		}{
+			{"upsTestId", snmp.GetOID(id, -1)},
+			{"upsTestSpinLock", 3},
+			{"upsTestResultsSummary", summary},
+			{"upsTestResultsDetail", detail},
+			{"upsTestStartTime", nil},
+			{"upsTestElapsedTime", nil},
+		}
+		variables := packet.Variables[2:]
+		if len(variables) != len(want) {
+			t.Fatalf("%d varbinds, want %d", len(variables), len(want))
+		}
+		for i, w := range want {
+			if variables[i].Name != snmp.GetOID(w.name, 0) {
+				t.Fatalf("varbind %d: %s, want %s.0", i, variables[i].Name, w.name)
+			}
+			if w.value != nil && pduValue(variables[i]) != w.value {
+				t.Fatalf("%s = %#v, want %#v", w.name, pduValue(variables[i]), w.value)
+			}
+		}
+	}
+
+	serialReceived(snmp, "Q1", idle)
+	before := getSysUpTime()
+	startTest()
+	serialReceived(snmp, "Q1", inTest)
+	time.Sleep(100 * time.Millisecond)
+	serialReceived(snmp, "Q1", inTest)
+	if packets := traps.find(t, snmp, "upsTrapTestCompleted"); len(packets) != 0 {
+		t.Fatal("upsTrapTestCompleted sent while test in progress")
+	}
+	serialReceived(snmp, "Q1", idle)
+	after := getSysUpTime()
+	packet := traps.wait(t, snmp, "upsTrapTestCompleted")
+	check(packet, "upsTestQuickBatteryTest", 1, "Quick battery test passed")
+
+	// 开始时间为 sysUpTime, 持续时间为 TimeTicks (0.01 秒)
+	start := TimesTamp(gosnmp.ToBigInt(packet.Variables[6].Value).Int64())
+	elapsed := TimesTamp(gosnmp.ToBigInt(packet.Variables[7].Value).Int64())
+	if start < before || start > after {
+		t.Errorf("upsTestStartTime %d, want between %d and %d", start, before, after)
+	}
+	if elapsed < 10 || elapsed > after-before {
+		t.Errorf("upsTestElapsedTime %d, want between 10 and %d", elapsed, after-before)
+	}
+
+	// UPS 未开始测试
+	startTest()
+	for i := 0; i <= 20; i++ {
+		serialReceived(snmp, "Q1", idle)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for len(traps.find(t, snmp, "upsTrapTestCompleted")) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("upsTrapTestCompleted not sent on timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	check(traps.find(t, snmp, "upsTrapTestCompleted")[1], "upsTestAbortTestInProgress", 4, "Time out")
+}
+
+// upsWellKnownTests 对应的命令和结果
+func TestSNMPWellKnownTests(t *testing.T) {
+	const (
+		idle    = "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000"
+		inTest  = "(228.0 228.0 228.4 017 50.0 26.1 25.0 00001100"
+		lowTest = "(228.0 228.0 228.4 017 50.0 21.1 25.0 01001100"
+		lowIdle = "(228.0 228.0 228.4 017 50.0 21.1 25.0 01001000"
+		fault   = "(228.0 228.0 228.4 017 50.0 26.1 25.0 00011000"
+	)
+	tests := []struct {
+		profile string
+		test    string
+		sent    []string // 为空表示设备不支持, 写入失败
+		replies []string
+		summary int
+		detail  string
+	}{
+		{"three-phase", "upsTestQuickBatteryTest", []string{"T"}, []string{inTest, idle}, 1, "Quick battery test passed"},
+		{"three-phase", "upsTestQuickBatteryTest", []string{"T"}, []string{inTest, fault}, 3, "Quick battery test failed: UPS fault"},
+		{"three-phase", "upsTestQuickBatteryTest", []string{"T"}, []string{lowTest, lowIdle}, 2, "Quick battery test completed: battery low"},
+		{"three-phase", "upsTestDeepBatteryCalibration", []string{"TL"}, []string{inTest, lowTest, lowIdle}, 1, "Deep battery calibration passed"},
+		{"three-phase", "upsTestGeneralSystemsTest", []string{"T01"}, []string{inTest, idle}, 1, "General systems test passed"},
+		{"three-phase", "upsTestAbortTestInProgress", []string{"T", "CT"}, []string{inTest}, 4, "Aborted"},
+		{"mt1000-pro", "upsTestQuickBatteryTest", []string{"T"}, []string{inTest, idle}, 1, "Quick battery test passed"},
+		{"mt1000-pro", "upsTestDeepBatteryCalibration", nil, nil, 6, ""},
+		{"mt1000-pro", "upsTestGeneralSystemsTest", nil, nil, 6, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.profile+"/"+test.test, func(t *testing.T) {
+			snmp, traps := newTestTrapAgent(t, test.profile)
+			private := newTestClient(t, snmp, "private")
+			public := newTestClient(t, snmp, "public")
+			var sent []string
+			snmp.SetSerialSend(func(cmd string) {
+				sent = append(sent, cmd)
+			})
+			set := func(name string) error {
+				t.Helper()
+				result, err := private.Set([]gosnmp.SnmpPDU{{Name: snmp.GetOID("upsTestId", 0), Type: gosnmp.ObjectIdentifier, Value: snmp.GetOID(name, -1)}})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if result.Error != gosnmp.NoError {
+					return fmt.Errorf("%s", result.Error)
+				}
+				return nil
+			}
+			get := func(name string) any {
+				t.Helper()
+				result, err := public.Get([]string{snmp.GetOID(name, 0)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				return pduValue(result.Variables[0])
+			}
+
+			serialReceived(snmp, "Q1", idle)
+			testId := test.test
+			if testId == "upsTestAbortTestInProgress" {
+				if err := set("upsTestQuickBatteryTest"); err != nil {
+					t.Fatal(err)
+				}
+				serialReceived(snmp, "Q1", inTest)
+			}
+			err := set(testId)
+			if test.sent == nil {
+				if err == nil {
+					t.Fatalf("set %s succeeded", testId)
+				}
+				if v := get("upsTestId"); v != snmp.GetOID("upsTestNoTestsInitiated", -1) {
+					t.Fatalf("upsTestId = %#v after failed set", v)
+				}
+			} else if err != nil {
+				t.Fatalf("set %s: %s", testId, err)
+			}
+			for _, reply := range test.replies {
+				serialReceived(snmp, "Q1", reply)
+			}
+
+			snmp.Lock.Lock()
+			if fmt.Sprint(sent) != fmt.Sprint(test.sent) {
+				t.Errorf("sent %v, want %v", sent, test.sent)
+			}
+			snmp.Lock.Unlock()
+			if v := get("upsTestResultsSummary"); v != test.summary {
+				t.Fatalf("upsTestResultsSummary = %#v, want %d", v, test.summary)
+			}
+			if v := get("upsTestResultsDetail"); v != test.detail {
+				t.Fatalf("upsTestResultsDetail = %#v, want %#v", v, test.detail)
+			}
+			if test.sent != nil {
+				if v := get("upsTestId"); v != snmp.GetOID(testId, -1) {
+					t.Fatalf("upsTestId = %#v, want %s", v, testId)
+				}
+				traps.wait(t, snmp, "upsTrapTestCompleted")
+			}
+		})
+	}
+}
+
+func TestExtractEnterpriseIDAndSpecificTrap(t *testing.T) {
+	tests := []struct {
+		oid        string
+		enterprise string
+		specific   int
+	}{
+		{".1.3.6.1.2.1.33.2.1", ".1.3.6.1.2.1.33.2", 1},
+		{"1.3.6.1.2.1.33.2.4", ".1.3.6.1.2.1.33.2", 4},
+		{".1.3.6.1.4.1.935.0.5", ".1.3.6.1.4.1.935", 5},
+	}
+	for _, test := range tests {
+		enterprise, specific, err := ExtractEnterpriseIDAndSpecificTrap(test.oid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if enterprise != test.enterprise || specific != test.specific {
+			t.Errorf("%s: %s %d, want %s %d", test.oid, enterprise, specific, test.enterprise, test.specific)
+		}
+	}
+}
@@ -11,35 +11,41 @@ import (
 
 var startTime = time.Now()
 
-func getRunningTimeInSeconds() float64 {
-	return time.Since(startTime).Seconds()
+// sysUpTime, 单位为 0.01 秒
+func getSysUpTime() TimesTamp {
+	return TimesTamp(time.Since(startTime) / (10 * time.Millisecond))
 }
 
-// ExtractEnterpriseIDAndSpecificTrap 解析 Trap OID 并提取企业 ID 和 SpecificTrap
+// ExtractEnterpriseIDAndSpecificTrap 按 RFC 3584 3.2 把通知 OID 转换为 v1 的企业 ID 和 SpecificTrap:
+// 倒数第二位为 0 时企业 ID 去掉最后两位, 否则去掉最后一位, SpecificTrap 为最后一位
 func ExtractEnterpriseIDAndSpecificTrap(oid string) (string, int, error) {
 	// 将 OID 分割成各个部分
-	parts := strings.Split(oid, ".")
-	if len(parts) < 2 {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 3 {
 		return "", 0, fmt.Errorf("无效的 OID: %s", oid)
 	}
 
 	// 检查 OID 是否满足基本格式：企业 OID 以 ".1.3.6.1.4.1" 开头
 	// "1.3.6.1.4.1" 是企业 OID 的标准前缀
 	// "1.3.6.1.2.1" 是 IANA OID 的标准前缀
-	if !strings.HasPrefix(oid, "1.3.6.1.4.1") && !strings.HasPrefix(oid, "1.3.6.1.2.1") {
+	trimmed := strings.TrimPrefix(oid, ".")
+	if !strings.HasPrefix(trimmed, "1.3.6.1.4.1.") && !strings.HasPrefix(trimmed, "1.3.6.1.2.1.") {
 		return "", 0, fmt.Errorf("OID 不是企业特定的 OID: %s", oid)
 	}
 
-	// 提取企业 ID，去掉最后两部分（Trap 的 ".0.x" 部分）
-	enterpriseID := strings.Join(parts[:len(parts)-2], ".")
-
 	// 提取 SpecificTrap，最后一位是 Trap 编号
 	specificTrap, err := strconv.Atoi(parts[len(parts)-1])
 	if err != nil {
 		return "", 0, fmt.Errorf("无法解析 SpecificTrap 值: %v", err)
 	}
 
-	return enterpriseID, specificTrap, nil
+	// 提取企业 ID，v1 形式的 ".0.x" 去掉最后两部分
+	enterprise := parts[:len(parts)-1]
+	if parts[len(parts)-2] == "0" {
+		enterprise = parts[:len(parts)-2]
+	}
+
+	return "." + strings.Join(enterprise, "."), specificTrap, nil
 }
 
 func getAuthProto(proto string) gosnmp.SnmpV3AuthProtocol {
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Webhook 通知。
+// 告警产生、清除和测试完成时向配置的地址 POST 一条 JSON, 每个地址一个发送协程,
+// 失败后按退避时间重试, 配置了 Secret 时在 X-Signature-256 中带上 HMAC-SHA256 签名。
+
+const (
+	WebhookAlarmRaised   = "alarm-raised"
+	WebhookAlarmCleared  = "alarm-cleared"
+	WebhookTestCompleted = "test-completed"
+)
+
+const (
+	webhookTimeout    = 10 * time.Second
+	webhookRetries    = 3
+	webhookRetryDelay = 5 * time.Second
+	webhookMaxPending = 100 // 发送协程积压超过后丢弃新的通知, 同样用于 AddHandler 添加的处理函数
+)
+
+type WebhookEvent struct {
+	Event string    `json:"event"`
+	Time  time.Time `json:"timestamp"`
+
+	AlarmId   int    `json:"alarm-id,omitempty"`
+	AlarmOID  string `json:"alarm-oid,omitempty"`
+	AlarmName string `json:"alarm-name,omitempty"`
+
+	AlarmSuppressed int `json:"alarm-suppressed,omitempty"` // 抖动结束时, 抖动期间未发送的变化次数
+
+	TestName    string `json:"test-name,omitempty"`
+	TestSummary int    `json:"test-summary,omitempty"` // upsTestResultsSummary
+	TestDetail  string `json:"test-detail,omitempty"`
+
+	BatteryCharge    int `json:"battery-charge"`    // %
+	MinutesRemaining int `json:"minutes-remaining"` // 分钟
+	InputVoltage     int `json:"input-voltage"`     // V
+}
+
+type WebhookConfig struct {
+	URL         string
+	Events      []string // 为空时发送所有事件
+	Template    string   // text/template, 为空时发送 WebhookEvent 的 JSON
+	ContentType string
+	Secret      string // HMAC-SHA256 密钥, 为空时不签名
+	Headers     map[string]string
+
+	Timeout    time.Duration
+	Retries    int           // 失败后的重试次数, 0 为默认 3 次, 小于 0 时不重试
+	RetryDelay time.Duration // 第一次重试的等待时间, 之后每次加倍
+}
+
+type Webhook struct {
+	Config WebhookConfig
+
+	template *template.Template
+	client   *http.Client
+	events   chan WebhookEvent
+}
+
+// 事件处理函数, 在单独的协程中按顺序调用
+type notifyHandler struct {
+	handle func(event WebhookEvent)
+	events chan WebhookEvent
+}
+
+type Notifier struct {
+	Webhooks []*Webhook
+	handlers []*notifyHandler
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	// 输出 JSON 字面量, 用于在模板中安全地嵌入字符串
+	"json": func(v any) (string, error) {
+		dataBytes, err := json.Marshal(v)
+		return string(dataBytes), err
+	},
+}
+
+// 检查配置并启动发送协程
+func NewNotifier(configs []WebhookConfig) (*Notifier, error) {
+	n := &Notifier{stop: make(chan struct{})}
+	for i, config := range configs {
+		u, err := url.Parse(config.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook %d: invalid url '%s'", i+1, config.URL)
+		}
+		for _, event := range config.Events {
+			switch event {
+			case WebhookAlarmRaised, WebhookAlarmCleared, WebhookTestCompleted:
+			default:
+				return nil, fmt.Errorf("webhook %s: unknown event '%s'", config.URL, event)
+			}
+		}
+		if config.ContentType == "" {
+			config.ContentType = "application/json"
+		}
+		if config.Timeout <= 0 {
+			config.Timeout = webhookTimeout
+		}
+		if config.Retries == 0 {
+			config.Retries = webhookRetries
+		} else if config.Retries < 0 {
+			config.Retries = 0
+		}
+		if config.RetryDelay <= 0 {
+			config.RetryDelay = webhookRetryDelay
+		}
+
+		webhook := &Webhook{
+			Config: config,
+			client: &http.Client{Timeout: config.Timeout},
+			events: make(chan WebhookEvent, webhookMaxPending),
+		}
+		if config.Template != "" {
+			webhook.template, err = template.New(config.URL).Funcs(webhookTemplateFuncs).Parse(config.Template)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %s: %w", config.URL, err)
+			}
+		}
+		n.Webhooks = append(n.Webhooks, webhook)
+	}
+
+	for _, webhook := range n.Webhooks {
+		n.wg.Add(1)
+		go webhook.run(n)
+	}
+	return n, nil
+}
+
+// 按当前读数生成事件, 调用方需持有 snmp.Lock
+func NewWebhookEvent(snmp *SNMP, event string) WebhookEvent {
+	e := WebhookEvent{Event: event, Time: time.Now()}
+	get := func(name string, index int) int {
+		value, err := snmp.GetValue(name, index)
+		if err != nil {
+			return 0
+		}
+		v, _ := metricValue(value)
+		return int(v)
+	}
+	e.BatteryCharge = get("upsEstimatedChargeRemaining", 0)
+	e.MinutesRemaining = get("upsEstimatedMinutesRemaining", 0)
+	e.InputVoltage = get("upsInputVoltage", 1)
+	return e
+}
+
+// 异步发送, n 为空时不做任何操作
+func (n *Notifier) Notify(event WebhookEvent) {
+	if n == nil {
+		return
+	}
+	for _, handler := range n.handlers {
+		select {
+		case handler.events <- event:
+		default:
+			Logger.Errorf("Notify handler is busy, drop %s event", event.Event)
+		}
+	}
+	for _, webhook := range n.Webhooks {
+		if !webhook.wants(event.Event) {
+			continue
+		}
+		select {
+		case webhook.events <- event:
+		default:
+			Logger.Errorf("Webhook %s is busy, drop %s event", webhook.Config.URL, event.Event)
+		}
+	}
+}
+
+// 添加事件处理函数 (如 MQTT 发布)。
+// Notify 在 Snmp.Lock 中调用, 处理函数在单独的协程中运行, 可以阻塞
+func (n *Notifier) AddHandler(handle func(event WebhookEvent)) {
+	handler := &notifyHandler{
+		handle: handle,
+		events: make(chan WebhookEvent, webhookMaxPending),
+	}
+	n.handlers = append(n.handlers, handler)
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		for {
+			select {
+			case <-n.stop:
+				return
+			case event := <-handler.events:
+				handler.handle(event)
+			}
+		}
+	}()
+}
+
+// 停止发送协程, 正在重试的通知会被放弃
+func (n *Notifier) Close() {
+	if n == nil {
+		return
+	}
+	select {
+	case <-n.stop:
+		return
+	default:
+		close(n.stop)
+	}
+	n.wg.Wait()
+}
+
+func (w *Webhook) wants(event string) bool {
+	if len(w.Config.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Config.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+func (w *Webhook) body(event WebhookEvent) ([]byte, error) {
+	if w.template == nil {
+		return json.Marshal(event)
+	}
+	var buf bytes.Buffer
+	err := w.template.Execute(&buf, event)
+	return buf.Bytes(), err
+}
+
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (w *Webhook) run(n *Notifier) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.stop:
+			return
+		case event := <-w.events:
+			w.deliver(event, n.stop)
+		}
+	}
+}
+
+func (w *Webhook) deliver(event WebhookEvent, stop chan struct{}) {
+	body, err := w.body(event)
+	if err != nil {
+		Logger.Errorf("Webhook %s template faild: %s", w.Config.URL, err.Error())
+		return
+	}
+	delay := w.Config.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err = w.post(body)
+		if err == nil {
+			Logger.Debugf("Webhook %s: %s delivered", w.Config.URL, event.Event)
+			return
+		}
+		if attempt >= w.Config.Retries {
+			Logger.Errorf("Webhook %s: %s faild after %d attempts: %s", w.Config.URL, event.Event, attempt+1, err.Error())
+			return
+		}
+		Logger.Warnf("Webhook %s: %s faild (attempt %d): %s, retry in %s", w.Config.URL, event.Event, attempt+1, err.Error(), delay)
+		select {
+		case <-stop:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+func (w *Webhook) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", w.Config.ContentType)
+	for name, value := range w.Config.Headers {
+		req.Header.Set(name, value)
+	}
+	if w.Config.Secret != "" {
+		req.Header.Set("X-Signature-256", webhookSignature(w.Config.Secret, body))
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testWebhookRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// 记录收到的请求, 前 fail 次返回 500
+func newTestWebhookServer(t *testing.T, fail int) (*httptest.Server, func() []testWebhookRequest) {
+	t.Helper()
+
+	var lock sync.Mutex
+	var received []testWebhookRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		received = append(received, testWebhookRequest{Header: r.Header, Body: body})
+		if len(received) <= fail {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	wait := func() []testWebhookRequest {
+		time.Sleep(200 * time.Millisecond)
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]testWebhookRequest{}, received...)
+	}
+	return server, wait
+}
+
+// 告警产生时 POST 签名的 JSON, 失败后重试
+func TestWebhook(t *testing.T) {
+	server, received := newTestWebhookServer(t, 1)
+	snmp := newTestAgent(t, "mt1000-pro", SNMPConfig{})
+	notifier, err := NewNotifier([]WebhookConfig{{
+		URL:        server.URL,
+		Events:     []string{WebhookAlarmRaised},
+		Secret:     "secret",
+		Headers:    map[string]string{"X-Source": "ups"},
+		RetryDelay: 10 * time.Millisecond,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(notifier.Close)
+	snmp.Notifier = notifier
+
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+	serialReceived(snmp, "Q1", "(000.0 228.0 228.4 017 00.0 26.1 25.0 10001000")
+	// 清除事件未订阅
+	serialReceived(snmp, "Q1", "(228.0 228.0 228.4 017 50.0 27.1 25.0 00001000")
+
+	requests := received()
+	if len(requests) != 3 {
+		t.Fatalf("received %d requests, want 3 (1 retry + 2 alarms)", len(requests))
+	}
+	names := map[string]bool{}
+	for _, request := range requests[1:] {
+		if sig := request.Header.Get("X-Signature-256"); sig != webhookSignature("secret", request.Body) {
+			t.Errorf("signature %q", sig)
+		}
+		if request.Header.Get("X-Source") != "ups" || request.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("headers %v", request.Header)
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(request.Body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Event != WebhookAlarmRaised || event.AlarmOID != snmp.GetOID(event.AlarmName, -1) || event.AlarmId == 0 {
+			t.Errorf("event %+v", event)
+		}
+		if event.BatteryCharge == 0 || event.InputVoltage != 0 || time.Since(event.Time) > time.Minute {
+			t.Errorf("readings %+v", event)
+		}
+		names[event.AlarmName] = true
+	}
+	if !names["upsAlarmInputBad"] || !names["upsAlarmOnBattery"] {
+		t.Errorf("alarms %v", names)
+	}
+}
+
+func TestWebhookTemplate(t *testing.T) {
+	server, received := newTestWebhookServer(t, 0)
+	notifier, err := NewNotifier([]WebhookConfig{{
+		URL:      server.URL,
+		Template: `{"text": {{json (printf "%s: %s" .TestName .TestDetail)}}}`,
+		Retries:  -1,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(notifier.Close)
+
+	notifier.Notify(WebhookEvent{
+		Event:       WebhookTestCompleted,
+		TestName:    "upsTestQuickBatteryTest",
+		TestSummary: 1,
+		TestDetail:  `Quick battery test "passed"`,
+	})
+	requests := received()
+	if len(requests) != 1 {
+		t.Fatalf("received %d requests, want 1", len(requests))
+	}
+	want := `{"text": "upsTestQuickBatteryTest: Quick battery test \"passed\""}`
+	if string(requests[0].Body) != want {
+		t.Errorf("body %s, want %s", requests[0].Body, want)
+	}
+	if requests[0].Header.Get("X-Signature-256") != "" {
+		t.Error("signed without secret")
+	}
+
+	for _, config := range []WebhookConfig{
+		{URL: "ftp://example.com"},
+		{URL: server.URL, Events: []string{"alarm"}},
+		{URL: server.URL, Template: "{{.Event"},
+	} {
+		if _, err := NewNotifier([]WebhookConfig{config}); err == nil {
+			t.Errorf("%+v accepted", config)
+		}
+	}
+}
+
+// 处理函数阻塞时 Notify 不等待, 事件按顺序交给处理函数, 积压过多时丢弃
+func TestNotifierHandler(t *testing.T) {
+	notifier, err := NewNotifier(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{}, 1)
+	block := make(chan struct{})
+	handled := make(chan string, webhookMaxPending+2)
+	notifier.AddHandler(func(event WebhookEvent) {
+		select {
+		case started <- struct{}{}:
+		default:
+		}
+		<-block
+		handled <- event.Event
+	})
+
+	// 第一个事件被取出后处理函数阻塞, 之后最多积压 webhookMaxPending 个
+	notifier.Notify(WebhookEvent{Event: WebhookAlarmRaised})
+	<-started
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < webhookMaxPending+10; i++ {
+			notifier.Notify(WebhookEvent{Event: WebhookAlarmRaised})
+		}
+		notifier.Notify(WebhookEvent{Event: WebhookAlarmCleared})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Notify blocked by handler")
+	}
+
+	close(block)
+	for i := 0; i < webhookMaxPending+1; i++ {
+		select {
+		case event := <-handled:
+			if event != WebhookAlarmRaised {
+				t.Fatalf("event %d: %s", i, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("handled %d events, want %d", i, webhookMaxPending+1)
+		}
+	}
+	notifier.Close()
+	if len(handled) != 0 {
+		t.Fatalf("%d events handled after dropping", len(handled))
+	}
+}